@@ -0,0 +1,129 @@
+package buffer_manager
+
+import (
+	"log"
+	fm "oh_my_godb/file_manager"
+	"sync"
+	"time"
+)
+
+/*
+backgroundWriter trickles the dirty pages into the disk, so the Pin() evicting a buffer seldom writes it by itself.
+
+	every interval:
+	  |buff0 dirty|buff1 pinned|buff2 dirty|buff3 clean|...   --> the snapshots of maxPages dirty unpinned buffers
+	              ⬆ cursor, the round goes on from the last one   --> FlushByLSN(page LSN), then write each snapshot
+
+- the snapshots are taken with the mutex of the BufferManager held, the IO is done without it
+- like the Buffer.Flush(), the log is flushed before the page, the WAL holds
+- a buffer changed or reassigned since its snapshot is skipped, see Buffer.writeSnapshot()
+*/
+type backgroundWriter struct {
+	bufferMgr *BufferManager
+	interval  time.Duration
+	maxPages  int
+	cursor    int // the frame the next round starts from
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+type pageSnapshot struct {
+	buff    *Buffer
+	page    *fm.Page
+	blk     *fm.BlockId
+	lsn     uint64
+	version uint64
+}
+
+/*
+StartBackgroundWriter a background writer writes the dirty unpinned buffers into the disk.
+
+@param interval the pause between the rounds
+
+@param maxPages the most pages written in a round, the rate is maxPages per interval
+*/
+func (b *BufferManager) StartBackgroundWriter(interval time.Duration, maxPages int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.writer != nil {
+		return
+	}
+
+	w := &backgroundWriter{
+		bufferMgr: b,
+		interval:  interval,
+		maxPages:  max(maxPages, 1),
+		stop:      make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.run()
+
+	b.writer = w
+}
+
+// StopBackgroundWriter the round being written is done before it returns
+func (b *BufferManager) StopBackgroundWriter() {
+	b.mu.Lock()
+	w := b.writer
+	b.writer = nil
+	b.mu.Unlock()
+
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	w.wg.Wait()
+}
+
+func (w *backgroundWriter) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.writeRound()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// writeRound writes up to maxPages dirty unpinned buffers from the cursor
+func (w *backgroundWriter) writeRound() {
+	b := w.bufferMgr
+
+	b.mu.Lock()
+	var snapshots []pageSnapshot
+	for i := 0; i < len(b.bufferPool) && len(snapshots) < w.maxPages; i++ {
+		buff := b.bufferPool[(w.cursor+i)%len(b.bufferPool)]
+		page, blk, lsn, version, ok := buff.snapshot()
+		if ok {
+			snapshots = append(snapshots, pageSnapshot{buff, page, blk, lsn, version})
+		}
+	}
+	if len(snapshots) > 0 {
+		w.cursor = (snapshots[len(snapshots)-1].buff.frame + 1) % len(b.bufferPool)
+	}
+	b.mu.Unlock()
+
+	written := uint64(0)
+	for _, snapshot := range snapshots {
+		ok, err := snapshot.buff.writeSnapshot(snapshot.page, snapshot.blk, snapshot.lsn, snapshot.version)
+		if err != nil {
+			log.Printf("the background writer fails to write block %d of %s: %v\n",
+				snapshot.blk.BlkNum(), snapshot.blk.GetFilePath(), err)
+			continue
+		}
+		if ok {
+			written += 1
+		}
+	}
+
+	b.mu.Lock()
+	b.stats.BackgroundWrites += written
+	b.mu.Unlock()
+}
@@ -0,0 +1,109 @@
+package buffer_manager
+
+import (
+	"github.com/stretchr/testify/require"
+	fm "oh_my_godb/file_manager"
+	lm "oh_my_godb/log_manager"
+	"testing"
+	"time"
+)
+
+func TestBackgroundWriter(t *testing.T) {
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 64, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	for i := 0; i < 8; i++ {
+		_, err = fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+	bm := NewBufferManager(fileManager, logManager, 4)
+
+	// the blocks 0 .. 3 are dirty, their log records aren't flushed yet
+	for i := uint64(0); i < 4; i++ {
+		buff, err := bm.Pin(fm.NewBlockId("testfile", i))
+		require.Nil(t, err)
+		lsn, err := logManager.AppendLogRecordIntoPage([]byte{byte(i)})
+		require.Nil(t, err)
+		buff.Contents().SetInt(8, 100+i)
+		buff.SetModified(1, lsn)
+		bm.Unpin(buff)
+	}
+	require.Equal(t, 4, len(bm.DirtyPages()))
+
+	// 2 pages a round
+	bm.StartBackgroundWriter(5*time.Millisecond, 2)
+	require.Eventually(t, func() bool {
+		return bm.Stats().BackgroundWrites == 4
+	}, 2*time.Second, 5*time.Millisecond)
+	bm.StopBackgroundWriter()
+	require.Empty(t, bm.DirtyPages())
+
+	page := fm.NewPageBySize(fileManager.BlockSize())
+	for i := uint64(0); i < 4; i++ {
+		_, err = fileManager.Read(fm.NewBlockId("testfile", i), page)
+		require.Nil(t, err)
+		require.Equal(t, 100+i, page.GetInt(8))
+	}
+	// the log is flushed before the pages, a new log manager finds all the records
+	restarted, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	require.Equal(t, logManager.LatestLSN(), restarted.LatestLSN())
+
+	// the evictions write nothing
+	for i := uint64(4); i < 8; i++ {
+		buff, err := bm.Pin(fm.NewBlockId("testfile", i))
+		require.Nil(t, err)
+		bm.Unpin(buff)
+	}
+	require.Equal(t, uint64(0), bm.Stats().DirtyEvictions)
+}
+
+func TestBackgroundWriterSkipsChangedBuffers(t *testing.T) {
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 64, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+	bm := NewBufferManager(fileManager, logManager, 1)
+
+	buff, err := bm.Pin(fm.NewBlockId("testfile", 0))
+	require.Nil(t, err)
+	buff.Contents().SetInt(8, 1)
+	buff.SetModified(1, 0)
+	// a pinned buffer may be changing, it isn't taken
+	_, _, _, _, ok := buff.snapshot()
+	require.False(t, ok)
+	bm.Unpin(buff)
+
+	// changed since the snapshot, it's still dirty
+	page, blk, lsn, version, ok := buff.snapshot()
+	require.True(t, ok)
+	buff, err = bm.Pin(fm.NewBlockId("testfile", 0))
+	require.Nil(t, err)
+	buff.Contents().SetInt(8, 2)
+	buff.SetModified(1, 0)
+	bm.Unpin(buff)
+	written, err := buff.writeSnapshot(page, blk, lsn, version)
+	require.Nil(t, err)
+	require.False(t, written)
+	require.Greater(t, buff.RecLSN(), uint64(0))
+
+	// reassigned since the snapshot, the old block isn't overwritten by it
+	page, blk, lsn, version, ok = buff.snapshot()
+	require.True(t, ok)
+	buff, err = bm.Pin(fm.NewBlockId("testfile", 1))
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), bm.Stats().DirtyEvictions)
+	written, err = buff.writeSnapshot(page, blk, lsn, version)
+	require.Nil(t, err)
+	require.False(t, written)
+
+	page = fm.NewPageBySize(fileManager.BlockSize())
+	_, err = fileManager.Read(fm.NewBlockId("testfile", 0), page)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), page.GetInt(8))
+}
@@ -1,8 +1,10 @@
 package buffer_manager
 
 import (
+	"errors"
 	fm "oh_my_godb/file_manager"
 	lm "oh_my_godb/log_manager"
+	"sync"
 )
 
 /*
@@ -15,6 +17,16 @@ Buffer describes the following things:
 3. log serviced provided by LogFileManager, and Write-Read service provided by FileManager
 
 4. pins acts as a reference count, which indicates how many components are using this buffer.
+
+5. recLSN, the LSN since which the page is dirty, the checkpoint records it in the dirty page table.
+
+6. corrupt, the *fm.ErrCorruptBlock if the block read fails its checksum. The transactions can't use the page then,
+only the recovery may Repair() it, see RecoveryManager.redo().
+
+7. version, changed by each SetModified() and AssignToBlock(), the background writer writes its snapshot of
+the page only if the version is the same, see writeSnapshot().
+
+The txNum, lsn, recLSN and version are guarded by mu, as the checkpoint reads them while the transactions are running.
 */
 type Buffer struct {
 	fm       *fm.FileManager // init
@@ -23,7 +35,15 @@ type Buffer struct {
 	lm       *lm.LogFileManager // init, for recovery
 	pins     uint32             // refCount
 	txNum    int32              // init, transaction number
-	lsn      uint64             // init, log sequence number
+	lsn      uint64             // init, log sequence number, the page LSN: the LSN of the latest log record applied to the page, written along with it
+	recLSN   uint64             // the LSN of the first log record which may be missing in the disk, 0 if the page is clean
+	corrupt  error              // the page read fails its checksum, nil if it's fine
+	frame    int                // the index in the bufferPool, see ReplacementPolicy
+	version  uint64
+	// guarded by the mutex of the BufferManager, see BufferManager.prefetch()
+	loading    chan struct{} // closed once the prefetched block is read, nil if not loading
+	prefetched bool          // prefetched and not pinned since
+	mu         sync.Mutex
 }
 
 func NewBuffer(fileManager *fm.FileManager, logManager *lm.LogFileManager) *Buffer {
@@ -59,10 +79,40 @@ TODO: ?
 @param lsn log sequence number, used for recovery
 */
 func (b *Buffer) SetModified(txNum int32, lsn uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.isDirty() {
+		// without the lsn, the change is logged later or never, so the next log record is the earliest
+		b.recLSN = lsn
+		if lsn == 0 {
+			b.recLSN = b.lm.LatestLSN() + 1
+		}
+	}
+
 	b.txNum = txNum
 	if lsn > 0 {
 		b.lsn = lsn
 	}
+	b.version += 1
+}
+
+func (b *Buffer) isDirty() bool {
+	return b.txNum > 0
+}
+
+// LSN the recovery skips the log records which are older than the page LSN, as they are already in the page
+func (b *Buffer) LSN() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lsn
+}
+
+// RecLSN returns 0 if the page is clean, see the recLSN
+func (b *Buffer) RecLSN() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.recLSN
 }
 
 /*
@@ -74,45 +124,149 @@ func (b *Buffer) IsPinned() bool {
 
 // ModifyingTx return the transaction number of the modifying transaction
 func (b *Buffer) ModifyingTx() int32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	return b.txNum
 }
 
-// AssignToBlock assign the buffer to a block
-func (b *Buffer) AssignToBlock(blk *fm.BlockId) {
-	//before assignment, flush the buffer into disk
+/*
+AssignToBlock assign the buffer to a block. A block failing its checksum is still assigned, marked as corrupt,
+the error is kept by Corrupt(). Any other error leaves the buffer unassigned.
 
-	b.Flush()
+If the old page can't be written back, the buffer keeps the old block and stays dirty, nothing is read,
+so a dirty buffer always has its block.
 
-	_, err := b.fm.Read(blk, b.contents)
+The buffer keeps its own copy of the blk, so the caller changing its BlockId doesn't move the buffer.
+*/
+func (b *Buffer) AssignToBlock(blk *fm.BlockId) error {
+	//before assignment, flush the buffer into disk
+	err := b.Flush()
 	if err != nil {
-		return
+		return err
 	}
 
-	b.blk = blk
+	// the snapshot of the old block taken by the background writer is stale
+	b.mu.Lock()
+	b.version += 1
+	b.mu.Unlock()
+
+	_, err = b.fm.Read(blk, b.contents)
+	return b.assign(blk, err)
+}
+
+// loadBlock like the AssignToBlock(), the page is read by the caller, the buffer must be clean
+func (b *Buffer) loadBlock(blk *fm.BlockId, page *fm.Page, err error) error {
+	b.mu.Lock()
+	b.version += 1
+	b.mu.Unlock()
+
+	b.contents.SetRawBytes(0, page.GetRawBytes(0, b.fm.BlockSize()))
+	b.contents.SetLSN(page.LSN())
+	return b.assign(blk, err)
+}
+
+// assign the contents are read from the blk with the err
+func (b *Buffer) assign(blk *fm.BlockId, err error) error {
+	var corruptErr *fm.ErrCorruptBlock
+	if err != nil && !errors.As(err, &corruptErr) {
+		b.blk = nil // the contents are no longer the old block's
+		return err
+	}
+
+	blkCopy := *blk
+	b.blk = &blkCopy
 	b.pins = 0
+	b.mu.Lock()
+	b.lsn = b.contents.LSN() // 0 if the block is corrupt, the recovery redoes all its log records then
+	b.corrupt = err
+	b.mu.Unlock()
+	return nil
+}
+
+// Corrupt returns the *fm.ErrCorruptBlock if the page read fails its checksum, nil otherwise
+func (b *Buffer) Corrupt() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.corrupt
 }
 
 /*
-Flush flush the log and the buffer into disk
+Repair the page is usable again. Only the recovery calls it, once it redoes the page: a torn page differs from
+the last one written in full only in the changes since then, which are all redone.
 */
-func (b *Buffer) Flush() {
+func (b *Buffer) Repair() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.corrupt = nil
+}
 
-	var err error
+/*
+Flush flush the log and the buffer into disk. The log is synced, the page is synced only with SYNC_ALWAYS,
+a page lost by a crash is redone from the log. The buffer is still dirty if it fails.
+*/
+func (b *Buffer) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	if b.txNum > 0 {
+	if !b.isDirty() {
+		return nil
+	}
 
-		err = b.lm.FlushByLSN(b.lsn) //write back the log
-		if err != nil {
-			return
-		}
+	err := b.lm.FlushByLSN(b.lsn) //write back the log
+	if err != nil {
+		return err
+	}
 
-		_, err = b.fm.Write(b.blk, b.contents) //write back the buffer
-		if err != nil {
-			return
-		}
-		//-1, indicates this transaction is committed
-		b.txNum = -1
+	b.contents.SetLSN(b.lsn)
+	_, err = b.fm.Write(b.blk, b.contents) //write back the buffer, along with the page LSN
+	if err != nil {
+		return err
+	}
+	//-1, indicates this transaction is committed
+	b.txNum = -1
+	b.recLSN = 0
+	return nil
+}
+
+/*
+snapshot copies the page of a dirty buffer, the caller holds the mutex of the BufferManager and the buffer is unpinned,
+so nobody is changing the page. The ok is false if the buffer is clean.
+*/
+func (b *Buffer) snapshot() (page *fm.Page, blk *fm.BlockId, lsn uint64, version uint64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.isDirty() || b.IsPinned() {
+		return nil, nil, 0, 0, false
+	}
+	page = fm.NewPageByBytes(b.contents.GetRawBytes(0, b.fm.BlockSize()))
+	page.SetLSN(b.lsn)
+	return page, b.blk, b.lsn, b.version, true
+}
+
+/*
+writeSnapshot like the Flush(), the log is flushed to the page LSN before the snapshot is written, and the buffer is
+clean since then. A buffer changed or reassigned since the snapshot is skipped, as the snapshot may be older than the
+block on the disk, it's still dirty anyway. The written is false if it's skipped.
+*/
+func (b *Buffer) writeSnapshot(page *fm.Page, blk *fm.BlockId, lsn uint64, version uint64) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.version != version || !b.isDirty() {
+		return false, nil
+	}
+	err := b.lm.FlushByLSN(lsn)
+	if err != nil {
+		return false, err
+	}
+	_, err = b.fm.Write(blk, page)
+	if err != nil {
+		return false, err
 	}
+	b.txNum = -1
+	b.recLSN = 0
+	return true, nil
 }
 
 func (b *Buffer) Pin() {
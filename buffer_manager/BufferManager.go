@@ -1,7 +1,8 @@
 package buffer_manager
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	fm "oh_my_godb/file_manager"
 	lm "oh_my_godb/log_manager"
 	"sync"
@@ -9,9 +10,27 @@ import (
 )
 
 const (
-	MAX_TIME = 3 // max time to wait for a buffer allocation
+	MAX_TIME = 3 // max time to wait for a buffer allocation, unless the ctx of the PinWithContext() has a deadline
 )
 
+/*
+ErrBufferAbort no buffer is freed for the blk before the ctx of the PinWithContext() is done. The caller should roll
+back to release its pins, e.g. the transactions pin all the buffers and wait for each other, see Transaction.Pin().
+*/
+type ErrBufferAbort struct {
+	Blk   fm.BlockId
+	Cause error // the ctx.Err(), context.DeadlineExceeded or context.Canceled
+}
+
+func (e *ErrBufferAbort) Error() string {
+	return fmt.Sprintf("no buffer available for block %d in the file %s: %v",
+		e.Blk.BlkNum(), e.Blk.GetFilePath(), e.Cause)
+}
+
+func (e *ErrBufferAbort) Unwrap() error {
+	return e.Cause
+}
+
 /*
 BufferManager also the refCounter BufferManager
 
@@ -20,22 +39,81 @@ If and only if the buffer wants to bind another block, will this buffer trigger
 
 - Unpin(), doesn't contain the writing strategy, just reduce the count by 1, if the count is 0,
 increase the numAvailable by 1, and notify all waiting threads.
+
+- the waiters of a free buffer wait on the freed channel without the mutex, the Unpin() freeing a buffer closes it
+and makes a new one, like the notifyChan of the LockTable
+
+- the ReplacementPolicy chooses which unpinned buffer to evict, the LRUPolicy by default, see NewBufferManagerWithPolicy()
+
+- the pageTable maps each block in the pool to its frame, a Pin() finds its block in O(1) instead of scanning the pool
+
+	pageTable              bufferPool
+	{file1, 3} --> 0 -->  |buff0 blk3|
+	{file2, 0} --> 2 --+  |buff1 nil |  the buffers without a block aren't in the pageTable
+	                   +->|buff2 blk0|
+
+- the background writer, if started, writes the dirty pages ahead of the evictions, see StartBackgroundWriter()
+
+- the sequential scans are read ahead, if set, see SetReadAhead()
 */
 type BufferManager struct {
+	fileMgr      *fm.FileManager
 	bufferPool   []*Buffer
+	pageTable    map[fm.BlockId]int // the block -> the frame of its buffer
 	numAvailable uint32
+	policy       ReplacementPolicy
+	stats        BufferStats
+	freed        chan struct{} // closed once a buffer is freed
+	writer       *backgroundWriter
+	readAhead    int
+	sequences    map[string]*sequence // the file -> its sequential access
+	prefetching  sync.WaitGroup
 	mu           sync.Mutex
 }
 
+/*
+BufferStats the pins served by the pool, the hits, and the ones reading their block, the misses.
+The DirtyEvictions are the misses writing the dirty page of their victim first, the background writer saves them.
+The PrefetchHits are the hits of the blocks prefetched, the PrefetchWasted are the blocks prefetched but evicted
+before any pin.
+*/
+type BufferStats struct {
+	Hits             uint64
+	Misses           uint64
+	DirtyEvictions   uint64
+	BackgroundWrites uint64 // the pages written by the background writer
+	Prefetches       uint64 // the blocks read ahead
+	PrefetchHits     uint64
+	PrefetchWasted   uint64
+}
+
 func NewBufferManager(fm *fm.FileManager, lm *lm.LogFileManager, numBuffer uint32) *BufferManager {
+	return NewBufferManagerWithPolicy(fm, lm, numBuffer, NewLRUPolicy())
+}
+
+// NewBufferManagerWithPolicy the policy is used by this BufferManager only, e.g. NewClockPolicy(), NewLRUKPolicy()
+func NewBufferManagerWithPolicy(
+	fileManager *fm.FileManager,
+	logManager *lm.LogFileManager,
+	numBuffer uint32,
+	policy ReplacementPolicy,
+) *BufferManager {
 	bufferManager := &BufferManager{
+		fileMgr:      fileManager,
 		numAvailable: numBuffer,
+		pageTable:    make(map[fm.BlockId]int, numBuffer),
+		freed:        make(chan struct{}),
+		policy:       policy,
+		sequences:    make(map[string]*sequence),
 		mu:           sync.Mutex{},
 	}
 
 	for i := uint32(0); i < numBuffer; i++ {
-		buffer := NewBuffer(fm, lm)
+		buffer := NewBuffer(fileManager, logManager)
+		buffer.frame = int(i)
 		bufferManager.bufferPool = append(bufferManager.bufferPool, buffer)
+		// the buffers are all free at first
+		policy.Unpin(buffer.frame)
 	}
 
 	return bufferManager
@@ -47,39 +125,92 @@ func (b *BufferManager) Available() uint32 {
 	return b.numAvailable
 }
 
-func (b *BufferManager) FlushAll(txNum int32) {
+// Stats the hits and misses since the BufferManager is created
+func (b *BufferManager) Stats() BufferStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// FlushAll writes back the pages modified by the txNum, it stops at the first page failing to be written
+func (b *BufferManager) FlushAll(txNum int32) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
 	for _, buffer := range b.bufferPool {
 		if buffer.ModifyingTx() == txNum {
-			buffer.Flush()
+			err := buffer.Flush()
+			if err != nil {
+				return err
+			}
 		}
 	}
 
+	return nil
+}
+
+/*
+DirtyPages the dirty page table, maps each dirty block to its recLSN. The checkpoint records it,
+the recovery needs to redo nothing older than the smallest recLSN.
+*/
+func (b *BufferManager) DirtyPages() map[fm.BlockId]uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	dirtyPages := make(map[fm.BlockId]uint64)
+	for _, buffer := range b.bufferPool {
+		recLSN := buffer.RecLSN()
+		if recLSN > 0 {
+			dirtyPages[*buffer.Block()] = recLSN
+		}
+	}
+
+	return dirtyPages
 }
 
 /*
 Pin binds a block to a buffer and returns the buffer. Consumer.
+A block failing its checksum is pinned as well, see Buffer.Corrupt().
 */
 func (b *BufferManager) Pin(blk *fm.BlockId) (*Buffer, error) {
+	return b.PinWithContext(context.Background(), blk)
+}
+
+/*
+PinWithContext like the Pin(), it waits for an Unpin() freeing a buffer till the ctx is done, then returns
+the *ErrBufferAbort. A ctx without deadline waits MAX_TIME at most, a buffer never freed is a deadlock.
+A block being prefetched is waited for the same way.
+*/
+func (b *BufferManager) PinWithContext(ctx context.Context, blk *fm.BlockId) (*Buffer, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, MAX_TIME*time.Second)
+		defer cancel()
+	}
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	start := time.Now()
-	buff := b.tryPin(blk)
+	for {
+		wait := b.loading(blk)
+		if wait == nil {
+			buff, err := b.tryPin(blk)
+			if err != nil || buff != nil {
+				return buff, err
+			}
+			// the freed is taken with the mutex held, so an Unpin() since the tryPin() isn't missed
+			wait = b.freed
+		}
 
-	//retry
-	for buff == nil && b.waitingTooLong(start) == false {
-		time.Sleep(MAX_TIME * time.Second)
-		buff = b.tryPin(blk)
-		if buff == nil {
-			return nil, errors.New("no buffer available, potential deadlock")
+		b.mu.Unlock()
+		select {
+		case <-wait:
+			b.mu.Lock()
+		case <-ctx.Done():
+			b.mu.Lock()
+			return nil, &ErrBufferAbort{Blk: *blk, Cause: ctx.Err()}
 		}
 	}
-
-	return buff, nil
 }
 
 /*
@@ -98,20 +229,16 @@ func (b *BufferManager) Unpin(buff *Buffer) {
 	if !buff.IsPinned() {
 		//buff.Flush()
 		b.numAvailable++
-		//TODO:notifyAll
+		b.policy.Unpin(buff.frame)
+		// notify all the waiters, they race for the buffer
+		close(b.freed)
+		b.freed = make(chan struct{})
 	}
 
 }
 
-func (b *BufferManager) waitingTooLong(start time.Time) bool {
-	elapsed := time.Since(start).Seconds()
-	if elapsed > MAX_TIME {
-		return true
-	}
-	return false
-}
-
-func (b *BufferManager) tryPin(blk *fm.BlockId) *Buffer {
+// tryPin returns nil if no buffer is free, the error if the block can't be read
+func (b *BufferManager) tryPin(blk *fm.BlockId) (*Buffer, error) {
 	// check if the block is already in the buffer pool
 	buff := b.findExistingBuffer(blk)
 	//the blk doesn't exist in mem
@@ -121,11 +248,31 @@ func (b *BufferManager) tryPin(blk *fm.BlockId) *Buffer {
 
 		// no free buffer available
 		if buff == nil {
-			return nil
+			return nil, nil
+		}
+		b.evict(buff)
+		if buff.RecLSN() > 0 {
+			b.stats.DirtyEvictions += 1
 		}
 		/*这里会触发flush*/
-		buff.AssignToBlock(blk)
+		err := buff.AssignToBlock(blk)
+		if err != nil {
+			// the buffer keeps its dirty block if it isn't written back, or it's unassigned. It's free again anyway
+			if old := buff.Block(); old != nil {
+				b.pageTable[*old] = buff.frame
+			}
+			b.policy.Unpin(buff.frame)
+			return nil, err
+		}
+		b.pageTable[*blk] = buff.frame
+		b.stats.Misses += 1
+	} else {
+		b.stats.Hits += 1
+		if buff.prefetched {
+			b.stats.PrefetchHits += 1
+		}
 	}
+	buff.prefetched = false
 
 	// unpinned buff, a free buff
 	if buff.IsPinned() == false {
@@ -134,26 +281,46 @@ func (b *BufferManager) tryPin(blk *fm.BlockId) *Buffer {
 	}
 
 	buff.Pin()
+	b.policy.Pin(buff.frame)
+	b.observe(blk)
 
-	return buff
+	return buff, nil
 }
 
 // findExistingBuffer checks if the block is already in the buffer pool
 func (b *BufferManager) findExistingBuffer(blk *fm.BlockId) *Buffer {
-	for _, buffer := range b.bufferPool {
-		block := buffer.Block()
-		if block != nil && block.Equals(blk) {
-			return buffer
-		}
+	frame, ok := b.pageTable[*blk]
+	if !ok {
+		return nil
+	}
+	return b.bufferPool[frame]
+}
+
+// loading returns the channel closed once the blk is prefetched, nil if it isn't being prefetched
+func (b *BufferManager) loading(blk *fm.BlockId) chan struct{} {
+	frame, ok := b.pageTable[*blk]
+	if !ok {
+		return nil
+	}
+	return b.bufferPool[frame].loading
+}
+
+// evict the victim leaves the pageTable
+func (b *BufferManager) evict(buff *Buffer) {
+	if old := buff.Block(); old != nil {
+		delete(b.pageTable, *old)
+	}
+	if buff.prefetched {
+		b.stats.PrefetchWasted += 1
+		buff.prefetched = false
 	}
-	return nil
 }
 
+// chooseUnpinBuffer the victim of the policy, nil if all the buffers are pinned
 func (b *BufferManager) chooseUnpinBuffer() *Buffer {
-	for _, buffer := range b.bufferPool {
-		if !buffer.IsPinned() {
-			return buffer
-		}
+	frame, ok := b.policy.Evict(anyFrame)
+	if !ok {
+		return nil
 	}
-	return nil
+	return b.bufferPool[frame]
 }
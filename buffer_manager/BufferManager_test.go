@@ -1,10 +1,15 @@
 package buffer_manager
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/require"
 	fm "oh_my_godb/file_manager"
 	lm "oh_my_godb/log_manager"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestBufferManager(t *testing.T) {
@@ -15,10 +20,11 @@ func TestBufferManager(t *testing.T) {
 	require.Greater(t, BLOCK_SIZE, TEST_OFFSET)
 	var err error
 
-	file_manager, _ := fm.NewFileManager("buffertest", BLOCK_SIZE)
+	file_manager, _ := fm.NewFileManagerWithStorage(fm.NewMemStorage(), BLOCK_SIZE, fm.SYNC_ON_LOG_FLUSH)
 	log_manager, _ := lm.NewLogManager(file_manager, "logfile")
 
-	for i := 0; i < 3; i++ {
+	// the blocks 0 .. 4, a block beyond the end can't be pinned
+	for i := 0; i < 5; i++ {
 		_, err = file_manager.Append(FILE_NAME)
 		if err != nil {
 			return
@@ -97,3 +103,249 @@ func TestBufferManager(t *testing.T) {
 	//*/
 
 }
+
+func TestPageTable(t *testing.T) {
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 64, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+	bm := NewBufferManager(fileManager, logManager, 3)
+
+	// the pageTable agrees with the blocks of the buffers
+	checkPageTable := func() {
+		assigned := 0
+		for frame, buff := range bm.bufferPool {
+			if buff.Block() != nil {
+				assigned += 1
+				require.Equal(t, frame, bm.pageTable[*buff.Block()])
+			}
+		}
+		require.Equal(t, assigned, len(bm.pageTable))
+	}
+
+	// another BlockId of the same block finds the same buffer, even if the first one is changed since
+	blk := fm.NewBlockId("testfile", 1)
+	buff1, err := bm.Pin(blk)
+	require.Nil(t, err)
+	blk.SetBlkNum(2)
+	buff2, err := bm.Pin(fm.NewBlockId("testfile", 1))
+	require.Nil(t, err)
+	require.Same(t, buff1, buff2)
+	require.Equal(t, BufferStats{Hits: 1, Misses: 1}, bm.Stats())
+	bm.Unpin(buff1)
+	bm.Unpin(buff2)
+	checkPageTable()
+
+	// the evicted blocks leave the pageTable
+	for i := uint64(0); i < 5; i++ {
+		buff, err := bm.Pin(fm.NewBlockId("testfile", i))
+		require.Nil(t, err)
+		bm.Unpin(buff)
+		checkPageTable()
+	}
+	require.Equal(t, 3, len(bm.pageTable))
+
+	// a block beyond the end leaves its buffer without a block
+	_, err = bm.Pin(fm.NewBlockId("testfile", 10))
+	require.NotNil(t, err)
+	checkPageTable()
+	require.Equal(t, 2, len(bm.pageTable))
+}
+
+func TestPageLSNSurvivesEviction(t *testing.T) {
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 64, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+	bm := NewBufferManager(fileManager, logManager, 1)
+
+	lsn, err := logManager.AppendLogRecordIntoPage([]byte("update"))
+	require.Nil(t, err)
+	buff, err := bm.Pin(fm.NewBlockId("testfile", 0))
+	require.Nil(t, err)
+	buff.Contents().SetInt(0, 1)
+	buff.SetModified(1, lsn)
+	bm.Unpin(buff)
+
+	// the only buffer is taken by the block 1, the block 0 is written along with its page LSN
+	buff, err = bm.Pin(fm.NewBlockId("testfile", 1))
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), buff.LSN())
+	bm.Unpin(buff)
+
+	buff, err = bm.Pin(fm.NewBlockId("testfile", 0))
+	require.Nil(t, err)
+	require.Equal(t, lsn, buff.LSN())
+	require.Equal(t, uint64(1), buff.Contents().GetInt(0))
+	bm.Unpin(buff)
+}
+
+// failingStorage the writes of the testfile fail while failing is set
+type failingStorage struct {
+	*fm.MemStorage
+	failing atomic.Bool
+}
+
+type failingFile struct {
+	fm.StorageFile
+	storage *failingStorage
+	name    string
+}
+
+func (s *failingStorage) Open(name string) (fm.StorageFile, error) {
+	file, err := s.MemStorage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &failingFile{StorageFile: file, storage: s, name: name}, nil
+}
+
+func (f *failingFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.name == "testfile" && f.storage.failing.Load() {
+		return 0, errors.New("injected write failure")
+	}
+	return f.StorageFile.WriteAt(p, off)
+}
+
+func TestFailedFlushKeepsDirtyBlock(t *testing.T) {
+	storage := &failingStorage{MemStorage: fm.NewMemStorage()}
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 64, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+	bm := NewBufferManager(fileManager, logManager, 1)
+	blk0 := fm.NewBlockId("testfile", 0)
+	blk1 := fm.NewBlockId("testfile", 1)
+
+	buff, err := bm.Pin(blk0)
+	require.Nil(t, err)
+	buff.Contents().SetInt(0, 1)
+	buff.SetModified(1, 0)
+	bm.Unpin(buff)
+
+	// the victim can't be written back, it keeps its block and stays dirty
+	storage.failing.Store(true)
+	_, err = bm.Pin(blk1)
+	require.NotNil(t, err)
+	require.Equal(t, *blk0, *buff.Block())
+	require.Contains(t, bm.DirtyPages(), *blk0)
+	require.Equal(t, 0, bm.pageTable[*blk0])
+	require.NotNil(t, bm.FlushAll(1))
+
+	storage.failing.Store(false)
+	buff, err = bm.Pin(blk1)
+	require.Nil(t, err)
+	require.Empty(t, bm.DirtyPages())
+	bm.Unpin(buff)
+
+	page := fm.NewPageBySize(fileManager.BlockSize())
+	_, err = fileManager.Read(blk0, page)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), page.GetInt(0))
+}
+
+func TestPinWaitsForUnpin(t *testing.T) {
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 64, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+	bm := NewBufferManager(fileManager, logManager, 1)
+	buff0, err := bm.Pin(fm.NewBlockId("testfile", 0))
+	require.Nil(t, err)
+
+	// the waiter gets the buffer as soon as it's unpinned
+	done := make(chan error)
+	go func() {
+		buff, err := bm.PinWithContext(context.Background(), fm.NewBlockId("testfile", 1))
+		if err == nil {
+			bm.Unpin(buff)
+		}
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	bm.Unpin(buff0)
+	select {
+	case err = <-done:
+		require.Nil(t, err)
+		require.Less(t, time.Since(start), time.Second)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the waiter isn't woken up by the Unpin()")
+	}
+
+	// the waiters give up once their ctx is done
+	buff0, err = bm.Pin(fm.NewBlockId("testfile", 0))
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = bm.PinWithContext(ctx, fm.NewBlockId("testfile", 1))
+	var abortErr *ErrBufferAbort
+	require.True(t, errors.As(err, &abortErr))
+	require.Equal(t, *fm.NewBlockId("testfile", 1), abortErr.Blk)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = bm.PinWithContext(ctx, fm.NewBlockId("testfile", 1))
+	require.True(t, errors.Is(err, context.Canceled))
+
+	// the block already pinned needs no free buffer
+	buff, err := bm.PinWithContext(ctx, fm.NewBlockId("testfile", 0))
+	require.Nil(t, err)
+	require.Same(t, buff0, buff)
+}
+
+/*
+BenchmarkPinHit pins the blocks already in the pool, the lookup cost grows with the pool if it scans the pool,
+e.g. go test -bench PinHit
+
+	BenchmarkPinHit/buffers8       5406369      254.0 ns/op    the scan
+	BenchmarkPinHit/buffers1024     487246     2122   ns/op    the scan
+	BenchmarkPinHit/buffers8       4958410      252.9 ns/op    the pageTable
+	BenchmarkPinHit/buffers1024    3723718      295.3 ns/op    the pageTable
+*/
+func BenchmarkPinHit(b *testing.B) {
+	for _, buffers := range []int{8, 1024} {
+		b.Run(fmt.Sprintf("buffers%d", buffers), func(b *testing.B) {
+			fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 64, fm.SYNC_NEVER)
+			require.Nil(b, err)
+			logManager, err := lm.NewLogManager(fileManager, "logfile")
+			require.Nil(b, err)
+			bm := NewBufferManager(fileManager, logManager, uint32(buffers))
+			blks := make([]*fm.BlockId, buffers)
+			for i := range blks {
+				_, err = fileManager.Append("testfile")
+				require.Nil(b, err)
+				blks[i] = fm.NewBlockId("testfile", uint64(i))
+				buff, err := bm.Pin(blks[i])
+				require.Nil(b, err)
+				bm.Unpin(buff)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buff, err := bm.Pin(blks[i%buffers])
+				if err != nil {
+					b.Fatal(err)
+				}
+				bm.Unpin(buff)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package buffer_manager
+
+import (
+	"log"
+	fm "oh_my_godb/file_manager"
+)
+
+const (
+	DEFAULT_READ_AHEAD = 8 // the blocks read ahead of a sequential scan, see SetReadAhead()
+	SEQUENTIAL_RUN     = 2 // the consecutive blocks pinned before the scan is taken as sequential
+)
+
+// sequence the sequential access to a file, guarded by the mutex of the BufferManager
+type sequence struct {
+	next         uint64 // the block expected next
+	run          int    // the consecutive blocks pinned
+	prefetchedTo uint64 // the blocks before it are prefetched already
+}
+
+/*
+SetReadAhead once a file is pinned block after block, the next blocks are prefetched asynchronously, so a sequential
+scan like the TableScan seldom waits for a read:
+
+	Pin(blk3) Pin(blk4) --> sequential --> prefetch blk5 ... blk4+blocks
+	Pin(blk5) ... Pin(blk4+blocks/2) --> half of the window is used --> prefetch the next ones
+
+- the prefetches take only the clean candidates of the ReplacementPolicy, no eviction writes, the dirty ones keep their place
+- a prefetched block is unpinned like a block just released, a Pin() of a block being prefetched waits for the read
+- the blocks prefetched and evicted before any Pin() are the PrefetchWasted of the Stats()
+
+@param blocks the blocks read ahead, e.g. DEFAULT_READ_AHEAD, 0 turns it off, the default
+*/
+func (b *BufferManager) SetReadAhead(blocks int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.readAhead = max(blocks, 0)
+	b.sequences = make(map[string]*sequence)
+}
+
+/*
+StopPrefetch turns the read-ahead off and waits for the prefetches being read, e.g. before a shutdown.
+The caller gives no more Prefetch() hints meanwhile.
+*/
+func (b *BufferManager) StopPrefetch() {
+	b.mu.Lock()
+	b.readAhead = 0
+	b.mu.Unlock()
+
+	b.prefetching.Wait()
+}
+
+// Prefetch the hint of the blocks pinned soon, they're read asynchronously, the ones beyond the end of their files are ignored
+func (b *BufferManager) Prefetch(blks []*fm.BlockId) {
+	copies := make([]fm.BlockId, len(blks))
+	for i, blk := range blks {
+		copies[i] = *blk
+	}
+
+	b.prefetching.Add(1)
+	go func() {
+		defer b.prefetching.Done()
+		b.prefetch(copies)
+	}()
+}
+
+// observe detects the sequential access once the blk is pinned, and prefetches the blocks ahead of it
+func (b *BufferManager) observe(blk *fm.BlockId) {
+	if b.readAhead == 0 {
+		return
+	}
+
+	seq, ok := b.sequences[blk.GetFilePath()]
+	if !ok {
+		seq = &sequence{}
+		b.sequences[blk.GetFilePath()] = seq
+	}
+	switch {
+	case seq.run > 0 && blk.BlkNum()+1 == seq.next:
+		// pinned again
+		return
+	case seq.run > 0 && blk.BlkNum() == seq.next:
+		seq.run += 1
+	default:
+		seq.run = 1
+		seq.prefetchedTo = 0
+	}
+	seq.next = blk.BlkNum() + 1
+
+	// prefetch once half of the window is used
+	if seq.run < SEQUENTIAL_RUN || seq.prefetchedTo > seq.next+uint64(b.readAhead/2) {
+		return
+	}
+	start := max(seq.next, seq.prefetchedTo)
+	end := seq.next + uint64(b.readAhead)
+	blks := make([]fm.BlockId, 0, end-start)
+	for blkNum := start; blkNum < end; blkNum++ {
+		blks = append(blks, *fm.NewBlockId(blk.GetFilePath(), blkNum))
+	}
+	seq.prefetchedTo = end
+
+	b.prefetching.Add(1)
+	go func() {
+		defer b.prefetching.Done()
+		b.prefetch(blks)
+	}()
+}
+
+// prefetch reads the blocks into the buffers, in order, till no clean buffer is free
+func (b *BufferManager) prefetch(blks []fm.BlockId) {
+	sizes := make(map[string]uint64)
+	for _, blk := range blks {
+		size, ok := sizes[blk.GetFilePath()]
+		if !ok {
+			var err error
+			size, err = b.fileMgr.BlockNum(blk.GetFilePath())
+			if err != nil {
+				log.Printf("fails to prefetch the file %s: %v\n", blk.GetFilePath(), err)
+				return
+			}
+			sizes[blk.GetFilePath()] = size
+		}
+		if blk.BlkNum() >= size {
+			continue
+		}
+
+		b.mu.Lock()
+		buff, ok := b.startLoading(&blk)
+		b.mu.Unlock()
+		if !ok {
+			return
+		}
+		if buff == nil {
+			continue
+		}
+
+		page := fm.NewPageBySize(b.fileMgr.BlockSize())
+		_, err := b.fileMgr.Read(&blk, page)
+
+		b.mu.Lock()
+		b.finishLoading(buff, &blk, page, err)
+		b.mu.Unlock()
+	}
+}
+
+/*
+startLoading takes a clean victim for the blk and holds it till finishLoading(), the blk is in the pageTable since then.
+The buff is nil if the blk is in the pool already, the ok is false if no clean buffer is free.
+*/
+func (b *BufferManager) startLoading(blk *fm.BlockId) (buff *Buffer, ok bool) {
+	if _, exists := b.pageTable[*blk]; exists {
+		return nil, true
+	}
+	frame, ok := b.policy.Evict(func(frame int) bool {
+		return b.bufferPool[frame].RecLSN() == 0
+	})
+	if !ok {
+		return nil, false
+	}
+	buff = b.bufferPool[frame]
+
+	b.evict(buff)
+	buff.blk = nil
+	buff.Pin()
+	b.numAvailable -= 1
+	buff.loading = make(chan struct{})
+	b.pageTable[*blk] = frame
+	return buff, true
+}
+
+// finishLoading the buffer holds the blk read, or nothing if the read fails, it's unpinned and the waiters are woken up
+func (b *BufferManager) finishLoading(buff *Buffer, blk *fm.BlockId, page *fm.Page, err error) {
+	err = buff.loadBlock(blk, page, err)
+	if err != nil {
+		log.Printf("fails to prefetch block %d of %s: %v\n", blk.BlkNum(), blk.GetFilePath(), err)
+		delete(b.pageTable, *blk)
+	} else {
+		buff.prefetched = true
+		b.stats.Prefetches += 1
+	}
+
+	close(buff.loading)
+	buff.loading = nil
+	b.numAvailable += 1
+	b.policy.Unpin(buff.frame)
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
@@ -0,0 +1,121 @@
+package buffer_manager
+
+import (
+	"github.com/stretchr/testify/require"
+	fm "oh_my_godb/file_manager"
+	lm "oh_my_godb/log_manager"
+	"sync"
+	"testing"
+)
+
+func newPrefetchTestManager(t *testing.T, blocks int, buffers uint32) *BufferManager {
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 64, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	page := fm.NewPageBySize(fileManager.BlockSize())
+	for i := 0; i < blocks; i++ {
+		blk, err := fileManager.Append("testfile")
+		require.Nil(t, err)
+		page.SetInt(8, uint64(100+i))
+		_, err = fileManager.Write(&blk, page)
+		require.Nil(t, err)
+	}
+	return NewBufferManager(fileManager, logManager, buffers)
+}
+
+func TestReadAhead(t *testing.T) {
+	bm := newPrefetchTestManager(t, 20, 8)
+	bm.SetReadAhead(4)
+	defer bm.StopPrefetch()
+
+	// the blocks 0 and 1 make the scan sequential, the rest are prefetched
+	for i := uint64(0); i < 20; i++ {
+		buff, err := bm.Pin(fm.NewBlockId("testfile", i))
+		require.Nil(t, err)
+		require.Equal(t, 100+i, buff.Contents().GetInt(8))
+		bm.Unpin(buff)
+		bm.prefetching.Wait()
+	}
+	require.Equal(t, BufferStats{Hits: 18, Misses: 2, Prefetches: 18, PrefetchHits: 18}, bm.Stats())
+
+	// the block pinned again doesn't break the sequence, a jump starts a new one
+	for _, blkNum := range []uint64{19, 19, 5, 6, 7} {
+		buff, err := bm.Pin(fm.NewBlockId("testfile", blkNum))
+		require.Nil(t, err)
+		bm.Unpin(buff)
+		bm.prefetching.Wait()
+	}
+	// the blocks 5 and 6 are read again, the 7 .. 10 are prefetched
+	require.Equal(t, BufferStats{Hits: 21, Misses: 4, Prefetches: 22, PrefetchHits: 19}, bm.Stats())
+}
+
+func TestPrefetch(t *testing.T) {
+	bm := newPrefetchTestManager(t, 8, 4)
+
+	// the blocks beyond the end are ignored
+	bm.Prefetch([]*fm.BlockId{fm.NewBlockId("testfile", 0), fm.NewBlockId("testfile", 1), fm.NewBlockId("testfile", 8)})
+	bm.prefetching.Wait()
+	require.Equal(t, uint64(2), bm.Stats().Prefetches)
+	require.Equal(t, uint32(4), bm.Available())
+
+	// the blocks 0 and 1 are evicted by the next prefetches without any pin
+	bm.Prefetch([]*fm.BlockId{fm.NewBlockId("testfile", 2), fm.NewBlockId("testfile", 3),
+		fm.NewBlockId("testfile", 4), fm.NewBlockId("testfile", 5)})
+	bm.prefetching.Wait()
+	buff, err := bm.Pin(fm.NewBlockId("testfile", 5))
+	require.Nil(t, err)
+	require.Equal(t, uint64(105), buff.Contents().GetInt(8))
+	require.Equal(t, BufferStats{Hits: 1, Prefetches: 6, PrefetchHits: 1, PrefetchWasted: 2}, bm.Stats())
+
+	// the prefetch passes over the dirty victim, its page isn't written
+	buff.SetModified(1, 0)
+	bm.Unpin(buff)
+	for i := uint64(2); i < 5; i++ {
+		buff, err := bm.Pin(fm.NewBlockId("testfile", i))
+		require.Nil(t, err)
+		bm.Unpin(buff)
+	}
+	bm.Prefetch([]*fm.BlockId{fm.NewBlockId("testfile", 6)})
+	bm.StopPrefetch()
+	require.Equal(t, uint64(7), bm.Stats().Prefetches)
+	require.Equal(t, 1, len(bm.DirtyPages()))
+
+	// the dirty block is still the least recently used, the next miss writes it
+	buff, err = bm.Pin(fm.NewBlockId("testfile", 7))
+	require.Nil(t, err)
+	bm.Unpin(buff)
+	require.Equal(t, 0, len(bm.DirtyPages()))
+	require.Equal(t, uint64(1), bm.Stats().DirtyEvictions)
+}
+
+func TestPinWaitsForPrefetch(t *testing.T) {
+	bm := newPrefetchTestManager(t, 8, 4)
+	defer bm.StopPrefetch()
+
+	// the pins race with the prefetch of the same blocks, each block is read once
+	var wg sync.WaitGroup
+	for round := 0; round < 20; round++ {
+		blks := []*fm.BlockId{fm.NewBlockId("testfile", uint64(round%8)), fm.NewBlockId("testfile", uint64((round+1)%8))}
+		bm.Prefetch(blks)
+		for _, blk := range blks {
+			wg.Add(1)
+			go func(blk *fm.BlockId) {
+				defer wg.Done()
+				buff, err := bm.Pin(blk)
+				require.Nil(t, err)
+				require.Equal(t, 100+blk.BlkNum(), buff.Contents().GetInt(8))
+				bm.Unpin(buff)
+			}(blk)
+		}
+		wg.Wait()
+		bm.prefetching.Wait()
+	}
+
+	require.Equal(t, uint32(4), bm.Available())
+	require.Equal(t, 4, len(bm.pageTable))
+	for frame, buff := range bm.bufferPool {
+		require.Nil(t, buff.loading)
+		require.Equal(t, frame, bm.pageTable[*buff.Block()])
+	}
+}
@@ -0,0 +1,224 @@
+package buffer_manager
+
+import "container/list"
+
+/*
+ReplacementPolicy chooses the buffer to evict once a block isn't in the pool. The buffers are known by their
+frame, i.e. their index in the bufferPool, and only the unpinned ones, the candidates, may be evicted:
+
+	Pin(frame)     --> every access, the buffer is no longer a candidate
+	Unpin(frame)   --> the last pin is released, the buffer is a candidate again
+	Evict(accept)  --> takes a candidate the accept allows away, the buffer is pinned by the new block right after
+
+- the BufferManager calls it with its mutex held, a policy isn't safe for concurrent use
+- all the buffers are unpinned at first, from the frame 0 to the last one
+- a policy is used by one BufferManager only
+- the candidates the accept refuses are passed over as if pinned, they keep their place, e.g. the dirty ones for a prefetch
+*/
+type ReplacementPolicy interface {
+	Pin(frame int)
+	Unpin(frame int)
+	Evict(accept func(frame int) bool) (int, bool) // false if all the buffers are pinned or refused
+}
+
+// anyFrame the accept of an eviction taking any candidate
+func anyFrame(int) bool {
+	return true
+}
+
+/*
+LRUPolicy evicts the buffer unpinned the longest time ago. A pinned buffer isn't in the list,
+so both the Pin() and the Unpin() are O(1).
+
+	front                          back
+	|least recently used|...|most recently used|
+*/
+type LRUPolicy struct {
+	candidates *list.List
+	elements   []*list.Element // frame -> its element in the candidates, nil if pinned
+}
+
+func NewLRUPolicy() *LRUPolicy {
+	return &LRUPolicy{candidates: list.New()}
+}
+
+func (p *LRUPolicy) Pin(frame int) {
+	p.elements = grow(p.elements, frame)
+	if p.elements[frame] != nil {
+		p.candidates.Remove(p.elements[frame])
+		p.elements[frame] = nil
+	}
+}
+
+func (p *LRUPolicy) Unpin(frame int) {
+	p.elements = grow(p.elements, frame)
+	if p.elements[frame] == nil {
+		p.elements[frame] = p.candidates.PushBack(frame)
+	}
+}
+
+func (p *LRUPolicy) Evict(accept func(frame int) bool) (int, bool) {
+	for e := p.candidates.Front(); e != nil; e = e.Next() {
+		frame := e.Value.(int)
+		if !accept(frame) {
+			continue
+		}
+		p.candidates.Remove(e)
+		p.elements[frame] = nil
+		return frame, true
+	}
+	return 0, false
+}
+
+/*
+ClockPolicy the second chance, an approximation of the LRU without any list to maintain.
+Each access sets the referenced bit of the buffer, the hand sweeps the buffers in a circle:
+
+	        hand
+	         ⬇
+	|ref 0|ref 1|pinned|ref 0|
+	       clear  skip   evict
+
+- a referenced candidate gets its bit cleared and is passed over, it's evicted next time unless accessed again
+- the sweep ends within two turns, as the first turn clears all the bits, a refused candidate keeps its bit
+*/
+type ClockPolicy struct {
+	referenced []bool
+	candidate  []bool
+	candidates int
+	hand       int
+}
+
+func NewClockPolicy() *ClockPolicy {
+	return &ClockPolicy{}
+}
+
+func (p *ClockPolicy) Pin(frame int) {
+	p.grow(frame)
+	p.referenced[frame] = true
+	if p.candidate[frame] {
+		p.candidate[frame] = false
+		p.candidates -= 1
+	}
+}
+
+func (p *ClockPolicy) Unpin(frame int) {
+	p.grow(frame)
+	if !p.candidate[frame] {
+		p.candidate[frame] = true
+		p.candidates += 1
+	}
+}
+
+func (p *ClockPolicy) Evict(accept func(frame int) bool) (int, bool) {
+	if p.candidates == 0 {
+		return 0, false
+	}
+	for i := 0; i < 2*len(p.candidate); i++ {
+		frame := p.hand
+		p.hand = (p.hand + 1) % len(p.candidate)
+		if !p.candidate[frame] || !accept(frame) {
+			continue
+		}
+		if p.referenced[frame] {
+			p.referenced[frame] = false
+			continue
+		}
+		p.candidate[frame] = false
+		p.candidates -= 1
+		return frame, true
+	}
+	return 0, false
+}
+
+func (p *ClockPolicy) grow(frame int) {
+	p.referenced = grow(p.referenced, frame)
+	p.candidate = grow(p.candidate, frame)
+}
+
+const DEFAULT_LRU_K = 2
+
+/*
+LRUKPolicy evicts the candidate whose K-th most recent access is the oldest, i.e. the largest backward K-distance.
+A block touched once by a scan has fewer than K accesses, its distance is infinite, so the scan doesn't push
+the hot blocks out as it does with the LRU. The candidates with fewer than K accesses are evicted first,
+the least recently used one among them.
+
+	access time:  1  2  3  4  5
+	frame 0:      a        a        K=2: the 2nd latest is 1, evicted second
+	frame 1:         b              K=2: infinite, evicted first
+	frame 2:            c     c     K=2: the 2nd latest is 3, evicted last
+
+- the history belongs to the block, it's cleared once the buffer is evicted
+- the Evict() is O(n), it looks at every candidate
+*/
+type LRUKPolicy struct {
+	k         int
+	now       uint64
+	history   [][]uint64 // frame -> the access times, the latest K at most, from the oldest to the latest
+	candidate []bool
+}
+
+func NewLRUKPolicy(k int) *LRUKPolicy {
+	return &LRUKPolicy{k: max(k, 1)}
+}
+
+func (p *LRUKPolicy) Pin(frame int) {
+	p.grow(frame)
+	p.now += 1
+	history := p.history[frame]
+	if len(history) == p.k {
+		copy(history, history[1:])
+		history[p.k-1] = p.now
+	} else {
+		p.history[frame] = append(history, p.now)
+	}
+	p.candidate[frame] = false
+}
+
+func (p *LRUKPolicy) Unpin(frame int) {
+	p.grow(frame)
+	p.candidate[frame] = true
+}
+
+func (p *LRUKPolicy) Evict(accept func(frame int) bool) (int, bool) {
+	victim := -1
+	var victimKth, victimLatest uint64
+	for frame, candidate := range p.candidate {
+		if !candidate || !accept(frame) {
+			continue
+		}
+		// the K-th latest access, 0 for infinite distance, and the latest one to break the ties
+		var kth, latest uint64
+		history := p.history[frame]
+		if len(history) == p.k {
+			kth = history[0]
+		}
+		if len(history) > 0 {
+			latest = history[len(history)-1]
+		}
+		if victim == -1 || kth < victimKth || (kth == victimKth && latest < victimLatest) {
+			victim, victimKth, victimLatest = frame, kth, latest
+		}
+	}
+	if victim == -1 {
+		return 0, false
+	}
+
+	p.candidate[victim] = false
+	p.history[victim] = p.history[victim][:0]
+	return victim, true
+}
+
+func (p *LRUKPolicy) grow(frame int) {
+	p.history = grow(p.history, frame)
+	p.candidate = grow(p.candidate, frame)
+}
+
+// grow extends the slice to hold the frame, the policies learn the size of the pool from the frames they see
+func grow[T any](s []T, frame int) []T {
+	if frame < len(s) {
+		return s
+	}
+	return append(s, make([]T, frame+1-len(s))...)
+}
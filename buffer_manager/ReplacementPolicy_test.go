@@ -0,0 +1,178 @@
+package buffer_manager
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	fm "oh_my_godb/file_manager"
+	lm "oh_my_godb/log_manager"
+	"testing"
+)
+
+// evictAll returns the frames in the order the policy evicts them
+func evictAll(policy ReplacementPolicy) []int {
+	var frames []int
+	for {
+		frame, ok := policy.Evict(anyFrame)
+		if !ok {
+			return frames
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestReplacementPolicies(t *testing.T) {
+	// the frame 1 is pinned and unpinned again, the frame 2 is still pinned
+	access := func(policy ReplacementPolicy) ReplacementPolicy {
+		for frame := 0; frame < 4; frame++ {
+			policy.Unpin(frame)
+		}
+		policy.Pin(1)
+		policy.Pin(2)
+		policy.Unpin(1)
+		return policy
+	}
+
+	require.Equal(t, []int{0, 3, 1}, evictAll(access(NewLRUPolicy())))
+	// the hand passes over the referenced frame 1 once
+	require.Equal(t, []int{0, 3, 1}, evictAll(access(NewClockPolicy())))
+	// the frame 1 is accessed once, like the ones never accessed, the least recently used of them goes last
+	require.Equal(t, []int{0, 3, 1}, evictAll(access(NewLRUKPolicy(DEFAULT_LRU_K))))
+
+	// the refused frame 0 keeps its place, it's the next victim
+	for _, policy := range []ReplacementPolicy{NewLRUPolicy(), NewClockPolicy(), NewLRUKPolicy(DEFAULT_LRU_K)} {
+		access(policy)
+		frame, ok := policy.Evict(func(frame int) bool { return frame != 0 })
+		require.True(t, ok)
+		require.Equal(t, 3, frame, "%T", policy)
+		require.Equal(t, []int{0, 1}, evictAll(policy), "%T", policy)
+	}
+
+	// the frame 0 is accessed twice, it outlives the frame 1 accessed later but once
+	policy := NewLRUKPolicy(2)
+	for _, frame := range []int{0, 0, 1} {
+		policy.Pin(frame)
+		policy.Unpin(frame)
+	}
+	require.Equal(t, []int{1, 0}, evictAll(policy))
+
+	// the history goes with the evicted block
+	policy.Pin(0)
+	policy.Unpin(0)
+	policy.Pin(1)
+	policy.Pin(1)
+	policy.Unpin(1)
+	require.Equal(t, []int{0, 1}, evictAll(policy))
+}
+
+func TestBufferManagerKeepsHotBlocks(t *testing.T) {
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 64, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	for i := 0; i < 4; i++ {
+		_, err = fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+
+	// the clock may evict the block 0 once its sweep clears all the referenced bits
+	for _, policy := range []ReplacementPolicy{NewLRUPolicy(), NewLRUKPolicy(DEFAULT_LRU_K)} {
+		bm := NewBufferManagerWithPolicy(fileManager, logManager, 2, policy)
+		// the block 0 is used between the others, it's never evicted
+		for _, blkNum := range []uint64{0, 1, 0, 2, 0, 3, 0} {
+			buff, err := bm.Pin(fm.NewBlockId("testfile", blkNum))
+			require.Nil(t, err)
+			bm.Unpin(buff)
+		}
+		require.Equal(t, BufferStats{Hits: 3, Misses: 4}, bm.Stats(), "%T", policy)
+	}
+}
+
+/*
+blockTrace the block numbers of a workload:
+
+- zipf: a few blocks take most of the accesses
+- loop: a sequential scan over more blocks than the pool repeated, the worst case of the LRU
+- hot-and-scan: the hot blocks are accessed along with a long scan, which flushes them out of the LRU
+*/
+func blockTrace(name string, blocks int, length int) []uint64 {
+	rnd := rand.New(rand.NewSource(1))
+	trace := make([]uint64, length)
+	switch name {
+	case "zipf":
+		zipf := rand.NewZipf(rnd, 1.2, 1, uint64(blocks-1))
+		for i := range trace {
+			trace[i] = zipf.Uint64()
+		}
+	case "loop":
+		for i := range trace {
+			trace[i] = uint64(i % (blocks / 3))
+		}
+	case "hot-and-scan":
+		for i := range trace {
+			if i%2 == 0 {
+				trace[i] = uint64(rnd.Intn(blocks / 8))
+			} else {
+				trace[i] = uint64(blocks/8 + (i/2)%(blocks-blocks/8))
+			}
+		}
+	}
+	return trace
+}
+
+/*
+BenchmarkReplacementPolicy replays the block traces with a pool of 16 buffers over 64 blocks, the hit% is
+the hit ratio of the pins, e.g. go test -bench ReplacementPolicy -benchtime 100000x
+
+	BenchmarkReplacementPolicy/zipf/lru              100000     363.7 ns/op    71.05 hit%
+	BenchmarkReplacementPolicy/zipf/clock            100000     346.9 ns/op    69.35 hit%
+	BenchmarkReplacementPolicy/zipf/lru-2            100000     331.6 ns/op    77.80 hit%
+	BenchmarkReplacementPolicy/loop/lru              100000     969.1 ns/op     0.02 hit%
+	BenchmarkReplacementPolicy/loop/clock            100000     954.1 ns/op     0.02 hit%
+	BenchmarkReplacementPolicy/loop/lru-2            100000     795.4 ns/op    24.62 hit%
+	BenchmarkReplacementPolicy/hot-and-scan/lru      100000     598.3 ns/op    36.37 hit%
+	BenchmarkReplacementPolicy/hot-and-scan/clock    100000     587.4 ns/op    32.70 hit%
+	BenchmarkReplacementPolicy/hot-and-scan/lru-2    100000     495.2 ns/op    52.10 hit%
+
+The LRU-K keeps the blocks accessed more than once, the LRU and the clock lose them to the scans.
+*/
+func BenchmarkReplacementPolicy(b *testing.B) {
+	const blocks, buffers = 64, 16
+	policies := []struct {
+		name      string
+		newPolicy func() ReplacementPolicy
+	}{
+		{"lru", func() ReplacementPolicy { return NewLRUPolicy() }},
+		{"clock", func() ReplacementPolicy { return NewClockPolicy() }},
+		{fmt.Sprintf("lru-%d", DEFAULT_LRU_K), func() ReplacementPolicy { return NewLRUKPolicy(DEFAULT_LRU_K) }},
+	}
+
+	for _, traceName := range []string{"zipf", "loop", "hot-and-scan"} {
+		trace := blockTrace(traceName, blocks, 1<<16)
+		for _, policy := range policies {
+			b.Run(traceName+"/"+policy.name, func(b *testing.B) {
+				fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 4096, fm.SYNC_NEVER)
+				require.Nil(b, err)
+				logManager, err := lm.NewLogManager(fileManager, "logfile")
+				require.Nil(b, err)
+				for i := 0; i < blocks; i++ {
+					_, err = fileManager.Append("tracefile")
+					require.Nil(b, err)
+				}
+				bm := NewBufferManagerWithPolicy(fileManager, logManager, buffers, policy.newPolicy())
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					buff, err := bm.Pin(fm.NewBlockId("tracefile", trace[i%len(trace)]))
+					if err != nil {
+						b.Fatal(err)
+					}
+					bm.Unpin(buff)
+				}
+				b.StopTimer()
+				stats := bm.Stats()
+				b.ReportMetric(100*float64(stats.Hits)/float64(stats.Hits+stats.Misses), "hit%")
+			})
+		}
+	}
+}
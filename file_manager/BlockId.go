@@ -6,7 +6,10 @@ import (
 )
 
 /*
-BlockId describes the position of the file with filePath
+BlockId describes the position of the file with filePath.
+
+It's comparable, the BlockId value, not the pointer, is the map key of a block, e.g. the page table of the
+BufferManager and the LockTable.
 */
 type BlockId struct {
 	filePath string
@@ -37,6 +40,7 @@ func (b *BlockId) Equals(other *BlockId) bool {
 	return b.filePath == other.filePath && b.blkNum == other.blkNum
 }
 
+// Deprecated: use the BlockId value as the map key, it's cheaper than the SHA-256
 func (b *BlockId) HashCode() string {
 	return asSha256(*b)
 }
@@ -0,0 +1,84 @@
+package file_manager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+Each block written by the FileManager carries a header in front of the page, so a torn or flipped block is
+detected by the Read() rather than taken as the data:
+
+	|  checksum  |   format   |  page LSN  |          page          |
+	|     4B     |     4B     |     8B     |       blockSize B      |
+	 <--------------- BLOCK_HEADER_LEN ---------------->
+
+The checksum is the CRC32C of the format, the block number, the page LSN and the page, a block written into a wrong
+place fails too. The page LSN is kept by the Page, see Page.LSN(), so the recovery knows what the block on the disk holds.
+A block never written, i.e. all zero, is an empty page. The page size, BlockSize(), is unchanged,
+the block on the disk is BLOCK_HEADER_LEN larger, unless the file skips the checksum, see SkipChecksum().
+*/
+const (
+	BLOCK_HEADER_LEN      = uint64(16)
+	BLOCK_FORMAT_CHECKSUM = uint32(1)
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptBlock the block read doesn't match its checksum, the page holds what has been read anyway
+type ErrCorruptBlock struct {
+	Blk      BlockId
+	Stored   uint32
+	Computed uint32
+}
+
+func (e *ErrCorruptBlock) Error() string {
+	return fmt.Sprintf("corrupt block %d in the file %s: checksum %08x, expected %08x",
+		e.Blk.BlkNum(), e.Blk.GetFilePath(), e.Stored, e.Computed)
+}
+
+func blockChecksum(blkNum uint64, format uint32, lsn uint64, contents []byte) uint32 {
+	var meta [20]byte
+	binary.LittleEndian.PutUint32(meta[0:4], format)
+	binary.LittleEndian.PutUint64(meta[4:12], blkNum)
+	binary.LittleEndian.PutUint64(meta[12:20], lsn)
+
+	checksum := crc32.Update(0, castagnoli, meta[:])
+	return crc32.Update(checksum, castagnoli, contents)
+}
+
+// sealBlock fills the block with the header and the contents, the block is BLOCK_HEADER_LEN larger than the contents
+func sealBlock(blkNum uint64, lsn uint64, contents []byte, block []byte) {
+	copy(block[BLOCK_HEADER_LEN:], contents)
+	binary.LittleEndian.PutUint64(block[8:16], lsn)
+	binary.LittleEndian.PutUint32(block[4:8], BLOCK_FORMAT_CHECKSUM)
+	binary.LittleEndian.PutUint32(block[0:4], blockChecksum(blkNum, BLOCK_FORMAT_CHECKSUM, lsn, contents))
+}
+
+// verifyBlock returns the page LSN of the block, 0 if the block fails its checksum as the LSN can't be trusted either
+func verifyBlock(blk *BlockId, block []byte) (uint64, error) {
+	stored := binary.LittleEndian.Uint32(block[0:4])
+	format := binary.LittleEndian.Uint32(block[4:8])
+	lsn := binary.LittleEndian.Uint64(block[8:16])
+	contents := block[BLOCK_HEADER_LEN:]
+
+	if stored == 0 && format == 0 && lsn == 0 && isZero(contents) {
+		return 0, nil
+	}
+
+	computed := blockChecksum(blk.BlkNum(), BLOCK_FORMAT_CHECKSUM, lsn, contents)
+	if format != BLOCK_FORMAT_CHECKSUM || stored != computed {
+		return 0, &ErrCorruptBlock{Blk: *blk, Stored: stored, Computed: computed}
+	}
+	return lsn, nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
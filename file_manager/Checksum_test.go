@@ -0,0 +1,98 @@
+package file_manager
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func writeRaw(t *testing.T, storage Storage, name string, data []byte, offset int64) {
+	file, err := storage.Open(name)
+	require.Nil(t, err)
+	_, err = file.WriteAt(data, offset)
+	require.Nil(t, err)
+}
+
+func requireCorrupt(t *testing.T, err error, blk *BlockId) {
+	var corruptErr *ErrCorruptBlock
+	require.True(t, errors.As(err, &corruptErr), "%v", err)
+	require.True(t, corruptErr.Blk.Equals(blk))
+}
+
+func TestChecksumDetectsCorruption(t *testing.T) {
+	storage := NewMemStorage()
+	fileManager, err := NewFileManagerWithStorage(storage, 400, SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	diskBlockSize := int64(400 + BLOCK_HEADER_LEN)
+
+	blk0, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	blk1, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	require.Equal(t, 2*diskBlockSize, int64(len(readAll(t, storage, "testfile"))))
+
+	// the appended block is empty and fine
+	require.Equal(t, uint64(0), readInt(t, fileManager, &blk0))
+
+	p := NewPageBySize(400)
+	p.SetInt(0, 42)
+	p.SetString(300, "hello world")
+	_, err = fileManager.Write(&blk1, p)
+	require.Nil(t, err)
+	require.Equal(t, uint64(42), readInt(t, fileManager, &blk1))
+
+	// a bit flip, the page still holds what has been read
+	raw := readAll(t, storage, "testfile")
+	flipped := raw[diskBlockSize+int64(BLOCK_HEADER_LEN)+300] ^ 0x01
+	writeRaw(t, storage, "testfile", []byte{flipped}, diskBlockSize+int64(BLOCK_HEADER_LEN)+300)
+	page := NewPageBySize(400)
+	_, err = fileManager.Read(&blk1, page)
+	requireCorrupt(t, err, &blk1)
+	require.Equal(t, uint64(42), page.GetInt(0))
+	require.Contains(t, err.Error(), "testfile")
+
+	// a torn write, the first half is new and the rest is old
+	p.SetString(300, "hello there")
+	_, err = fileManager.Write(&blk1, p)
+	require.Nil(t, err)
+	newBlock := readAll(t, storage, "testfile")[diskBlockSize:]
+	writeRaw(t, storage, "testfile", raw[diskBlockSize:], diskBlockSize)
+	writeRaw(t, storage, "testfile", newBlock[:diskBlockSize/2], diskBlockSize)
+	_, err = fileManager.Read(&blk1, NewPageBySize(400))
+	requireCorrupt(t, err, &blk1)
+
+	// a block written into a wrong place
+	writeRaw(t, storage, "testfile", newBlock, 0)
+	_, err = fileManager.Read(&blk0, NewPageBySize(400))
+	requireCorrupt(t, err, &blk0)
+
+	// a block never written is empty
+	writeRaw(t, storage, "testfile", make([]byte, diskBlockSize), 0)
+	require.Equal(t, uint64(0), readInt(t, fileManager, &blk0))
+}
+
+func TestSkipChecksum(t *testing.T) {
+	storage := NewMemStorage()
+	fileManager, err := NewFileManagerWithStorage(storage, 400, SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	fileManager.SkipChecksum("logfile")
+
+	for i := 0; i < 2; i++ {
+		_, err = fileManager.Append("logfile.0")
+		require.Nil(t, err)
+		_, err = fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+	require.Equal(t, 800, len(readAll(t, storage, "logfile.0")))
+	require.Equal(t, 2*int(400+BLOCK_HEADER_LEN), len(readAll(t, storage, "testfile")))
+	blockNum, err := fileManager.BlockNum("logfile.0")
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), blockNum)
+
+	// the page is stored as it is, the file checks it by itself
+	blk := NewBlockId("logfile.0", 1)
+	writeInt(t, fileManager, blk, 42)
+	require.Equal(t, byte(42), readAll(t, storage, "logfile.0")[400])
+	writeRaw(t, storage, "logfile.0", []byte{43}, 400)
+	require.Equal(t, uint64(43), readInt(t, fileManager, blk))
+}
@@ -0,0 +1,127 @@
+package file_manager
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+)
+
+/*
+TestConcurrentIO run with -race: the appenders grow the files while the workers read and write their own blocks
+of the same files, and the syncer syncs them.
+*/
+func TestConcurrentIO(t *testing.T) {
+	const files, ownedBlocks, workers, appenders, appends = 4, 16, 8, 4, 50
+
+	err := os.RemoveAll("concurrent_io_test")
+	require.Nil(t, err)
+	fileManager, err := NewFileManager("concurrent_io_test", 400)
+	require.Nil(t, err)
+
+	fileName := func(i int) string { return fmt.Sprintf("file%d", i) }
+	for i := 0; i < files; i++ {
+		for j := 0; j < ownedBlocks; j++ {
+			_, err = fileManager.Append(fileName(i))
+			require.Nil(t, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers+files*appenders+1)
+
+	// each worker owns the blocks j of every file, j % workers == w
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			page := NewPageBySize(fileManager.BlockSize())
+			for round := uint64(1); round <= 20; round++ {
+				for i := 0; i < files; i++ {
+					for j := w; j < ownedBlocks; j += workers {
+						blk := NewBlockId(fileName(i), uint64(j))
+						page.SetInt(0, uint64(w))
+						page.SetInt(8, round)
+						_, err := fileManager.Write(blk, page)
+						if err != nil {
+							errs <- err
+							return
+						}
+						_, err = fileManager.Read(blk, page)
+						if err != nil {
+							errs <- err
+							return
+						}
+						if page.GetInt(0) != uint64(w) || page.GetInt(8) != round {
+							errs <- fmt.Errorf("block %d of %s is overwritten", j, fileName(i))
+							return
+						}
+					}
+				}
+			}
+		}(w)
+	}
+
+	appended := make([][]uint64, files)
+	var appendedMu sync.Mutex
+	for i := 0; i < files; i++ {
+		for a := 0; a < appenders; a++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for n := 0; n < appends; n++ {
+					blk, err := fileManager.Append(fileName(i))
+					if err != nil {
+						errs <- err
+						return
+					}
+					appendedMu.Lock()
+					appended[i] = append(appended[i], blk.BlkNum())
+					appendedMu.Unlock()
+				}
+			}(i)
+		}
+	}
+
+	stop := make(chan struct{})
+	syncDone := make(chan struct{})
+	go func() {
+		defer close(syncDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			err := fileManager.SyncAll()
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	<-syncDone
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+
+	// no block is appended twice
+	for i := 0; i < files; i++ {
+		sort.Slice(appended[i], func(a, b int) bool { return appended[i][a] < appended[i][b] })
+		for n, blkNum := range appended[i] {
+			require.Equal(t, uint64(ownedBlocks+n), blkNum)
+		}
+		blockNum, err := fileManager.BlockNum(fileName(i))
+		require.Nil(t, err)
+		require.Equal(t, uint64(ownedBlocks+appenders*appends), blockNum)
+	}
+
+	require.Nil(t, fileManager.Close())
+	require.Nil(t, os.RemoveAll("concurrent_io_test"))
+}
@@ -0,0 +1,358 @@
+package file_manager
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+CRASH_MODE what the unsynced writes become once CrashStorage.Crash() is called.
+
+- CRASH_DROP_UNSYNCED: they are all lost, only what has been synced survives
+- CRASH_KEEP_SOME: the OS has written back a random prefix of them, per file
+- CRASH_TORN_WRITE: like CRASH_KEEP_SOME, and the write right after the prefix of one file
+is half done, i.e. a torn block
+*/
+type CRASH_MODE int
+
+const (
+	CRASH_DROP_UNSYNCED CRASH_MODE = iota
+	CRASH_KEEP_SOME
+	CRASH_TORN_WRITE
+)
+
+type STORAGE_OP int
+
+const (
+	OP_WRITE STORAGE_OP = iota
+	OP_TRUNCATE
+	OP_SYNC
+	OP_SYNC_DIR
+	OP_REMOVE
+)
+
+// StorageOp one write or sync seen by the CrashStorage, see Ops()
+type StorageOp struct {
+	Op     STORAGE_OP
+	Name   string
+	Offset int64
+	Size   int64
+}
+
+/*
+CrashStorage simulates the disk under the OS cache in the memory, for the recovery tests.
+Each file has what the reads see and what survives a crash:
+
+	       WriteAt()                Sync()
+	data <----------- pending -------------> synced
+	                  |w0|w1|w2|
+
+A file created or removed comes and goes in a crash unless SyncDir() is called since.
+
+The crash point is set by CrashAfter(), the storage keeps working as usual beyond it,
+but Crash() restores the state at the crash point. The managers using the storage should be dropped then,
+new ones on the same storage see what survives, like a restart.
+*/
+type CrashStorage struct {
+	mu      sync.Mutex
+	files   map[string]*crashFile
+	removed map[string]*crashFile // removed since the last SyncDir(), they come back in a crash
+	ops     []StorageOp
+	crashAt int                   // the number of ops when the crash happens, -1 if not set
+	frozen  map[string]crashImage // what survives the crash, once the crash point is reached
+	rnd     *rand.Rand
+}
+
+type crashFile struct {
+	storage *CrashStorage
+	name    string
+	data    []byte
+	synced  []byte // never changed in place, so it's shared with the crashImage
+	pending []pendingWrite
+	durable bool // the dir has been synced since the file is created
+}
+
+// pendingWrite a write or truncate not synced yet, data is nil for the truncate
+type pendingWrite struct {
+	offset int64
+	data   []byte
+	size   int64
+}
+
+type crashImage struct {
+	synced  []byte
+	pending []pendingWrite
+}
+
+// NewCrashStorage the seed decides which unsynced writes survive a crash, see CRASH_MODE
+func NewCrashStorage(seed int64) *CrashStorage {
+	return &CrashStorage{
+		files:   make(map[string]*crashFile),
+		removed: make(map[string]*crashFile),
+		crashAt: -1,
+		rnd:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (s *CrashStorage) Open(name string) (StorageFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[name]
+	if !ok {
+		file = &crashFile{storage: s, name: name}
+		s.files[name] = file
+	}
+	return file, nil
+}
+
+func (s *CrashStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[name]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(s.files, name)
+	if file.durable {
+		s.removed[name] = file
+	}
+	s.record(StorageOp{Op: OP_REMOVE, Name: name})
+	return nil
+}
+
+func (s *CrashStorage) List(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0)
+	for name := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *CrashStorage) SyncDir() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, file := range s.files {
+		file.durable = true
+	}
+	s.removed = make(map[string]*crashFile)
+	s.record(StorageOp{Op: OP_SYNC_DIR})
+	return nil
+}
+
+// MoveTo the file is dropped, as if it were removed
+func (s *CrashStorage) MoveTo(name string, _ string) error {
+	return s.Remove(name)
+}
+
+// Ops returns the writes and syncs since the storage is created
+func (s *CrashStorage) Ops() []StorageOp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]StorageOp(nil), s.ops...)
+}
+
+// CrashAfter sets the crash point after the next n ops, i.e. at once if n is 0
+func (s *CrashStorage) CrashAfter(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.frozen = nil
+	s.crashAt = len(s.ops) + n
+	if n == 0 {
+		s.freeze()
+	}
+}
+
+// Crashed returns true if the crash point is reached, what has been written since then is lost
+func (s *CrashStorage) Crashed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.frozen != nil
+}
+
+/*
+Crash throws away what isn't durable at the crash point, or now if no crash point is reached.
+
+@param tearPrefix only the files starting with it may be torn by CRASH_TORN_WRITE
+*/
+func (s *CrashStorage) Crash(mode CRASH_MODE, tearPrefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	images := s.frozen
+	if images == nil {
+		images = s.images()
+	}
+
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names) // the same seed tears the same file
+
+	tornName := ""
+	if mode == CRASH_TORN_WRITE {
+		tearable := make([]string, 0)
+		for _, name := range names {
+			if strings.HasPrefix(name, tearPrefix) && len(images[name].pending) > 0 {
+				tearable = append(tearable, name)
+			}
+		}
+		if len(tearable) > 0 {
+			tornName = tearable[s.rnd.Intn(len(tearable))]
+		}
+	}
+
+	s.files = make(map[string]*crashFile)
+	for _, name := range names {
+		image := images[name]
+		data := append([]byte(nil), image.synced...)
+
+		kept := 0
+		if mode != CRASH_DROP_UNSYNCED {
+			kept = s.rnd.Intn(len(image.pending) + 1)
+		}
+		for _, w := range image.pending[:kept] {
+			data = w.applyTo(data)
+		}
+		if name == tornName && kept < len(image.pending) {
+			w := image.pending[kept]
+			if w.data != nil {
+				w.data = w.data[:len(w.data)/2]
+			}
+			data = w.applyTo(data)
+		}
+
+		s.files[name] = &crashFile{
+			storage: s, name: name, data: append([]byte(nil), data...), synced: data, durable: true}
+	}
+
+	s.removed = make(map[string]*crashFile)
+	s.crashAt = -1
+	s.frozen = nil
+}
+
+// record is called with the mu held
+func (s *CrashStorage) record(op StorageOp) {
+	s.ops = append(s.ops, op)
+	if s.crashAt == len(s.ops) && s.frozen == nil {
+		s.freeze()
+	}
+}
+
+func (s *CrashStorage) freeze() {
+	s.frozen = s.images()
+}
+
+// images returns what survives a crash now, with the unsynced writes to be chosen from
+func (s *CrashStorage) images() map[string]crashImage {
+	images := make(map[string]crashImage)
+	for name, file := range s.removed {
+		images[name] = file.image()
+	}
+	for name, file := range s.files {
+		if file.durable {
+			images[name] = file.image()
+		}
+	}
+	return images
+}
+
+func (f *crashFile) image() crashImage {
+	return crashImage{
+		synced:  f.synced,
+		pending: f.pending[:len(f.pending):len(f.pending)],
+	}
+}
+
+func (w pendingWrite) applyTo(data []byte) []byte {
+	if w.data == nil {
+		return resize(data, w.size)
+	}
+
+	end := w.offset + int64(len(w.data))
+	if end > int64(len(data)) {
+		data = resize(data, end)
+	}
+	copy(data[w.offset:], w.data)
+	return data
+}
+
+func resize(data []byte, size int64) []byte {
+	if size <= int64(len(data)) {
+		return data[:size]
+	}
+	return append(data, make([]byte, size-int64(len(data)))...)
+}
+
+func (f *crashFile) ReadAt(p []byte, off int64) (int, error) {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *crashFile) WriteAt(p []byte, off int64) (int, error) {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+
+	w := pendingWrite{offset: off, data: append([]byte(nil), p...)}
+	f.data = w.applyTo(f.data)
+	f.pending = append(f.pending, w)
+	f.storage.record(StorageOp{Op: OP_WRITE, Name: f.name, Offset: off, Size: int64(len(p))})
+	return len(p), nil
+}
+
+func (f *crashFile) Size() (int64, error) {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+
+	return int64(len(f.data)), nil
+}
+
+func (f *crashFile) Truncate(size int64) error {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+
+	w := pendingWrite{size: size}
+	f.data = w.applyTo(f.data)
+	f.pending = append(f.pending, w)
+	f.storage.record(StorageOp{Op: OP_TRUNCATE, Name: f.name, Size: size})
+	return nil
+}
+
+func (f *crashFile) Sync() error {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+
+	f.synced = append([]byte(nil), f.data...)
+	f.pending = nil
+	f.storage.record(StorageOp{Op: OP_SYNC, Name: f.name})
+	return nil
+}
+
+func (f *crashFile) Close() error {
+	return nil
+}
@@ -0,0 +1,112 @@
+package file_manager
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func readAll(t *testing.T, storage Storage, name string) []byte {
+	file, err := storage.Open(name)
+	require.Nil(t, err)
+	size, err := file.Size()
+	require.Nil(t, err)
+	data := make([]byte, size)
+	if size > 0 {
+		_, err = file.ReadAt(data, 0)
+		require.Nil(t, err)
+	}
+	return data
+}
+
+func TestCrashStorageDropsUnsyncedWrites(t *testing.T) {
+	storage := NewCrashStorage(1)
+	fileManager, err := NewFileManagerWithStorage(storage, 400, SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+
+	blk, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	writeInt(t, fileManager, &blk, 1)
+	require.Nil(t, fileManager.Sync("testfile"))
+	writeInt(t, fileManager, &blk, 2)
+	_, err = fileManager.Append("newfile") // the dir is synced, but not the block
+	require.Nil(t, err)
+
+	storage.Crash(CRASH_DROP_UNSYNCED, "")
+	fileManager, err = NewFileManagerWithStorage(storage, 400, SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+
+	require.Equal(t, uint64(1), readInt(t, fileManager, &blk))
+	empty, err := fileManager.IsFileEmpty("newfile")
+	require.Nil(t, err)
+	require.True(t, empty)
+
+	ops := storage.Ops()
+	require.Equal(t, OP_WRITE, ops[0].Op)
+	require.Equal(t, "testfile", ops[0].Name)
+}
+
+func TestCrashStorageCrashPoint(t *testing.T) {
+	storage := NewCrashStorage(1)
+	fileManager, err := NewFileManagerWithStorage(storage, 400, SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	blk, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	require.Nil(t, fileManager.Sync("testfile"))
+
+	// the crash happens after the write, the sync is too late
+	storage.CrashAfter(1)
+	writeInt(t, fileManager, &blk, 1)
+	require.True(t, storage.Crashed())
+	require.Nil(t, fileManager.Sync("testfile"))
+	require.Equal(t, uint64(1), readInt(t, fileManager, &blk))
+
+	storage.Crash(CRASH_DROP_UNSYNCED, "")
+	require.False(t, storage.Crashed())
+	fileManager, err = NewFileManagerWithStorage(storage, 400, SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), readInt(t, fileManager, &blk))
+}
+
+func TestCrashStorageTornWrite(t *testing.T) {
+	oldData := bytes.Repeat([]byte{1}, 400)
+	newData := bytes.Repeat([]byte{2}, 400)
+	torn := append(append([]byte(nil), newData[:200]...), oldData[200:]...)
+
+	outcomes := make(map[string]bool)
+	for seed := int64(0); seed < 20; seed++ {
+		storage := NewCrashStorage(seed)
+		file, err := storage.Open("testfile")
+		require.Nil(t, err)
+		require.Nil(t, storage.SyncDir())
+		_, err = file.WriteAt(oldData, 0)
+		require.Nil(t, err)
+		require.Nil(t, file.Sync())
+		_, err = file.WriteAt(newData, 0)
+		require.Nil(t, err)
+
+		// either the write is done, or half done
+		storage.Crash(CRASH_TORN_WRITE, "test")
+		data := readAll(t, storage, "testfile")
+		switch {
+		case bytes.Equal(data, newData):
+			outcomes["new"] = true
+		case bytes.Equal(data, torn):
+			outcomes["torn"] = true
+		default:
+			require.Fail(t, "unexpected content after the crash")
+		}
+	}
+	require.Equal(t, map[string]bool{"new": true, "torn": true}, outcomes)
+
+	// only the files with the prefix are torn
+	storage := NewCrashStorage(0)
+	file, err := storage.Open("logfile")
+	require.Nil(t, err)
+	require.Nil(t, storage.SyncDir())
+	_, err = file.WriteAt(newData, 0)
+	require.Nil(t, err)
+	storage.Crash(CRASH_TORN_WRITE, "test")
+	data := readAll(t, storage, "logfile")
+	require.True(t, len(data) == 0 || bytes.Equal(data, newData))
+}
@@ -0,0 +1,240 @@
+package file_manager
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// undoWrite restores the file as before a write
+type undoWrite struct {
+	offset  int64
+	oldData []byte
+	oldSize int64
+}
+
+/*
+faultyStorage writes into the OS files, but remembers what isn't synced yet. Crash() throws those writes away,
+just like a power failure drops the OS cache:
+
+- the writes to a file since its last Sync() are undone
+- the files created since the last SyncDir() are removed
+*/
+type faultyStorage struct {
+	*OSStorage
+	mu       sync.Mutex
+	unsynced map[string][]undoWrite
+	created  map[string]bool
+}
+
+type faultyFile struct {
+	StorageFile
+	name    string
+	storage *faultyStorage
+}
+
+func newFaultyStorage(t *testing.T) *faultyStorage {
+	inner, err := NewOSStorage("faulty_test")
+	require.Nil(t, err)
+
+	return &faultyStorage{
+		OSStorage: inner,
+		unsynced:  make(map[string][]undoWrite),
+		created:   make(map[string]bool),
+	}
+}
+
+func (s *faultyStorage) Open(name string) (StorageFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(filepath.Join("faulty_test", name)); os.IsNotExist(err) {
+		s.created[name] = true
+	}
+
+	file, err := s.OSStorage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{StorageFile: file, name: name, storage: s}, nil
+}
+
+func (s *faultyStorage) SyncDir() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.created = make(map[string]bool)
+	return nil
+}
+
+func (f *faultyFile) WriteAt(p []byte, off int64) (int, error) {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+
+	size, err := f.Size()
+	if err != nil {
+		return 0, err
+	}
+	undo := undoWrite{offset: off, oldSize: size}
+	if off < size {
+		undo.oldData = make([]byte, min(int64(len(p)), size-off))
+		_, err = f.StorageFile.ReadAt(undo.oldData, off)
+		if err != nil {
+			return 0, err
+		}
+	}
+	f.storage.unsynced[f.name] = append(f.storage.unsynced[f.name], undo)
+
+	return f.StorageFile.WriteAt(p, off)
+}
+
+func (f *faultyFile) Sync() error {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+
+	delete(f.storage.unsynced, f.name)
+	return nil
+}
+
+// Crash the FileManager using the storage should be dropped, a new one sees what survives
+func (s *faultyStorage) Crash(t *testing.T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, undos := range s.unsynced {
+		if s.created[name] {
+			continue
+		}
+		file, err := s.OSStorage.Open(name)
+		require.Nil(t, err)
+		for i := len(undos) - 1; i >= 0; i-- {
+			_, err = file.WriteAt(undos[i].oldData, undos[i].offset)
+			require.Nil(t, err)
+			require.Nil(t, file.Truncate(undos[i].oldSize))
+		}
+		require.Nil(t, file.Close())
+	}
+	for name := range s.created {
+		require.Nil(t, s.OSStorage.Remove(name))
+	}
+
+	s.unsynced = make(map[string][]undoWrite)
+	s.created = make(map[string]bool)
+}
+
+func newFaultyTestManager(t *testing.T, policy SYNC_POLICY) (*FileManager, *faultyStorage) {
+	err := os.RemoveAll("faulty_test")
+	require.Nil(t, err)
+
+	storage := newFaultyStorage(t)
+	fileManager, err := NewFileManagerWithStorage(storage, 400, policy)
+	require.Nil(t, err)
+	return fileManager, storage
+}
+
+func writeInt(t *testing.T, fileManager *FileManager, blk *BlockId, val uint64) {
+	p := NewPageBySize(fileManager.BlockSize())
+	p.SetInt(0, val)
+	_, err := fileManager.Write(blk, p)
+	require.Nil(t, err)
+}
+
+func readInt(t *testing.T, fileManager *FileManager, blk *BlockId) uint64 {
+	p := NewPageBySize(fileManager.BlockSize())
+	_, err := fileManager.Read(blk, p)
+	require.Nil(t, err)
+	return p.GetInt(0)
+}
+
+func TestUnsyncedWritesAreLost(t *testing.T) {
+	fileManager, storage := newFaultyTestManager(t, SYNC_ON_LOG_FLUSH)
+
+	blk, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	_, err = fileManager.Append("testfile")
+	require.Nil(t, err)
+	require.Nil(t, fileManager.Sync("testfile"))
+
+	writeInt(t, fileManager, &blk, 1)
+	require.Nil(t, fileManager.Sync("testfile"))
+	writeInt(t, fileManager, &blk, 2)
+	_, err = fileManager.Append("testfile")
+	require.Nil(t, err)
+
+	storage.Crash(t)
+	fileManager, err = NewFileManagerWithStorage(storage, 400, SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+
+	require.Equal(t, uint64(1), readInt(t, fileManager, &blk))
+	blockNum, err := fileManager.BlockNum("testfile")
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), blockNum)
+}
+
+func TestSyncAlwaysKeepsEveryWrite(t *testing.T) {
+	fileManager, storage := newFaultyTestManager(t, SYNC_ALWAYS)
+
+	blk, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	writeInt(t, fileManager, &blk, 2)
+
+	storage.Crash(t)
+	fileManager, err = NewFileManagerWithStorage(storage, 400, SYNC_ALWAYS)
+	require.Nil(t, err)
+
+	require.Equal(t, uint64(2), readInt(t, fileManager, &blk))
+}
+
+func TestSyncNeverLosesTheNewFile(t *testing.T) {
+	fileManager, storage := newFaultyTestManager(t, SYNC_NEVER)
+
+	blk, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	writeInt(t, fileManager, &blk, 2)
+	require.Nil(t, fileManager.Sync("testfile"))
+
+	storage.Crash(t)
+	_, err = os.Stat(filepath.Join("faulty_test", "testfile"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSyncAllKeepsTheWrittenFiles(t *testing.T) {
+	fileManager, storage := newFaultyTestManager(t, SYNC_ON_LOG_FLUSH)
+
+	blkA, err := fileManager.Append("fileA")
+	require.Nil(t, err)
+	blkB, err := fileManager.Append("fileB")
+	require.Nil(t, err)
+	writeInt(t, fileManager, &blkA, 1)
+	writeInt(t, fileManager, &blkB, 2)
+	require.Nil(t, fileManager.SyncAll())
+
+	storage.Crash(t)
+	fileManager, err = NewFileManagerWithStorage(storage, 400, SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+
+	require.Equal(t, uint64(1), readInt(t, fileManager, &blkA))
+	require.Equal(t, uint64(2), readInt(t, fileManager, &blkB))
+}
+
+func TestAppendSyncsTheDir(t *testing.T) {
+	fileManager, storage := newFaultyTestManager(t, SYNC_ON_LOG_FLUSH)
+
+	// the file survives, but its block doesn't without Sync()
+	_, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+
+	storage.Crash(t)
+	fileManager, err = NewFileManagerWithStorage(storage, 400, SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+
+	_, err = os.Stat(filepath.Join("faulty_test", "testfile"))
+	require.Nil(t, err)
+	blockNum, err := fileManager.BlockNum("testfile")
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), blockNum)
+
+	require.Nil(t, os.RemoveAll("faulty_test"))
+}
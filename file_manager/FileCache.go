@@ -0,0 +1,129 @@
+package file_manager
+
+import (
+	"container/list"
+	"sync"
+)
+
+const DEFAULT_MAX_OPEN_FILES = 64
+
+/*
+fileCache keeps the recently used files open, so a Read() or Write() doesn't open and close the file each time.
+
+	        get()                                   evict
+	front |f3|f1|f7|...........................|f2| back
+	      most recently used                    least recently used
+
+A file evicted while in use, i.e. between get() and put(), is closed by the last put().
+With maxOpenFiles 0 each file is closed once unused, nothing is cached.
+*/
+type fileCache struct {
+	storage      Storage
+	maxOpenFiles int
+	files        map[string]*list.Element // the Value is *cachedFile
+	lru          *list.List
+	mu           sync.Mutex
+}
+
+type cachedFile struct {
+	name    string
+	file    StorageFile
+	users   int  // the get() not put() yet
+	evicted bool // no longer in the cache, the last user closes it
+}
+
+func newFileCache(storage Storage, maxOpenFiles int) *fileCache {
+	return &fileCache{
+		storage:      storage,
+		maxOpenFiles: maxOpenFiles,
+		files:        make(map[string]*list.Element),
+		lru:          list.New(),
+	}
+}
+
+// get opens the file if not cached, each get() should be followed by a put()
+func (c *fileCache) get(name string) (*cachedFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.files[name]; ok {
+		c.lru.MoveToFront(elem)
+		cached := elem.Value.(*cachedFile)
+		cached.users += 1
+		return cached, nil
+	}
+
+	file, err := c.storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	cached := &cachedFile{name: name, file: file, users: 1}
+	c.files[name] = c.lru.PushFront(cached)
+
+	for len(c.files) > c.maxOpenFiles {
+		err = c.evict(c.lru.Back())
+		if err != nil {
+			// the caller won't put() it, the file stays cached unused
+			cached.users -= 1
+			return nil, err
+		}
+	}
+
+	return cached, nil
+}
+
+func (c *fileCache) put(cached *cachedFile) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached.users -= 1
+	if cached.evicted && cached.users == 0 {
+		return cached.file.Close()
+	}
+	return nil
+}
+
+// drop closes the file before it's removed or moved, if it's open
+func (c *fileCache) drop(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.files[name]; ok {
+		return c.evict(elem)
+	}
+	return nil
+}
+
+// closeAll closes the unused files, the ones in use are closed by their put()
+func (c *fileCache) closeAll() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var firstErr error
+	for c.lru.Len() > 0 {
+		err := c.evict(c.lru.Back())
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// evict the caller holds the mu
+func (c *fileCache) evict(elem *list.Element) error {
+	cached := elem.Value.(*cachedFile)
+	c.lru.Remove(elem)
+	delete(c.files, cached.name)
+
+	cached.evicted = true
+	if cached.users == 0 {
+		return cached.file.Close()
+	}
+	return nil
+}
+
+func (c *fileCache) openCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,159 @@
+package file_manager
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// countingStorage counts the open and close syscalls
+type countingStorage struct {
+	Storage
+	opens      atomic.Int64
+	closes     atomic.Int64
+	failCloses atomic.Bool
+}
+
+type countingFile struct {
+	StorageFile
+	storage *countingStorage
+}
+
+func (s *countingStorage) Open(name string) (StorageFile, error) {
+	file, err := s.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	s.opens.Add(1)
+	return &countingFile{StorageFile: file, storage: s}, nil
+}
+
+func (f *countingFile) Close() error {
+	f.storage.closes.Add(1)
+	err := f.StorageFile.Close()
+	if f.storage.failCloses.Load() {
+		return fmt.Errorf("close fails")
+	}
+	return err
+}
+
+func TestFileHandleCache(t *testing.T) {
+	storage := &countingStorage{Storage: NewMemStorage()}
+	fileManager, err := NewFileManagerWithOpenFiles(storage, 400, SYNC_ON_LOG_FLUSH, 2)
+	require.Nil(t, err)
+
+	for _, fileName := range []string{"fileA", "fileB", "fileA", "fileB"} {
+		blk, err := fileManager.Append(fileName)
+		require.Nil(t, err)
+		writeInt(t, fileManager, &blk, 1)
+		require.Equal(t, uint64(1), readInt(t, fileManager, &blk))
+	}
+	require.Equal(t, int64(2), storage.opens.Load())
+	require.Equal(t, int64(0), storage.closes.Load())
+
+	// the least recently used fileA is closed
+	_, err = fileManager.BlockNum("fileC")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), storage.opens.Load())
+	require.Equal(t, int64(1), storage.closes.Load())
+	_, err = fileManager.BlockNum("fileB")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), storage.opens.Load())
+
+	// the removed file is closed first
+	require.Nil(t, fileManager.Remove("fileB"))
+	require.Equal(t, int64(2), storage.closes.Load())
+	require.Equal(t, 1, fileManager.openFiles.openCount())
+
+	require.Nil(t, fileManager.Close())
+	require.Equal(t, storage.opens.Load(), storage.closes.Load())
+	require.Equal(t, 0, fileManager.openFiles.openCount())
+
+	// still usable after Close()
+	blk := NewBlockId("fileA", 1)
+	require.Equal(t, uint64(1), readInt(t, fileManager, blk))
+	require.Nil(t, fileManager.Close())
+}
+
+func TestFileEvictedInUse(t *testing.T) {
+	storage := &countingStorage{Storage: NewMemStorage()}
+	fileManager, err := NewFileManagerWithOpenFiles(storage, 400, SYNC_ON_LOG_FLUSH, 0)
+	require.Nil(t, err)
+
+	cached, err := fileManager.getFile("fileA")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), storage.closes.Load())
+
+	// nothing is cached, the file is closed once unused
+	fileManager.putFile(cached)
+	require.Equal(t, int64(1), storage.closes.Load())
+	require.True(t, cached.evicted)
+}
+
+func TestFileCachedWhenEvictFails(t *testing.T) {
+	storage := &countingStorage{Storage: NewMemStorage()}
+	fileManager, err := NewFileManagerWithOpenFiles(storage, 400, SYNC_ON_LOG_FLUSH, 1)
+	require.Nil(t, err)
+
+	cached, err := fileManager.getFile("fileA")
+	require.Nil(t, err)
+	fileManager.putFile(cached)
+
+	// fileA can't be closed, fileB is opened but not handed out
+	storage.failCloses.Store(true)
+	_, err = fileManager.getFile("fileB")
+	require.NotNil(t, err)
+	storage.failCloses.Store(false)
+
+	// fileB isn't in use, it's closed like any unused file
+	require.Nil(t, fileManager.Close())
+	require.Equal(t, int64(2), storage.opens.Load())
+	require.Equal(t, int64(2), storage.closes.Load())
+}
+
+/*
+BenchmarkRandomRead reads the random blocks of several files, opening each file per read
+or keeping them open, the opens/op shows the syscalls saved.
+*/
+func BenchmarkRandomRead(b *testing.B) {
+	const files, blocks = 8, 64
+
+	for _, maxOpenFiles := range []int{0, DEFAULT_MAX_OPEN_FILES} {
+		b.Run(fmt.Sprintf("maxOpenFiles%d", maxOpenFiles), func(b *testing.B) {
+			err := os.RemoveAll("file_cache_bench")
+			require.Nil(b, err)
+			osStorage, err := NewOSStorage("file_cache_bench")
+			require.Nil(b, err)
+			storage := &countingStorage{Storage: osStorage}
+			fileManager, err := NewFileManagerWithOpenFiles(storage, 4096, SYNC_NEVER, maxOpenFiles)
+			require.Nil(b, err)
+
+			for i := 0; i < files; i++ {
+				for j := 0; j < blocks; j++ {
+					_, err = fileManager.Append(fmt.Sprintf("file%d", i))
+					require.Nil(b, err)
+				}
+			}
+
+			rnd := rand.New(rand.NewSource(1))
+			page := NewPageBySize(fileManager.BlockSize())
+			storage.opens.Store(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				blk := NewBlockId(fmt.Sprintf("file%d", rnd.Intn(files)), uint64(rnd.Intn(blocks)))
+				_, err = fileManager.Read(blk, page)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(storage.opens.Load())/float64(b.N), "opens/op")
+
+			require.Nil(b, fileManager.Close())
+			require.Nil(b, os.RemoveAll("file_cache_bench"))
+		})
+	}
+}
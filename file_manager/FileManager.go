@@ -1,56 +1,105 @@
 package file_manager
 
 import (
-	"os"
-	"path/filepath"
+	"log"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+)
+
+/*
+SYNC_POLICY when the written blocks are forced into the disk, a Write() alone may leave them in the OS cache
+and lose them on a power failure.
+
+- SYNC_ON_LOG_FLUSH: only the explicit Sync(), i.e. the log flush, forces them.
+The pages are written back without syncing, the log redoes them after a crash.
+- SYNC_ALWAYS: each Write() and Append() is synced, the slowest
+- SYNC_NEVER: even Sync() does nothing, only for the tests
+
+The dir is synced once Append() creates a file, unless SYNC_NEVER, or the file may vanish after a crash.
+*/
+type SYNC_POLICY int
+
+const (
+	SYNC_ON_LOG_FLUSH SYNC_POLICY = iota
+	SYNC_ALWAYS
+	SYNC_NEVER
 )
 
 /*
 FileManager used for manage the DATABASE dir, not the table files.
 
 It also provides the communication between fileSystem Block and memory Page.
+The files are kept in a Storage, the dbDir of the OS by default, see NewFileManagerWithStorage().
+
+The blocks are read and written in parallel, even in the same file, only the Append() to the same file waits.
+Each block carries a checksum verified by the Read(), see Checksum.go.
 */
 type FileManager struct {
-	dbDir     string
-	blockSize uint64              //also the Page blockNum, fileSize / blockSize = blockNum
-	isNew     bool                //if the dbDir doesn't exist, create it and set isNew as true
-	openFiles map[string]*os.File //only the getFile() will add elem into it
-	mu        sync.Mutex
+	blockSize   uint64     //also the Page blockNum, fileSize / blockSize = blockNum
+	isNew       bool       //if the storage has no file, i.e. the dbDir doesn't exist, set isNew as true
+	openFiles   *fileCache //only the getFile() will add elem into it
+	storage     Storage
+	syncPolicy  SYNC_POLICY
+	unsynced    map[string]bool          // the files written since their last Sync(), see SyncAll()
+	appendLocks map[string]*sync.Mutex   // one per file, so the Append() never returns the same block twice
+	mu          sync.Mutex               // guards unsynced and appendLocks, Read() and Write() never wait for it during the I/O
+	plainFiles  atomic.Pointer[[]string] // the prefixes of the files without the checksum, see SkipChecksum()
+	blockBufs   sync.Pool                // the []byte of a block with its header, for the Read() and Write()
 }
 
 func NewFileManager(dbDir string, blockSize uint64) (*FileManager, error) {
+	return NewFileManagerWithPolicy(dbDir, blockSize, SYNC_ON_LOG_FLUSH)
+}
+
+func NewFileManagerWithPolicy(dbDir string, blockSize uint64, syncPolicy SYNC_POLICY) (*FileManager, error) {
+	storage, err := NewOSStorage(dbDir)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileManagerWithStorage(storage, blockSize, syncPolicy)
+}
+
+/*
+NewFileManagerWithStorage e.g. a MemStorage for the tests, a new FileManager on the same storage sees the files
+of the previous one, like a restart.
+*/
+func NewFileManagerWithStorage(storage Storage, blockSize uint64, syncPolicy SYNC_POLICY) (*FileManager, error) {
+	return NewFileManagerWithOpenFiles(storage, blockSize, syncPolicy, DEFAULT_MAX_OPEN_FILES)
+}
+
+// NewFileManagerWithOpenFiles at most maxOpenFiles unused files are kept open, see fileCache
+func NewFileManagerWithOpenFiles(
+	storage Storage, blockSize uint64, syncPolicy SYNC_POLICY, maxOpenFiles int) (*FileManager, error) {
 	fileManger := FileManager{
-		dbDir:     dbDir,
-		blockSize: blockSize,
-		isNew:     false,
-		openFiles: make(map[string]*os.File),
+		blockSize:   blockSize,
+		isNew:       false,
+		openFiles:   newFileCache(storage, maxOpenFiles),
+		storage:     storage,
+		syncPolicy:  syncPolicy,
+		unsynced:    make(map[string]bool),
+		appendLocks: make(map[string]*sync.Mutex),
+	}
+	fileManger.plainFiles.Store(&[]string{})
+	fileManger.blockBufs.New = func() any {
+		block := make([]byte, blockSize+BLOCK_HEADER_LEN)
+		return &block
 	}
 
-	//if dbDir doesn't exist
-	if _, err := os.Stat(dbDir); os.IsNotExist(err) {
-		fileManger.isNew = true
-		err := os.Mkdir(dbDir, os.ModeDir)
-		if err != nil {
-			return nil, err
-		}
-	} else { //if exist
-		err := filepath.Walk(dbDir,
-			func(path string, info os.FileInfo, err error) error {
-				mode := info.Mode()
-				if mode.IsRegular() {
-					name := info.Name()
-					//TODO: remove the tempxxxx, this file is generated when ???
-					if strings.HasPrefix(name, "temp") {
-						err := os.Remove(filepath.Join(path, name))
-						if err != nil {
-							return err
-						}
-					}
-				}
-				return nil
-			})
+	names, err := storage.List("")
+	if err != nil {
+		return nil, err
+	}
+	fileManger.isNew = len(names) == 0
+
+	//TODO: remove the tempxxxx, this file is generated when ???
+	tempNames, err := storage.List("temp")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range tempNames {
+		err := storage.Remove(name)
 		if err != nil {
 			return nil, err
 		}
@@ -59,72 +108,218 @@ func NewFileManager(dbDir string, blockSize uint64) (*FileManager, error) {
 	return &fileManger, nil
 }
 
-func (f *FileManager) getFile(fileName string) (*os.File, error) {
-	path := filepath.Join(f.dbDir, fileName)
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+// getFile opens the file or takes it from the openFiles, each getFile() should be followed by a putFile()
+func (f *FileManager) getFile(fileName string) (*cachedFile, error) {
+	return f.openFiles.get(fileName)
+}
+
+func (f *FileManager) putFile(cached *cachedFile) {
+	err := f.openFiles.put(cached)
 	if err != nil {
-		return nil, err
+		log.Printf("fails to close the file %s: %v\n", cached.name, err)
 	}
-	f.openFiles[fileName] = file
+}
 
-	return file, nil
+func (f *FileManager) syncDir() error {
+	if f.syncPolicy == SYNC_NEVER {
+		return nil
+	}
+	return f.storage.SyncDir()
+}
+
+/*
+SkipChecksum the files starting with the prefix are stored without the block header, e.g. the log, which checks
+its records by itself. It should be called before the files are used, an existing file isn't converted.
+*/
+func (f *FileManager) SkipChecksum(prefix string) {
+	for {
+		old := f.plainFiles.Load()
+		for _, skipped := range *old {
+			if skipped == prefix {
+				return
+			}
+		}
+		prefixes := append(append([]string(nil), *old...), prefix)
+		if f.plainFiles.CompareAndSwap(old, &prefixes) {
+			return
+		}
+	}
+}
+
+func (f *FileManager) checksummed(fileName string) bool {
+	for _, prefix := range *f.plainFiles.Load() {
+		if strings.HasPrefix(fileName, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// diskBlockSize the size of a block in the file, the page plus the header if checksummed
+func (f *FileManager) diskBlockSize(fileName string) uint64 {
+	if f.checksummed(fileName) {
+		return f.blockSize + BLOCK_HEADER_LEN
+	}
+	return f.blockSize
+}
+
+// getBlockBuf returns a buffer for the page of the size plus the header, each getBlockBuf() should be followed by a putBlockBuf()
+func (f *FileManager) getBlockBuf(size int) *[]byte {
+	if uint64(size) != f.blockSize {
+		block := make([]byte, uint64(size)+BLOCK_HEADER_LEN)
+		return &block
+	}
+	return f.blockBufs.Get().(*[]byte)
+}
+
+func (f *FileManager) putBlockBuf(block *[]byte) {
+	if uint64(len(*block)) == f.blockSize+BLOCK_HEADER_LEN {
+		f.blockBufs.Put(block)
+	}
 }
 
 /*
 Read read the data in BlockId and store it in Page. The Block Size always fits the blockNum of Page.
 
-- It uses a FILE_LOCK to lock the entire file
-- 🤔TODO: I think that's extremely low efficiency
-- The java provides some fileLock that can lock part of the file;
+No lock is held, the positional ReadAt() and WriteAt() of different blocks run in parallel.
+The BufferManager makes sure a block is read and written by one buffer at a time.
+
+An *ErrCorruptBlock is returned if the block doesn't match its checksum, the Page holds what has been read,
+the recovery may repair it from the log.
 */
 func (f *FileManager) Read(blk *BlockId, page *Page) (int, error) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
-	file, err := f.getFile(blk.GetFilePath())
+	fileName := blk.GetFilePath()
+	cached, err := f.getFile(fileName)
 	if err != nil {
 		return 0, err
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
+	defer f.putFile(cached)
 
+	offset := int64(blk.BlkNum() * f.diskBlockSize(fileName))
+	if !f.checksummed(fileName) {
+		count, err := cached.file.ReadAt(page.contents(), offset)
+		if err != nil {
+			return 0, err
 		}
-	}(file)
+		page.SetLSN(0)
+		return count, nil
+	}
+
+	block := f.getBlockBuf(len(page.contents()))
+	defer f.putBlockBuf(block)
 
-	count, err := file.ReadAt(page.contents(), int64(blk.BlkNum()*f.blockSize))
+	_, err = cached.file.ReadAt(*block, offset)
 	if err != nil {
 		return 0, err
 	}
-	return count, nil
+	count := copy(page.contents(), (*block)[BLOCK_HEADER_LEN:])
+	lsn, err := verifyBlock(blk, *block)
+	page.SetLSN(lsn)
+	return count, err
 }
 
 /*
 write data from Page to BlockId. The Block Size always fits the blockNum of Page.
 */
 func (f *FileManager) Write(blk *BlockId, page *Page) (int, error) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
 	/*FIXME: check if the file has been managed by FM before create it*/
-	file, err := f.getFile(blk.GetFilePath())
+	fileName := blk.GetFilePath()
+	cached, err := f.getFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.putFile(cached)
+
+	offset := int64(blk.BlkNum() * f.diskBlockSize(fileName))
+	if f.checksummed(fileName) {
+		block := f.getBlockBuf(len(page.contents()))
+		defer f.putBlockBuf(block)
+		sealBlock(blk.BlkNum(), page.LSN(), page.contents(), *block)
+		_, err = cached.file.WriteAt(*block, offset)
+	} else {
+		_, err = cached.file.WriteAt(page.contents(), offset)
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	defer func(file *os.File) {
-		err := file.Close()
+	if f.syncPolicy == SYNC_ALWAYS {
+		err = cached.file.Sync()
 		if err != nil {
-
+			return 0, err
 		}
-	}(file)
+	} else {
+		f.markUnsynced(fileName)
+	}
+	return len(page.contents()), nil
+}
 
-	count, err := file.WriteAt(page.contents(), int64(blk.BlkNum()*f.blockSize))
+/*
+Sync forces the written blocks of the file into the disk, the Write() alone may leave them in the OS cache.
+It does nothing with SYNC_NEVER.
+*/
+func (f *FileManager) Sync(fileName string) error {
+	if f.syncPolicy == SYNC_NEVER {
+		return nil
+	}
 
+	cached, err := f.getFile(fileName)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	defer f.putFile(cached)
+
+	// unmarked before the sync, so a Write() meanwhile marks it again rather than being taken as synced
+	f.mu.Lock()
+	delete(f.unsynced, fileName)
+	f.mu.Unlock()
+
+	err = cached.file.Sync()
+	if err != nil {
+		f.markUnsynced(fileName)
+		return err
 	}
-	return count, nil
+	return nil
+}
+
+func (f *FileManager) markUnsynced(fileName string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unsynced[fileName] = true
+}
+
+func (f *FileManager) appendLock(fileName string) *sync.Mutex {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	appendMu, ok := f.appendLocks[fileName]
+	if !ok {
+		appendMu = new(sync.Mutex)
+		f.appendLocks[fileName] = appendMu
+	}
+	return appendMu
+}
+
+/*
+SyncAll syncs every file written since its last Sync(). Once it returns, the pages written back before survive a crash,
+so the log records older than them are no longer needed.
+*/
+func (f *FileManager) SyncAll() error {
+	f.mu.Lock()
+	fileNames := make([]string, 0, len(f.unsynced))
+	for fileName := range f.unsynced {
+		fileNames = append(fileNames, fileName)
+	}
+	f.mu.Unlock()
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		err := f.Sync(fileName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 /*
@@ -133,22 +328,26 @@ The Size() in teacher's code
 */
 func (f *FileManager) BlockNum(fileName string) (uint64, error) {
 
-	file, err := f.getFile(fileName)
+	cached, err := f.getFile(fileName)
 	if err != nil {
 		return 0, err
 	}
+	defer f.putFile(cached)
 
-	fileStat, err := file.Stat()
+	size, err := cached.file.Size()
 	if err != nil {
 		return 0, err
 	}
-	return uint64(fileStat.Size()) / f.blockSize, nil
+	return uint64(size) / f.diskBlockSize(fileName), nil
 }
 
 /*
-Append uses the [blockSize]byte, empty, to expand the file by one block and returns the new blockId.
+Append uses an empty page, with its checksum unless skipped, to expand the file by one block and returns the new blockId.
 */
 func (f *FileManager) Append(fileName string) (BlockId, error) {
+	appendMu := f.appendLock(fileName)
+	appendMu.Lock()
+	defer appendMu.Unlock()
 
 	newBlockNum, err := f.BlockNum(fileName)
 	if err != nil {
@@ -159,26 +358,62 @@ func (f *FileManager) Append(fileName string) (BlockId, error) {
 	//then this newBlock should be 1.
 	newBlock := BlockId{fileName, newBlockNum}
 
-	file, err := f.getFile(newBlock.GetFilePath())
+	cached, err := f.getFile(newBlock.GetFilePath())
 
 	if err != nil {
 		return BlockId{}, err
 	}
+	defer f.putFile(cached)
 
-	/*TODO: after appending new block, should I close the file here?*/
-	defer func(file *os.File) {
-		err := file.Close()
+	buf := make([]byte, f.diskBlockSize(fileName))
+	if f.checksummed(fileName) {
+		sealBlock(newBlockNum, 0, make([]byte, f.blockSize), buf)
+	}
+	_, err = cached.file.WriteAt(buf, int64(newBlockNum*uint64(len(buf))))
+	if err != nil {
+		return BlockId{}, err
+	}
+
+	if f.syncPolicy == SYNC_ALWAYS {
+		err = cached.file.Sync()
 		if err != nil {
-			panic(err)
+			return BlockId{}, err
 		}
-	}(file)
+	} else {
+		f.markUnsynced(fileName)
+	}
+	// the file was empty, it may be just created
+	if newBlockNum == 0 {
+		err = f.syncDir()
+		if err != nil {
+			return BlockId{}, err
+		}
+	}
+	return newBlock, nil
+}
+
+// Truncate keeps the first blockNum blocks of the file, e.g. the log drops what follows its logical end
+func (f *FileManager) Truncate(fileName string, blockNum uint64) error {
+	appendMu := f.appendLock(fileName)
+	appendMu.Lock()
+	defer appendMu.Unlock()
 
-	buf := make([]byte, f.blockSize)
-	_, err = file.WriteAt(buf, int64(newBlock.BlkNum()*f.blockSize))
+	cached, err := f.getFile(fileName)
 	if err != nil {
-		return BlockId{}, err
+		return err
 	}
-	return newBlock, nil
+	defer f.putFile(cached)
+
+	err = cached.file.Truncate(int64(blockNum * f.diskBlockSize(fileName)))
+	if err != nil {
+		return err
+	}
+
+	if f.syncPolicy == SYNC_ALWAYS {
+		return cached.file.Sync()
+	}
+	f.markUnsynced(fileName)
+	return nil
 }
 
 func (f *FileManager) IsNew() bool {
@@ -196,3 +431,50 @@ func (f *FileManager) IsFileEmpty(fileName string) (bool, error) {
 	}
 	return num == 0, nil
 }
+
+// ListFiles returns the names of the files in the storage starting with the prefix, in lexical order
+func (f *FileManager) ListFiles(prefix string) ([]string, error) {
+	return f.storage.List(prefix)
+}
+
+// Remove deletes the file from the storage
+func (f *FileManager) Remove(fileName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.unsynced, fileName)
+	err := f.openFiles.drop(fileName)
+	if err != nil {
+		return err
+	}
+	err = f.storage.Remove(fileName)
+	if err != nil {
+		return err
+	}
+	return f.syncDir()
+}
+
+// MoveTo moves the file out of the storage into the dir, the dir is created if absent
+func (f *FileManager) MoveTo(fileName string, dir string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.unsynced, fileName)
+	err := f.openFiles.drop(fileName)
+	if err != nil {
+		return err
+	}
+	err = f.storage.MoveTo(fileName, dir)
+	if err != nil {
+		return err
+	}
+	return f.syncDir()
+}
+
+/*
+Close closes the open files. The FileManager is still usable, the files are opened again once needed,
+but the unsynced writes aren't synced by it, see SyncAll().
+*/
+func (f *FileManager) Close() error {
+	return f.openFiles.closeAll()
+}
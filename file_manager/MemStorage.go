@@ -0,0 +1,156 @@
+package file_manager
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+MemStorage keeps the files in the memory, nothing touches the disk. The files survive a new FileManager on the
+same MemStorage, so a restart is simulated by creating the managers again.
+
+Sync() and SyncDir() do nothing, every write is "durable" at once.
+*/
+type MemStorage struct {
+	mu       sync.Mutex
+	files    map[string]*memFile
+	archived map[string]map[string]*memFile // dir -> name -> file, see MoveTo()
+}
+
+type memFile struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{
+		files:    make(map[string]*memFile),
+		archived: make(map[string]map[string]*memFile),
+	}
+}
+
+func (s *MemStorage) Open(name string) (StorageFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[name]
+	if !ok {
+		file = &memFile{}
+		s.files[name] = file
+	}
+	return file, nil
+}
+
+func (s *MemStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(s.files, name)
+	return nil
+}
+
+func (s *MemStorage) List(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0)
+	for name := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemStorage) SyncDir() error {
+	return nil
+}
+
+func (s *MemStorage) MoveTo(name string, dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[name]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: name, Err: os.ErrNotExist}
+	}
+	delete(s.files, name)
+
+	if _, ok := s.archived[dir]; !ok {
+		s.archived[dir] = make(map[string]*memFile)
+	}
+	s.archived[dir][name] = file
+	return nil
+}
+
+// Archived returns the names of the files moved into the dir
+func (s *MemStorage) Archived(dir string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.archived[dir]))
+	for name := range s.archived[dir] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ReadAt behaves like the os.File, io.EOF if reading beyond the end
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	end := off + int64(len(p))
+	if end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return int64(len(f.data)), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size <= int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
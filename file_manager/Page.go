@@ -12,6 +12,7 @@ Tha page structure used to show how data is stored in the page.
 
 type Page struct {
 	buffer []byte
+	lsn    uint64 // the page LSN, kept in the block header rather than the page, see Checksum.go
 }
 
 func NewPageBySize(blockSize uint64) *Page {
@@ -26,6 +27,15 @@ func NewPageByBytes(buffer []byte) *Page {
 	}
 }
 
+// LSN the LSN of the latest log record applied to the page, 0 if unknown, e.g. the files without the checksum
+func (p *Page) LSN() uint64 {
+	return p.lsn
+}
+
+func (p *Page) SetLSN(lsn uint64) {
+	p.lsn = lsn
+}
+
 func (p *Page) GetInt(offset uint64) uint64 {
 	return binary.LittleEndian.Uint64(p.buffer[offset : offset+8])
 }
@@ -56,6 +66,18 @@ func (p *Page) SetBytes(offset uint64, b []byte) {
 	copy(p.buffer[offset+8:], b)
 }
 
+// GetRawBytes returns the length bytes at the offset, unlike the GetBytes() the length isn't stored in the page
+func (p *Page) GetRawBytes(offset uint64, length uint64) []byte {
+	newBuf := make([]byte, length)
+	copy(newBuf, p.buffer[offset:offset+length])
+	return newBuf
+}
+
+// SetRawBytes unlike the SetBytes() the length isn't stored in the page, the caller keeps it somewhere else
+func (p *Page) SetRawBytes(offset uint64, b []byte) {
+	copy(p.buffer[offset:], b)
+}
+
 /*!*/
 func (p *Page) GetString(offset uint64) string {
 	return string(p.GetBytes(offset))
@@ -0,0 +1,123 @@
+package file_manager
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Storage is where the FileManager keeps the files of a database, the names are relative to it.
+
+- OSStorage: the files in the dbDir of the OS file system
+- MemStorage: the files in the memory, for the tests
+*/
+type Storage interface {
+	// Open opens the file for reading and writing, creates it if absent
+	Open(name string) (StorageFile, error)
+	Remove(name string) error
+	// List returns the names of the files starting with the prefix, in lexical order
+	List(prefix string) ([]string, error)
+	// SyncDir makes the creation and removal of the files durable
+	SyncDir() error
+	// MoveTo moves the file out of the storage into the dir, i.e. archiving it
+	MoveTo(name string, dir string) error
+}
+
+type StorageFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() (int64, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+type OSStorage struct {
+	dbDir string
+}
+
+type osFile struct {
+	*os.File
+}
+
+// NewOSStorage creates the dbDir if absent
+func NewOSStorage(dbDir string) (*OSStorage, error) {
+	storage := &OSStorage{dbDir: dbDir}
+
+	if _, err := os.Stat(dbDir); os.IsNotExist(err) {
+		err := os.Mkdir(dbDir, os.ModeDir)
+		if err != nil {
+			return nil, err
+		}
+		err = syncDir(filepath.Dir(dbDir))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return storage, nil
+}
+
+func (s *OSStorage) Open(name string) (StorageFile, error) {
+	file, err := os.OpenFile(filepath.Join(s.dbDir, name), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{file}, nil
+}
+
+func (s *OSStorage) Remove(name string) error {
+	return os.Remove(filepath.Join(s.dbDir, name))
+}
+
+func (s *OSStorage) List(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(s.dbDir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasPrefix(entry.Name(), prefix) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *OSStorage) SyncDir() error {
+	return syncDir(s.dbDir)
+}
+
+func (s *OSStorage) MoveTo(name string, dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(filepath.Join(s.dbDir, name), filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func (f osFile) Size() (int64, error) {
+	fileStat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fileStat.Size(), nil
+}
@@ -6,8 +6,8 @@ import (
 )
 
 func TestFileManger(t *testing.T) {
-	var err error
-	fm, _ := NewFileManager("file_test", 400)
+	fm, err := NewFileManagerWithStorage(NewMemStorage(), 400, SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
 
 	blk := NewBlockId("testFile", 2)
 
@@ -52,3 +52,35 @@ func TestFileManger(t *testing.T) {
 	require.Equal(t, s1_exp, s1_act)
 	require.Equal(t, int_exp, int_act)
 }
+
+func TestMemStorage(t *testing.T) {
+	storage := NewMemStorage()
+	fileManager, err := NewFileManagerWithStorage(storage, 400, SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	require.True(t, fileManager.IsNew())
+
+	blk, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	writeInt(t, fileManager, &blk, 42)
+	_, err = fileManager.Append("tempfile")
+	require.Nil(t, err)
+
+	// a new FileManager on the same storage is a restart, the temp files are removed
+	fileManager, err = NewFileManagerWithStorage(storage, 400, SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	require.False(t, fileManager.IsNew())
+	require.Equal(t, uint64(42), readInt(t, fileManager, &blk))
+	names, err := fileManager.ListFiles("")
+	require.Nil(t, err)
+	require.Equal(t, []string{"testfile"}, names)
+
+	// reading beyond the end fails like the OS file
+	_, err = fileManager.Read(NewBlockId("testfile", 1), NewPageBySize(400))
+	require.NotNil(t, err)
+
+	require.Nil(t, fileManager.MoveTo("testfile", "archive"))
+	require.Equal(t, []string{"testfile"}, storage.Archived("archive"))
+	empty, err := fileManager.IsFileEmpty("testfile")
+	require.Nil(t, err)
+	require.True(t, empty)
+}
@@ -0,0 +1,146 @@
+package log_manager
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errGroupCommitStopped = errors.New("the group commit is stopped")
+
+type flushRequest struct {
+	done chan error
+}
+
+/*
+groupCommitter the background flusher of the group commit.
+
+	committer1 --FlushByLSN(5)--> |        |
+	committer2 --FlushByLSN(6)--> | batch  | --> one flush and sync of LR1...LR7 --> all of them return
+	committer3 --FlushByLSN(7)--> |        |
+
+- the first request opens a batch, the batch is closed after maxDelay or once it has maxBatch requests
+- the requests arriving during the sync wait for the next batch
+*/
+type groupCommitter struct {
+	logMgr   *LogFileManager
+	requests chan flushRequest
+	maxDelay time.Duration
+	maxBatch int
+	stop     chan struct{}
+	stopped  chan struct{} // closed once the flusher exits
+	batches  int           // the syncs done, only touched by the flusher
+	wg       sync.WaitGroup
+}
+
+/*
+StartGroupCommit the committers calling FlushByLSN() are batched into a single flush and sync by a background flusher.
+
+@param maxDelay how long the batch waits for more committers, 0 means taking only the ones already waiting
+
+@param maxBatch the most committers in a batch
+*/
+func (l *LogFileManager) StartGroupCommit(maxDelay time.Duration, maxBatch int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.group != nil {
+		return
+	}
+
+	g := &groupCommitter{
+		logMgr:   l,
+		requests: make(chan flushRequest),
+		maxDelay: maxDelay,
+		maxBatch: max(maxBatch, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	g.wg.Add(1)
+	go g.run()
+
+	l.group = g
+}
+
+// StopGroupCommit the waiting committers are served before it returns, the FlushByLSN() syncs by itself since then
+func (l *LogFileManager) StopGroupCommit() {
+	l.mutex.Lock()
+	g := l.group
+	l.group = nil
+	l.mutex.Unlock()
+
+	if g == nil {
+		return
+	}
+	close(g.stop)
+	g.wg.Wait()
+}
+
+// wait returns the errGroupCommitStopped if the flusher is gone before taking the request
+func (g *groupCommitter) wait() error {
+	req := flushRequest{
+		done: make(chan error, 1),
+	}
+
+	select {
+	case g.requests <- req:
+	case <-g.stopped:
+		return errGroupCommitStopped
+	}
+
+	return <-req.done
+}
+
+func (g *groupCommitter) run() {
+	defer g.wg.Done()
+	defer close(g.stopped)
+
+	for {
+		var batch []flushRequest
+
+		select {
+		case req := <-g.requests:
+			batch = append(batch, req)
+		case <-g.stop:
+			return
+		}
+
+		batch = g.collect(batch)
+
+		err := g.logMgr.syncLog()
+		g.batches += 1
+		for _, req := range batch {
+			req.done <- err
+		}
+	}
+}
+
+// collect adds the requests to the batch till the maxDelay passes or the batch is full
+func (g *groupCommitter) collect(batch []flushRequest) []flushRequest {
+	if g.maxDelay <= 0 {
+		for len(batch) < g.maxBatch {
+			select {
+			case req := <-g.requests:
+				batch = append(batch, req)
+			default:
+				return batch
+			}
+		}
+		return batch
+	}
+
+	timer := time.NewTimer(g.maxDelay)
+	defer timer.Stop()
+
+	for len(batch) < g.maxBatch {
+		select {
+		case req := <-g.requests:
+			batch = append(batch, req)
+		case <-timer.C:
+			return batch
+		case <-g.stop:
+			return batch
+		}
+	}
+	return batch
+}
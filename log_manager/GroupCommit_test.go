@@ -0,0 +1,145 @@
+package log_manager
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	fm "oh_my_godb/file_manager"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newGroupCommitTestManager the tests run on the MemStorage, the benchmarks on the disk as they measure the syncs
+func newGroupCommitTestManager(t testing.TB, storage fm.Storage) *LogFileManager {
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+
+	return logManager
+}
+
+// commit appends a record and waits for it to be saved
+func commit(lm *LogFileManager, i uint64) error {
+	lsn, err := lm.AppendLogRecordIntoPage(makeCommitRecord(i))
+	if err != nil {
+		return err
+	}
+	return lm.FlushByLSN(lsn)
+}
+
+func makeCommitRecord(i uint64) []byte {
+	rec := make([]byte, 2*UINT64_LEN)
+	page := fm.NewPageByBytes(rec)
+	page.SetInt(0, 2) // COMMIT
+	page.SetInt(UINT64_LEN, i)
+	return rec
+}
+
+func TestGroupCommitBatchesCommitters(t *testing.T) {
+	storage := fm.NewMemStorage()
+	logManager := newGroupCommitTestManager(t, storage)
+	logManager.StartGroupCommit(50*time.Millisecond, 8)
+	group := logManager.group
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := uint64(0); i < 8; i++ {
+		wg.Add(1)
+		go func(i uint64) {
+			defer wg.Done()
+			errs <- commit(logManager, i)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+	require.Equal(t, logManager.LatestLSN(), logManager.lastSavedLSN)
+
+	logManager.StopGroupCommit()
+	require.Less(t, group.batches, 8)
+
+	// the FlushByLSN syncs by itself once stopped
+	require.Nil(t, commit(logManager, 8))
+	latestLSN := logManager.LatestLSN()
+	require.Equal(t, latestLSN, logManager.lastSavedLSN)
+
+	// the saved records survive a restart
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err = NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	require.Equal(t, latestLSN, logManager.LatestLSN())
+}
+
+func TestGroupCommitBatchSize(t *testing.T) {
+	logManager := newGroupCommitTestManager(t, fm.NewMemStorage())
+	// the delay never ends a batch, so only the batch size does
+	logManager.StartGroupCommit(time.Hour, 2)
+	defer logManager.StopGroupCommit()
+
+	done := make(chan error, 2)
+	for i := uint64(0); i < 2; i++ {
+		go func(i uint64) {
+			done <- commit(logManager, i)
+		}(i)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			require.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the full batch isn't flushed")
+		}
+	}
+}
+
+/*
+BenchmarkCommit each committer appends a record and waits for the sync, e.g. go test -bench Commit -cpu 4
+
+	BenchmarkCommit/individual-4             3000     63450 ns/op
+	BenchmarkCommit/group-delay-0s-4         3000      8305 ns/op
+	BenchmarkCommit/group-delay-100µs-4      3000     18572 ns/op
+
+The slower the sync of the disk, the more the group commit gains.
+*/
+func BenchmarkCommit(b *testing.B) {
+	run := func(b *testing.B, logManager *LogFileManager) {
+		b.SetParallelism(8)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := uint64(0)
+			for pb.Next() {
+				err := commit(logManager, i)
+				if err != nil {
+					b.Error(err)
+				}
+				i++
+			}
+		})
+	}
+
+	b.Run("individual", func(b *testing.B) {
+		logManager := newGroupCommitTestManager(b, newDiskStorage(b))
+		run(b, logManager)
+	})
+
+	for _, delay := range []time.Duration{0, 100 * time.Microsecond} {
+		b.Run(fmt.Sprintf("group-delay-%v", delay), func(b *testing.B) {
+			logManager := newGroupCommitTestManager(b, newDiskStorage(b))
+			logManager.StartGroupCommit(delay, 64)
+			defer logManager.StopGroupCommit()
+			run(b, logManager)
+		})
+	}
+}
+
+// newDiskStorage the files go into a directory removed once the benchmark ends
+func newDiskStorage(b *testing.B) fm.Storage {
+	storage, err := fm.NewOSStorage(b.TempDir())
+	require.Nil(b, err)
+	return storage
+}
@@ -0,0 +1,60 @@
+package log_manager
+
+import (
+	"fmt"
+	fm "oh_my_godb/file_manager"
+	"strconv"
+	"strings"
+)
+
+/*
+The LSN is the position of the log record. The segments are seen as one address space of blocks, each segment is
+named by its start position, see SEGMENT_NAME_FORMAT, and its block N is at start + N * blockSize.
+The LSN of a record is the position of its block plus the bytes the block takes once the record is written:
+
+	position                                          position + blockSize
+	|whereToWrite|empty|.....|LR2 frame|LR1 frame|LR0 frame|
+	                         ⬆ offset
+	LSN(LR2) = position + blockSize - offset
+
+- a newer record always has a greater LSN, in the same block, the next block or the next segment
+- the LSN survives restarts, truncation and archiving, as the position is in the segment names
+- the LSN falls inside its block, never on the position of a block, so 0 is never an LSN
+*/
+
+// lsnOf the LSN of the record framed at the offset of the block
+func lsnOf(segmentStart uint64, blkNum uint64, offset uint64, blockSize uint64) uint64 {
+	return segmentStart + blkNum*blockSize + blockSize - offset
+}
+
+// parseSegmentStart the start position is the suffix of the segment name, see SEGMENT_NAME_FORMAT
+func parseSegmentStart(segment string) (uint64, bool) {
+	suffix := segment[strings.LastIndex(segment, ".")+1:]
+	start, err := strconv.ParseUint(suffix, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return start, true
+}
+
+/*
+locate returns the block and the offset of the frame the lsn points to, in the segments from the oldest to the newest.
+The lsn may still point to no record, the frame is checked by the caller.
+*/
+func locate(segments []string, lsn uint64, blockSize uint64) (*fm.BlockId, uint64, error) {
+	for i := len(segments) - 1; i >= 0; i-- {
+		start, _ := parseSegmentStart(segments[i])
+		if start >= lsn {
+			continue
+		}
+
+		used := (lsn - start) % blockSize
+		// the used bytes of a block are the frames after its whereToWrite
+		if used < RECORD_FRAME_LEN || used > blockSize-UINT64_LEN {
+			return nil, 0, fmt.Errorf("no log record at LSN %d", lsn)
+		}
+		return fm.NewBlockId(segments[i], (lsn-start)/blockSize), blockSize - used, nil
+	}
+
+	return nil, 0, fmt.Errorf("the log record of LSN %d is truncated", lsn)
+}
@@ -0,0 +1,136 @@
+package log_manager
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	fm "oh_my_godb/file_manager"
+)
+
+/*
+Each log record is framed with its length and a CRC32C, so a torn or garbage record is never returned as a record:
+
+	|LR      |LRLen|CRC|
+	|LRLen B |4B   |4B |
+	         <trailer>
+
+The top 2 bits of the LRLen are the FRAGMENT_KIND.
+
+The trailer at the end of the frame lets the records of a block be walked from the end of the block, i.e. from the
+oldest to the newest, see parseBlock(). The walk stops at the first invalid frame, which is the logical end of the log.
+The CRC covers the Kind, the LRLen and the LR.
+
+A record larger than an empty block is split into fragments, one frame each, see FRAGMENT_KIND:
+
+	|Block N               |  |Block N+1             |  |Block N+2             |
+	|whereToWrite|FIRST|...|  |whereToWrite|MIDDLE   |  |whereToWrite|...|LAST |
+
+- the FIRST fills what's left of the block, each MIDDLE fills a whole block, the LAST starts the block after them
+- the LSN of the record is the one of its LAST fragment, i.e. where the record ends
+- a record crossing a crash may be left without its LAST fragment, the iterators skip such fragments
+*/
+const (
+	RECORD_TRAILER_LEN = 8
+	RECORD_FRAME_LEN   = RECORD_TRAILER_LEN
+	MAX_FRAGMENT_LEN   = 1<<30 - 1 // the LRLen in the trailer is 30 bits, a larger record is split anyway
+
+	MIN_LOG_BLOCK_SIZE = UINT64_LEN + RECORD_FRAME_LEN + 1 // a block holds a fragment of 1 byte at least
+)
+
+// FRAGMENT_KIND tells which part of the record a frame holds
+type FRAGMENT_KIND uint32
+
+const (
+	FRAGMENT_FULL FRAGMENT_KIND = iota // the whole record
+	FRAGMENT_FIRST
+	FRAGMENT_MIDDLE
+	FRAGMENT_LAST
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func recordChecksum(kindAndLen uint32, record []byte) uint32 {
+	var meta [4]byte
+	binary.LittleEndian.PutUint32(meta[:], kindAndLen)
+
+	checksum := crc32.Update(0, castagnoli, meta[:])
+	return crc32.Update(checksum, castagnoli, record)
+}
+
+// writeRecord frames the record or its fragment at the offset, the frame takes RECORD_FRAME_LEN + len(record) bytes
+func writeRecord(page *fm.Page, offset uint64, kind FRAGMENT_KIND, record []byte) {
+	length := uint64(len(record))
+	kindAndLen := uint32(kind)<<30 | uint32(length)
+	page.SetRawBytes(offset, record)
+	page.SetInt(offset+length, uint64(recordChecksum(kindAndLen, record))<<32|uint64(kindAndLen))
+}
+
+// logFrame a record or its fragment along with the offset of its frame in the block
+type logFrame struct {
+	offset uint64
+	kind   FRAGMENT_KIND
+	record []byte
+}
+
+// readFrame returns the frame ending at the end, if it starts at the start or after it, and passes its CRC
+func readFrame(page *fm.Page, start uint64, end uint64) (logFrame, bool) {
+	// compare by addition as the subtraction may underflow
+	if end < start+RECORD_FRAME_LEN {
+		return logFrame{}, false
+	}
+	trailer := page.GetInt(end - RECORD_TRAILER_LEN)
+	kindAndLen := uint32(trailer)
+	length := uint64(kindAndLen & MAX_FRAGMENT_LEN)
+	if length > end-start-RECORD_FRAME_LEN {
+		return logFrame{}, false
+	}
+
+	offset := end - RECORD_FRAME_LEN - length
+	record := page.GetRawBytes(offset, length)
+	if recordChecksum(kindAndLen, record) != uint32(trailer>>32) {
+		return logFrame{}, false
+	}
+	return logFrame{offset: offset, kind: FRAGMENT_KIND(kindAndLen >> 30), record: record}, true
+}
+
+/*
+parseBlock walks the records of the log page from the end of the block to its whereToWrite, and returns them
+from the oldest to the newest, along with the offset of the newest one, where the next record goes.
+
+torn is true if the walk stops at an invalid frame before the whereToWrite, or the whereToWrite is garbage,
+the records after the invalid frame can't be found.
+*/
+func parseBlock(page *fm.Page, blockSize uint64) (frames []logFrame, end uint64, torn bool) {
+	whereToWrite := page.GetInt(0)
+	// the block is appended, but its whereToWrite is lost in a crash, it holds no record
+	if whereToWrite == 0 {
+		whereToWrite = blockSize
+	}
+	if whereToWrite < UINT64_LEN || whereToWrite > blockSize {
+		whereToWrite = UINT64_LEN
+		torn = true
+	}
+
+	end = blockSize
+	for end > whereToWrite {
+		frame, ok := readFrame(page, whereToWrite, end)
+		if !ok {
+			return frames, end, true
+		}
+
+		frames = append(frames, frame)
+		end = frame.offset
+	}
+
+	return frames, end, torn
+}
+
+// findFrame returns the frame at the offset of the block
+func findFrame(page *fm.Page, offset uint64, blockSize uint64) (logFrame, bool) {
+	frames, _, _ := parseBlock(page, blockSize)
+	for _, frame := range frames {
+		if frame.offset == offset {
+			return frame, true
+		}
+	}
+	return logFrame{}, false
+}
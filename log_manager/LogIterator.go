@@ -1,33 +1,62 @@
 package log_manager
 
-import fm "oh_my_godb/file_manager"
+import (
+	"bytes"
+	fm "oh_my_godb/file_manager"
+	"slices"
+)
 
+/*
+LogIterator walks the log from the newest record to the oldest one, from the last block of the newest segment
+to the block 0 of the oldest segment.
+
+Each block is parsed as a whole, see parseBlock(), only the records passing their CRC are returned.
+An invalid record in an older block leaves a hole in the log, the iterator stops there cleanly,
+as the records older than it can't be trusted to be followed by the ones already returned.
+A block failing to be read stops it too, but that's not the end of the log, the caller checks Err() after the walk.
+
+The fragments of a large record are met from the LAST one to the FIRST one, and joined into the record.
+*/
 type LogIterator struct {
-	fileManager  *fm.FileManager
-	blockId      *fm.BlockId // const
-	logPage      *fm.Page
-	curPos       uint64
-	whereToWrite uint64
+	fileManager *fm.FileManager
+	segments    []string    // the segment files, from the oldest to the newest
+	segIdx      int         // the segment of blockId
+	blockId     *fm.BlockId // the block currently mapped into logPage
+	logPage     *fm.Page
+	frames      []logFrame // the records of the block not returned yet, from the oldest to the newest
+	next        []byte     // the record HasNext() found, returned by the Next()
+	hasNext     bool
+	nextLSN     uint64
+	lsn         uint64 // the LSN of the record returned by the last Next()
+	stopped     bool   // the oldest block or a hole is reached, or err is set
+	err         error  // the read failing the walk, nil if it ends at the oldest block or a hole
 }
 
-func NewLogIterator(fileManager *fm.FileManager, blockId *fm.BlockId) *LogIterator {
+/*
+NewLogIterator starts from the blockId, which is in the last one of the segments.
+*/
+func NewLogIterator(fileManager *fm.FileManager, segments []string, blockId *fm.BlockId) (*LogIterator, error) {
 	it := LogIterator{
 		fileManager: fileManager,
+		segments:    segments,
+		segIdx:      len(segments) - 1,
 		blockId:     blockId,
 	}
 
 	it.logPage = fm.NewPageBySize(fileManager.BlockSize())
-	err := it.moveToBlock(blockId)
-
+	err := it.moveToBlock(blockId, true)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return &it
-
+	return &it, nil
 }
 
-// map the logPage to the blockId
-func (it *LogIterator) moveToBlock(blockId *fm.BlockId) error {
+/*
+map the logPage to the blockId and parse its records.
+
+The newest block may be torn, its valid records are returned. An older one being torn is a hole.
+*/
+func (it *LogIterator) moveToBlock(blockId *fm.BlockId, newest bool) error {
 	var err error
 
 	_, err = it.fileManager.Read(blockId, it.logPage) //mmap
@@ -36,50 +65,370 @@ func (it *LogIterator) moveToBlock(blockId *fm.BlockId) error {
 		return err
 	}
 
-	/*
-			|whereToWrite|empty|.....|empty|LR1Len|LR1      |LR0Len|LR0     |
-			|8B          |empty|.....|empty|8B    |LR1Len B |8B    |LR0Len B|
-		                                   ⬆ whereToWrite, curPos
-	*/
-	it.whereToWrite = it.logPage.GetInt(0)
-	it.curPos = it.whereToWrite
+	frames, _, torn := parseBlock(it.logPage, it.fileManager.BlockSize())
+	if torn && !newest {
+		it.frames = nil
+		it.stopped = true
+		return nil
+	}
+	it.frames = frames
 
 	return nil
 }
 
 /*
-Next get the next log record from the page.
+Next get the next log record, nil if there's none.
 
 LogPage and LogBlock layout:
-|whereToWrite|LRNLen|LRN     |.....|LR1Len|LR1      |LR0Len|LR0     |
-|8B          |8B    |LRNLen B|.....|8B    |LR1Len B |8B    |LR0Len B|
+|whereToWrite|LRN frame|.....|LR1 frame|LR0 frame|
+|8B          |         |.....|         |         |
 
-- LogRecord is written in reversed order, but we read it in forward order.
+- LogRecord is written in reversed order, the newest one is returned first.
 - The greater the N, the newer the log record.
 */
 func (it *LogIterator) Next() []byte {
+	if !it.HasNext() {
+		return nil
+	}
 
-	// the end of the log page, move to the next block
-	if it.curPos == it.fileManager.BlockSize() {
-		err := it.moveToBlock(fm.NewBlockId(it.blockId.GetFilePath(), it.blockId.BlkNum()-1))
+	it.hasNext = false
+	it.lsn = it.nextLSN
+	return it.next
+}
+
+// LSN returns the LSN of the record returned by the last Next()
+func (it *LogIterator) LSN() uint64 {
+	return it.lsn
+}
+
+// Err returns the read error stopping the walk, nil if the HasNext() is false as the log ends
+func (it *LogIterator) Err() error {
+	return it.err
+}
+
+/*
+HasNext joins the fragments of the next record if it's a large one. The FIRST and MIDDLE fragments without a LAST one,
+i.e. a record cut by a crash, are skipped.
+*/
+func (it *LogIterator) HasNext() bool {
+	var fragments [][]byte // from the newest to the oldest
+	var lsn uint64
+
+	for !it.hasNext {
+		frame, frameLSN, ok := it.nextFrame()
+		if !ok {
+			return false
+		}
+
+		switch frame.kind {
+		case FRAGMENT_FULL:
+			it.next, it.nextLSN, it.hasNext = frame.record, frameLSN, true
+		case FRAGMENT_LAST:
+			fragments, lsn = [][]byte{frame.record}, frameLSN
+		case FRAGMENT_MIDDLE:
+			if fragments != nil {
+				fragments = append(fragments, frame.record)
+			}
+		case FRAGMENT_FIRST:
+			if fragments != nil {
+				fragments = append(fragments, frame.record)
+				slices.Reverse(fragments)
+				it.next, it.nextLSN, it.hasNext = bytes.Join(fragments, nil), lsn, true
+			}
+		}
+	}
+
+	return true
+}
+
+// nextFrame returns the next frame along with its LSN, it moves to the previous blocks, the empty blocks are skipped
+func (it *LogIterator) nextFrame() (logFrame, uint64, bool) {
+	// the end of the log page, move to the next block, which may be the last block of the previous segment
+	for len(it.frames) == 0 && !it.stopped {
+		prevBlk, err := it.prevBlock()
+		if err == nil && prevBlk == nil {
+			it.stopped = true
+			break
+		}
+		if err == nil {
+			err = it.moveToBlock(prevBlk, false)
+		}
 		if err != nil {
-			return nil
+			it.stopped, it.err = true, err
+			break
 		}
+		it.blockId = prevBlk
+	}
+	if len(it.frames) == 0 {
+		return logFrame{}, 0, false
 	}
-	/*
-			|whereToWrite|empty|.....|empty|LR1Len|LR1      |LR0Len|LR0     |
-			|8B          |empty|.....|empty|8B    |LR1Len B |8B    |LR0Len B|
-		                                          |         |
-		                                          - Record  -
-		                                    ⬆ oldCurPos      ⬆ newCurPos
 
-	*/
-	record := it.logPage.GetBytes(it.curPos)
-	it.curPos += UINT64_LEN + it.logPage.GetInt(it.curPos) //update the curPos
+	frame := it.frames[len(it.frames)-1]
+	it.frames = it.frames[:len(it.frames)-1]
 
-	return record
+	start, _ := parseSegmentStart(it.segments[it.segIdx])
+	return frame, lsnOf(start, it.blockId.BlkNum(), frame.offset, it.fileManager.BlockSize()), true
 }
 
-func (it *LogIterator) HasNext() bool {
-	return it.curPos < it.fileManager.BlockSize() || it.blockId.BlkNum() > 0
+// prevBlock returns nil at the block 0 of the oldest segment
+func (it *LogIterator) prevBlock() (*fm.BlockId, error) {
+	if it.blockId.BlkNum() > 0 {
+		return fm.NewBlockId(it.blockId.GetFilePath(), it.blockId.BlkNum()-1), nil
+	}
+
+	for it.segIdx > 0 {
+		it.segIdx -= 1
+		blockNum, err := it.fileManager.BlockNum(it.segments[it.segIdx])
+		if err != nil {
+			return nil, err
+		}
+		if blockNum > 0 {
+			return fm.NewBlockId(it.segments[it.segIdx], blockNum-1), nil
+		}
+	}
+
+	return nil, nil
+}
+
+/*
+fragmentsBefore returns the FIRST and MIDDLE fragments of the large record whose next fragment starts the blockId,
+from the oldest to the newest, along with the LSN of the FIRST one, where the record starts.
+It returns false if any of them is not in the log, e.g. truncated or torn, and the error if a block fails to be read.
+*/
+func fragmentsBefore(
+	fileManager *fm.FileManager, segments []string, blockId *fm.BlockId) ([][]byte, uint64, bool, error) {
+	segIdx := slices.Index(segments, blockId.GetFilePath())
+	if segIdx < 0 {
+		return nil, 0, false, nil
+	}
+	// no frame left in the blockId, the walk starts from the previous block
+	it := LogIterator{
+		fileManager: fileManager,
+		segments:    segments,
+		segIdx:      segIdx,
+		blockId:     blockId,
+		logPage:     fm.NewPageBySize(fileManager.BlockSize()),
+	}
+
+	fragments := make([][]byte, 0)
+	for {
+		frame, frameLSN, ok := it.nextFrame()
+		if !ok {
+			return nil, 0, false, it.err
+		}
+
+		switch frame.kind {
+		case FRAGMENT_MIDDLE:
+			fragments = append(fragments, frame.record)
+		case FRAGMENT_FIRST:
+			fragments = append(fragments, frame.record)
+			slices.Reverse(fragments)
+			return fragments, frameLSN, true, nil
+		default:
+			return nil, 0, false, nil
+		}
+	}
+}
+
+/*
+LogForwardIterator walks the log from a LSN to the newest record, from the oldest to the newest,
+e.g. for the redo or the replication. It stops at the first invalid record, the logical end of the log,
+or at a block failing to be read, see Err().
+*/
+type LogForwardIterator struct {
+	fileManager *fm.FileManager
+	segments    []string    // the segment files, from the oldest to the newest
+	segIdx      int         // the segment of blockId
+	blockId     *fm.BlockId // the block mapped into logPage, or to be mapped if not loaded
+	loaded      bool
+	lastBlk     *fm.BlockId // the newest block when the iterator is created, nothing after it is read
+	fromLSN     uint64      // the records older than it are skipped
+	logPage     *fm.Page
+	frames      []logFrame // the records of the block not returned yet, from the oldest to the newest
+	started     bool       // a frame is returned by the nextFrame()
+	next        []byte     // the record HasNext() found, returned by the Next()
+	hasNext     bool
+	nextLSN     uint64
+	lsn         uint64 // the LSN of the record returned by the last Next()
+	stopped     bool   // the newest block or the first invalid record is reached, or err is set
+	err         error  // the read failing the walk, nil if it ends at the newest block or an invalid record
+}
+
+/*
+NewLogForwardIterator starts from the oldest record whose LSN is lsn or greater, the lastBlk is in the last one of
+the segments. A lsn older than the log starts from its oldest record.
+*/
+func NewLogForwardIterator(
+	fileManager *fm.FileManager, segments []string, lastBlk *fm.BlockId, lsn uint64) *LogForwardIterator {
+	it := LogForwardIterator{
+		fileManager: fileManager,
+		segments:    segments,
+		blockId:     fm.NewBlockId(segments[0], 0),
+		lastBlk:     lastBlk,
+		fromLSN:     lsn,
+		logPage:     fm.NewPageBySize(fileManager.BlockSize()),
+	}
+
+	for i := len(segments) - 1; i >= 0; i-- {
+		start, _ := parseSegmentStart(segments[i])
+		if start < lsn {
+			it.segIdx = i
+			it.blockId = fm.NewBlockId(segments[i], (lsn-start)/fileManager.BlockSize())
+			break
+		}
+	}
+	if it.segIdx == len(segments)-1 && it.blockId.BlkNum() > lastBlk.BlkNum() {
+		it.stopped = true
+	}
+
+	return &it
+}
+
+/*
+load maps the logPage to the blockId and parses its records, the records after an invalid one are dropped.
+A block beyond the end of its segment has no record.
+*/
+func (it *LogForwardIterator) load() error {
+	it.loaded = true
+	it.frames = nil
+
+	blockNum, err := it.fileManager.BlockNum(it.blockId.GetFilePath())
+	if err != nil {
+		return err
+	}
+	if it.blockId.BlkNum() >= blockNum {
+		return nil
+	}
+
+	_, err = it.fileManager.Read(it.blockId, it.logPage)
+	if err != nil {
+		return err
+	}
+
+	frames, _, torn := parseBlock(it.logPage, it.fileManager.BlockSize())
+	it.frames = frames
+	if torn {
+		it.stopped = true
+	}
+	return nil
+}
+
+// Next get the next log record, nil if there's none
+func (it *LogForwardIterator) Next() []byte {
+	if !it.HasNext() {
+		return nil
+	}
+
+	it.hasNext = false
+	it.lsn = it.nextLSN
+	return it.next
+}
+
+// LSN returns the LSN of the record returned by the last Next()
+func (it *LogForwardIterator) LSN() uint64 {
+	return it.lsn
+}
+
+// Err returns the read error stopping the walk, nil if the HasNext() is false as the log ends
+func (it *LogForwardIterator) Err() error {
+	return it.err
+}
+
+/*
+HasNext joins the fragments of the next record if it's a large one. The fragments before the block of the fromLSN are
+read backwards if the record ends after the fromLSN. The FIRST and MIDDLE fragments without a LAST one are skipped.
+*/
+func (it *LogForwardIterator) HasNext() bool {
+	var fragments [][]byte // from the oldest to the newest
+
+	for !it.hasNext {
+		first := !it.started
+		frame, frameLSN, ok := it.nextFrame()
+		if !ok {
+			return false
+		}
+
+		switch frame.kind {
+		case FRAGMENT_FULL:
+			fragments = nil
+			if frameLSN >= it.fromLSN {
+				it.next, it.nextLSN, it.hasNext = frame.record, frameLSN, true
+			}
+		case FRAGMENT_FIRST:
+			fragments = [][]byte{frame.record}
+		case FRAGMENT_MIDDLE, FRAGMENT_LAST:
+			// the record starts before the block of the fromLSN
+			if first && (frame.kind == FRAGMENT_MIDDLE || frameLSN >= it.fromLSN) {
+				var err error
+				fragments, _, _, err = fragmentsBefore(it.fileManager, it.segments[:it.segIdx+1], it.blockId)
+				if err != nil {
+					it.stopped, it.err, it.frames = true, err, nil
+					return false
+				}
+			}
+			if fragments == nil {
+				continue
+			}
+			fragments = append(fragments, frame.record)
+			if frame.kind == FRAGMENT_LAST {
+				if frameLSN >= it.fromLSN {
+					it.next, it.nextLSN, it.hasNext = bytes.Join(fragments, nil), frameLSN, true
+				}
+				fragments = nil
+			}
+		}
+	}
+
+	return true
+}
+
+// nextFrame returns the next frame along with its LSN, it moves to the next blocks, the empty blocks are skipped
+func (it *LogForwardIterator) nextFrame() (logFrame, uint64, bool) {
+	for len(it.frames) == 0 && !it.stopped {
+		if it.loaded {
+			moved, err := it.moveToNextBlock()
+			if err != nil || !moved {
+				it.stopped, it.err = true, err
+				break
+			}
+		}
+		err := it.load()
+		if err != nil {
+			it.stopped, it.err = true, err
+			break
+		}
+	}
+	if len(it.frames) == 0 {
+		return logFrame{}, 0, false
+	}
+
+	frame := it.frames[0]
+	it.frames = it.frames[1:]
+	it.started = true
+
+	start, _ := parseSegmentStart(it.segments[it.segIdx])
+	return frame, lsnOf(start, it.blockId.BlkNum(), frame.offset, it.fileManager.BlockSize()), true
+}
+
+// moveToNextBlock returns false at the lastBlk
+func (it *LogForwardIterator) moveToNextBlock() (bool, error) {
+	if it.blockId.Equals(it.lastBlk) {
+		return false, nil
+	}
+
+	blockNum, err := it.fileManager.BlockNum(it.blockId.GetFilePath())
+	if err != nil {
+		return false, err
+	}
+	if it.blockId.BlkNum()+1 < blockNum {
+		it.blockId = fm.NewBlockId(it.blockId.GetFilePath(), it.blockId.BlkNum()+1)
+		return true, nil
+	}
+
+	if it.segIdx+1 < len(it.segments) {
+		it.segIdx += 1
+		it.blockId = fm.NewBlockId(it.segments[it.segIdx], 0)
+		return true, nil
+	}
+	return false, nil
 }
@@ -1,32 +1,43 @@
 package log_manager
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
 	fm "oh_my_godb/file_manager"
+	"strings"
 	"sync"
 )
 
 const (
 	UINT64_LEN = 8
+
+	DEFAULT_SEGMENT_BLOCKS = 1024 // the blocks of a segment file
+
+	SEGMENT_NAME_FORMAT = "%s.%020d" // logFileName.startPosition, the zero padding keeps the lexical order
 )
 
 /*
 LogFile Structure:
 |Block0|Block1|Block2|...|BlockN|
     ↓ expand
-The LogFile Block Structure:
-|whereToWrite|LRNLen|LRN     |.....|LR1Len|LR1      |LR0Len|LR0     |
-|8B          |8B    |LRNLen B|.....|8B    |LR1Len B |8B    |LR0Len B|
+The LogFile Block Structure, each LR is framed with its length and CRC, see LogFrame.go:
+|whereToWrite|LRN     |LRNLen|CRC|.....|LR0     |LR0Len|CRC|
+|8B          |LRNLen B|4B    |4B |.....|LR0Len B|4B    |4B |
 
 The mapped logPage has the same structure:
 
-|whereToWrite|LRNLen|LRN     |.....|LR1Len|LR1      |LR0Len|LR0     |
-|8B          |8B    |LRNLen B|.....|8B    |LR1Len B |8B    |LR0Len B|
+|whereToWrite|LRN frame|.....|LR1 frame|LR0 frame|
 
 - notice the LogRecord is written in reverse order
-- suppose the whereToWrite is 400( appendNewBlockAndMmap() ), and the logRecordX is 100 bytes
+- suppose the whereToWrite is 400( appendNewBlockAndMmap() ), and the logRecordX is 92 bytes, i.e. a 100 bytes frame
 - then this logRecordX should be written in offset[300,399]
 - the whereToWrite should be updated as 300
-- TODO: the logFile is not concurrent. And no matter how many blocks the file contains, the logManager always use only one memory Page to handle it;
+- the first invalid frame is the logical end of the log, e.g. a block torn by a crash, see recoverTail()
+- a LR larger than an empty block is split into fragments over the blocks, see appendFragments()
+- no matter how many blocks the log contains, the logManager always use only one memory Page to handle it, unless
+the concurrent append is started, see StartConcurrentAppend();
 
 ------------------------------------------------------------------------------------
 
@@ -37,6 +48,18 @@ Snippet of the completed LogFile layout:
 newest to oldest:
 LRN -> LRN-1 -> LRN-2 -> LRN-3 -> ...
 
+------------------------------------------------------------------------------------
+
+The log is split into segment files, each one has segmentBlocks blocks at most, and is named by its start position,
+the blocks of all the segments make one address space, e.g. 400 bytes blocks and 4 blocks per segment:
+
+|logfile.00000000000000000000|logfile.00000000000000001600|logfile.00000000000000003200|
+  Block0 ... Block3             Block0 ... Block3             Block0 ... BlockN
+                                                                           ⬆ currentBlk is in the newest segment
+
+- the LSN of a record is its position in the address space, see LSN.go, ReadAt() and IteratorFrom() find it by the LSN
+- the segments older than what the recovery needs are removed or archived as a whole, see TruncateBefore(), ArchiveBefore()
+- the LSN survives restarts and the truncation, as the start position of each segment is in its name
 */
 
 /*
@@ -44,13 +67,19 @@ LogFileManager treated it as the child of the fileManager.
 FIXME: the design of the latestLSN and lastSavedLSN are buggy and confusing.
 */
 type LogFileManager struct {
-	fileManager  *fm.FileManager // !the ref is const
-	logFileName  string          // !the ref is const, fileName of the log file
-	logPage      *fm.Page        // !the ref is const, cache
-	currentBlk   *fm.BlockId     // current blockId being written to, will only be updated in AppendLogRecordIntoPage()
-	latestLSN    uint64          // LSN, the last sequence number of the log file, also the number of log records
-	lastSavedLSN uint64          // LSN, the last sequence number of the log file that has been saved to disk
-	mutex        *sync.Mutex     // !the ref is const
+	fileManager   *fm.FileManager // !the ref is const
+	logFileName   string          // !the ref is const, prefix of the segment files
+	segmentBlocks uint64          // !const, the max blocks of a segment file
+	segments      []string        // the segment files, from the oldest to the newest
+	currentStart  uint64          // the start position of the newest segment, see LSN.go
+	logPage       *fm.Page        // !the ref is const, cache
+	currentBlk    *fm.BlockId     // current blockId being written to, will only be updated in AppendLogRecordIntoPage()
+	latestLSN     uint64          // LSN of the newest log record, or the start of the newest segment if it has none
+	lastSavedLSN  uint64          // LSN of the newest log record that has been saved to disk
+	unsynced      map[string]bool // the segments written but not synced yet
+	group         *groupCommitter // nil unless the group commit is started
+	ring          *logRing        // nil unless the concurrent append is started
+	mutex         *sync.Mutex     // !the ref is const
 }
 
 func NewLogManagerWithConfig(dbPath string, blockSize uint64, logFileName string) (*LogFileManager, error) {
@@ -62,50 +91,170 @@ func NewLogManagerWithConfig(dbPath string, blockSize uint64, logFileName string
 }
 
 func NewLogManager(fileManager *fm.FileManager, logFileName string) (*LogFileManager, error) {
+	return NewLogManagerWithSegmentSize(fileManager, logFileName, DEFAULT_SEGMENT_BLOCKS)
+}
+
+func NewLogManagerWithSegmentSize(
+	fileManager *fm.FileManager, logFileName string, segmentBlocks uint64) (*LogFileManager, error) {
+
+	if segmentBlocks == 0 {
+		return nil, fmt.Errorf("a log segment needs 1 block at least")
+	}
+	if fileManager.BlockSize() < MIN_LOG_BLOCK_SIZE {
+		return nil, fmt.Errorf("a log block needs %d bytes at least", MIN_LOG_BLOCK_SIZE)
+	}
+
 	logManager := LogFileManager{
-		fileManager:  fileManager,
-		logFileName:  logFileName,
-		logPage:      fm.NewPageBySize(fileManager.BlockSize()),
-		latestLSN:    0,
-		lastSavedLSN: 0,
-		mutex:        new(sync.Mutex),
+		fileManager:   fileManager,
+		logFileName:   logFileName,
+		segmentBlocks: segmentBlocks,
+		logPage:       fm.NewPageBySize(fileManager.BlockSize()),
+		latestLSN:     0,
+		lastSavedLSN:  0,
+		unsynced:      make(map[string]bool),
+		mutex:         new(sync.Mutex),
 	}
 
-	logBlockNum, err := fileManager.BlockNum(logFileName)
+	// the records carry their own CRC, and a torn log block keeps its older records readable
+	fileManager.SkipChecksum(logFileName + ".")
 
+	segments, err := logManager.listSegments()
 	if err != nil {
 		return nil, err
 	}
+	logManager.segments = segments
+	if len(segments) > 0 {
+		logManager.currentStart, _ = logManager.segmentStart(segments[len(segments)-1])
+	}
 
 	//handle the curBlk, map it into the logPage
-	if logBlockNum == 0 {
+	if len(segments) == 0 {
 		/*
-			if the logFile is empty, create a new blockId for it
+			if the log is empty, create the first segment and a new blockId for it
 			|empty| -> |Block0|
 						 ⬆ currentBlk
 		*/
-		blockId, err := logManager.appendNewBlockAndMmap()
+		blockId, err := logManager.appendNewSegmentAndMmap()
+		if err != nil {
+			return nil, err
+		}
+		logManager.currentBlk = blockId
+		return &logManager, nil
+	}
+
+	/*
+		if the newest segment has logBlockNum = N + 1 blocks
+		|Block0|Block1|Block2|...|BlockN|
+									⬆ currentBlk
+	*/
+	lastSegment := segments[len(segments)-1]
+	logBlockNum, err := fileManager.BlockNum(lastSegment)
+	if err != nil {
+		return nil, err
+	}
+	if logBlockNum == 0 {
+		blockId, err := logManager.appendNewBlockAndMmap(lastSegment)
 		if err != nil {
 			return nil, err
 		}
 		logManager.currentBlk = blockId
 	} else {
-		/*
-			if the logFile is not empty and the logBlockNum = N + 1
-			|Block0|Block1|Block2|...|BlockN|
-										⬆ currentBlk
-		*/
-		logManager.currentBlk = fm.NewBlockId(logManager.logFileName, logBlockNum-1)
 		//mmap, map the currentBlock to the mem Page
-		_, err = logManager.fileManager.Read(logManager.currentBlk, logManager.logPage)
+		logManager.currentBlk, err = logManager.recoverTail(lastSegment, logBlockNum)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	//the LSN is the position of the newest record, a large one may start in the older segments
+	logManager.latestLSN = logManager.currentStart
+	it, err := NewLogIterator(logManager.fileManager, segments, logManager.currentBlk)
+	if err != nil {
+		return nil, err
+	}
+	if it.Next() != nil {
+		logManager.latestLSN = it.LSN()
+	}
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+	logManager.lastSavedLSN = logManager.latestLSN
+
 	return &logManager, nil
 }
 
+/*
+recoverTail maps the block of the newest segment holding the logical end of the log, i.e. the first invalid record,
+e.g. a block torn by a crash, or the last block if there's none.
+
+The records after the logical end are dropped: the block is rebuilt from its valid records and the blocks after it
+are truncated, so nothing appended later is followed by the garbage.
+*/
+func (l *LogFileManager) recoverTail(segment string, blockNum uint64) (*fm.BlockId, error) {
+	blockSize := l.fileManager.BlockSize()
+
+	for blkNum := uint64(0); blkNum < blockNum; blkNum++ {
+		blockId := fm.NewBlockId(segment, blkNum)
+		_, err := l.fileManager.Read(blockId, l.logPage)
+		if err != nil {
+			return nil, err
+		}
+
+		frames, end, torn := parseBlock(l.logPage, blockSize)
+		if !torn {
+			if blkNum+1 < blockNum {
+				continue
+			}
+			l.logPage.SetInt(0, end)
+			return blockId, nil
+		}
+
+		l.logPage.SetBytes(0, make([]byte, blockSize-UINT64_LEN))
+		// the frames keep their offsets, so do their LSNs
+		for _, frame := range frames {
+			writeRecord(l.logPage, frame.offset, frame.kind, frame.record)
+		}
+		l.logPage.SetInt(0, end)
+
+		err = l.fileManager.Truncate(segment, blkNum+1)
+		if err != nil {
+			return nil, err
+		}
+		_, err = l.fileManager.Write(blockId, l.logPage)
+		if err != nil {
+			return nil, err
+		}
+		l.unsynced[segment] = true
+		return blockId, nil
+	}
+
+	return nil, fmt.Errorf("the log segment %s has no block", segment)
+}
+
+// listSegments returns the segment files from the oldest to the newest
+func (l *LogFileManager) listSegments() ([]string, error) {
+	names, err := l.fileManager.ListFiles(l.logFileName + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, ok := l.segmentStart(name); ok {
+			segments = append(segments, name)
+		}
+	}
+	return segments, nil
+}
+
+// segmentStart parses the name of the segment, see SEGMENT_NAME_FORMAT
+func (l *LogFileManager) segmentStart(segment string) (uint64, bool) {
+	if !strings.HasPrefix(segment, l.logFileName+".") {
+		return 0, false
+	}
+	return parseSegmentStart(segment)
+}
+
 /*
 AppendLogRecordIntoPage
 
@@ -120,31 +269,35 @@ func (l *LogFileManager) AppendLogRecordIntoPage(logRecord []byte) (uint64, erro
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
+	for l.ring != nil && l.ring.stopping && l.ring.err == nil {
+		l.ring.cond.Wait()
+	}
+	if l.ring != nil {
+		return l.ring.append(logRecord)
+	}
+
 	/*
 		LogFile_Page structure, LR = logRecord:
-				|whereToWrite|LRNLen|LRN     |.....|LR1Len|LR1      |LR0Len|LR0     |
-				|8bytes      |8B    |LRNLen B|.....|8B    |LR1Len B |8B    |LR0Len B|
-		Suppose the whereToWrite is 400, and the recordSize is 100, then this new Record should be written in file offset[300,399]
+				|whereToWrite|LRN frame|.....|LR1 frame|LR0 frame|
+				|8bytes      |         |.....|         |         |
+		Suppose the whereToWrite is 400, and the frame is 100 bytes, then this new Record should be written in file offset[300,399]
 	*/
 	whereToWrite := l.logPage.GetInt(0) // check the appendNewBlockAndMmap()
 	recordSize := uint64(len(logRecord))
-	//byte slice should be appended with the len of the slice, check the Page struct
-	bytesNeed := recordSize + UINT64_LEN
+	//the record is framed with its len and CRC, see writeRecord()
+	bytesNeed := recordSize + RECORD_FRAME_LEN
+	blockSize := l.fileManager.BlockSize()
 
-	//the logPage can't contain the logRecord
-	if (whereToWrite - bytesNeed) < uint64(UINT64_LEN) {
+	//the logPage can't contain the logRecord, compare by addition as the subtraction may underflow
+	fitsEmptyBlock := bytesNeed+UINT64_LEN <= blockSize && recordSize <= MAX_FRAGMENT_LEN
+	if whereToWrite < bytesNeed+UINT64_LEN && fitsEmptyBlock {
 		/*
 					|Block0|Block1|             |Block0|Block1|Block2|
 			                   ⬆ curBlk                           ⬆ curBlk
 				- make sure the curBlk should be written back with updated data
 				- create a new Block2 for storing the locRecord
 		*/
-		err := l.Flush() //write logPage data into Block1
-		if err != nil {
-			return l.latestLSN, err
-		}
-		//mmap, the logPage now mapping to the empty Block2 is also empty
-		l.currentBlk, err = l.appendNewBlockAndMmap()
+		err := l.moveToNewBlock()
 		if err != nil {
 			return l.latestLSN, err
 		}
@@ -152,6 +305,11 @@ func (l *LogFileManager) AppendLogRecordIntoPage(logRecord []byte) (uint64, erro
 		whereToWrite = l.logPage.GetInt(0)
 	}
 
+	//the record is larger than an empty block, split it
+	if !fitsEmptyBlock {
+		return l.appendFragments(logRecord)
+	}
+
 	recordOffset := whereToWrite - bytesNeed
 
 	/*
@@ -159,23 +317,126 @@ func (l *LogFileManager) AppendLogRecordIntoPage(logRecord []byte) (uint64, erro
 		if not, the logPage now maps to the Block2(empty)
 	*/
 
-	l.logPage.SetBytes(recordOffset, logRecord) //update the logRecord
-	l.logPage.SetInt(0, recordOffset)           //set whereToWrite
-	l.latestLSN += 1                            // the logRecord sequence number
+	writeRecord(l.logPage, recordOffset, FRAGMENT_FULL, logRecord) //update the logRecord
+	l.logPage.SetInt(0, recordOffset)                              //set whereToWrite
+	l.latestLSN = lsnOf(l.currentStart, l.currentBlk.BlkNum(), recordOffset, blockSize)
 
 	return l.latestLSN, nil
 }
 
+/*
+appendFragments splits the logRecord into the fragments, see LogFrame.go. The FIRST one fills what's left of
+the currentBlk, unless it can't hold a byte, each following one starts a new block.
+
+If it fails in the middle, the fragments written have no LAST one and are skipped by the iterators.
+*/
+func (l *LogFileManager) appendFragments(logRecord []byte) (uint64, error) {
+	blockSize := l.fileManager.BlockSize()
+	kind := FRAGMENT_FIRST
+	rest := logRecord
+
+	for {
+		whereToWrite := l.logPage.GetInt(0)
+		if whereToWrite < MIN_LOG_BLOCK_SIZE {
+			err := l.moveToNewBlock()
+			if err != nil {
+				return l.latestLSN, err
+			}
+			continue
+		}
+
+		size := min(uint64(len(rest)), whereToWrite-UINT64_LEN-RECORD_FRAME_LEN, MAX_FRAGMENT_LEN)
+		if size == uint64(len(rest)) {
+			kind = FRAGMENT_LAST
+		}
+		offset := whereToWrite - RECORD_FRAME_LEN - size
+		writeRecord(l.logPage, offset, kind, rest[:size])
+		l.logPage.SetInt(0, offset)
+		rest = rest[size:]
+
+		if kind == FRAGMENT_LAST {
+			l.latestLSN = lsnOf(l.currentStart, l.currentBlk.BlkNum(), offset, blockSize)
+			return l.latestLSN, nil
+		}
+
+		kind = FRAGMENT_MIDDLE
+		err := l.moveToNewBlock()
+		if err != nil {
+			return l.latestLSN, err
+		}
+	}
+}
+
+/*
+moveToNewBlock writes the logPage back to the currentBlk, and maps the logPage to a new block, which is in a new segment
+if the segment of the currentBlk is full.
+
+WARN: don't use it solely
+*/
+func (l *LogFileManager) moveToNewBlock() error {
+	err := l.flush() //write logPage data into the currentBlk
+	if err != nil {
+		return err
+	}
+	//mmap, the logPage now mapping to the empty new block is also empty
+	var blockId *fm.BlockId
+	if l.currentBlk.BlkNum()+1 < l.segmentBlocks {
+		blockId, err = l.appendNewBlockAndMmap(l.currentBlk.GetFilePath())
+	} else {
+		// the segment is full, the record is the first one of the new segment
+		blockId, err = l.appendNewSegmentAndMmap()
+	}
+	if err != nil {
+		return err
+	}
+	l.currentBlk = blockId
+	return nil
+}
+
+/*
+appendNewSegmentAndMmap creates the segment file starting right after the currentBlk, and maps its Block0.
+
+The full segment is synced first. Otherwise the OS may save the new segment before the tail of the old one,
+and a crash leaves a hole in the log, e.g. the ROLLBACK survives but some of the CLRs before it don't.
+
+WARN: don't use it solely
+*/
+func (l *LogFileManager) appendNewSegmentAndMmap() (*fm.BlockId, error) {
+	if len(l.segments) > 0 {
+		fullSegment := l.segments[len(l.segments)-1]
+		err := l.fileManager.Sync(fullSegment)
+		if err != nil {
+			return nil, err
+		}
+		delete(l.unsynced, fullSegment)
+	}
+
+	start := uint64(0)
+	if l.currentBlk != nil {
+		start = l.currentStart + (l.currentBlk.BlkNum()+1)*l.fileManager.BlockSize()
+	}
+	segment := fmt.Sprintf(SEGMENT_NAME_FORMAT, l.logFileName, start)
+
+	blockId, err := l.appendNewBlockAndMmap(segment)
+	if err != nil {
+		return nil, err
+	}
+	l.segments = append(l.segments, segment)
+	l.currentStart = start
+
+	return blockId, nil
+}
+
 /*
 appendNewBlockAndMmap allocates a new Block and map it to a Page(not a new one). Use the logPage to assign the whereToWrite to the beginning of the blockId.
 
 WARN: don't use it solely
 */
-func (l *LogFileManager) appendNewBlockAndMmap() (*fm.BlockId, error) {
-	//allocate new blockId for the log file
+func (l *LogFileManager) appendNewBlockAndMmap(segment string) (*fm.BlockId, error) {
+	//allocate new blockId for the segment file
 
 	// |Block0| -> |Block0|Block1|
-	blockId, err := l.fileManager.Append(l.logFileName)
+	blockId, err := l.fileManager.Append(segment)
 	if err != nil {
 		return nil, err
 	}
@@ -187,6 +448,8 @@ func (l *LogFileManager) appendNewBlockAndMmap() (*fm.BlockId, error) {
 				|whereToWrite|empty| ...|empty|empty|
 			                                        ⬆ whereToWrite
 	*/
+	// clear the records of the previous block, or a torn write of the new block brings them back, see parseBlock()
+	l.logPage.SetBytes(0, make([]byte, l.fileManager.BlockSize()-UINT64_LEN))
 	l.logPage.SetInt(0, l.fileManager.BlockSize()) //set whereToWrite
 
 	//empty block means empty page
@@ -194,45 +457,297 @@ func (l *LogFileManager) appendNewBlockAndMmap() (*fm.BlockId, error) {
 	if err != nil {
 		return nil, err
 	}
+	l.unsynced[segment] = true
 
 	return &blockId, nil
 }
 
 /*
-FlushByLSN used for write the logRecord back to disk with number LSN.
+FlushByLSN used for write the logRecord back to disk with number LSN, and sync it. Once it returns, the logRecord survives a crash.
 But if other LRs share the same block with the logRecord, they will also be flushed.
+
+With the group commit started, the caller waits for the flusher instead, see StartGroupCommit().
+With the concurrent append started, only the records up to the lsn are waited for, see StartConcurrentAppend().
 */
 func (l *LogFileManager) FlushByLSN(lsn uint64) error {
+	l.mutex.Lock()
 	// if the lastSavedLSN is 6, and the lsn is 5, that means the log file has been flushed to disk
-	if lsn > l.lastSavedLSN {
-		err := l.Flush()
+	if lsn <= l.lastSavedLSN {
+		l.mutex.Unlock()
+		return nil
+	}
+	group := l.group
+	l.mutex.Unlock()
+
+	if group != nil {
+		err := group.wait()
+		if !errors.Is(err, errGroupCommitStopped) {
+			return err
+		}
+	}
+
+	return l.syncLogThrough(lsn)
+}
+
+/*
+syncLog flushes the logPage and syncs every segment written since the last sync, then all the records appended
+before are saved. The mutex is released during the sync, so the appending goes on.
+*/
+func (l *LogFileManager) syncLog() error {
+	return l.syncLogThrough(math.MaxUint64)
+}
+
+// syncLogThrough like the syncLog(), the records after the lsn may be left in the ring
+func (l *LogFileManager) syncLogThrough(lsn uint64) error {
+	l.mutex.Lock()
+	savedLSN := l.latestLSN
+	var err error
+	if l.ring != nil {
+		savedLSN = min(savedLSN, lsn)
+		err = l.ring.writeThrough(savedLSN)
+	} else {
+		err = l.flush()
+	}
+	if err != nil {
+		l.mutex.Unlock()
+		return err
+	}
+	segments := l.unsynced
+	l.unsynced = make(map[string]bool)
+	l.mutex.Unlock()
+
+	for segment := range segments {
+		err = l.fileManager.Sync(segment)
 		if err != nil {
+			l.mutex.Lock()
+			for segment := range segments {
+				l.unsynced[segment] = true
+			}
+			l.mutex.Unlock()
 			return err
 		}
-		l.lastSavedLSN = lsn
 	}
 
+	l.mutex.Lock()
+	l.lastSavedLSN = max(l.lastSavedLSN, savedLSN)
+	l.mutex.Unlock()
+
 	return nil
 }
 
 /*
 Flush just write the current logPage back to the file blockId. It won't alter currentBlk and latestLSN, latestSavedLSN.
+With the concurrent append started, it waits for the writer to write the records appended so far.
 */
 func (l *LogFileManager) Flush() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.writeBack()
+}
+
+// writeBack the records appended so far are in the files once it returns, the caller holds the mutex
+func (l *LogFileManager) writeBack() error {
+	if l.ring != nil {
+		return l.ring.writeThrough(l.latestLSN)
+	}
+	return l.flush()
+}
+
+// flush the caller holds the mutex
+func (l *LogFileManager) flush() error {
 	_, err := l.fileManager.Write(l.currentBlk, l.logPage)
 	if err != nil {
 		return err
 	}
+	l.unsynced[l.currentBlk.GetFilePath()] = true
 	return nil
 }
 
+// LatestLSN returns the LSN of the newest log record, the Iterator() starts from it
+func (l *LogFileManager) LatestLSN() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.latestLSN
+}
+
 /*
 Iterator For a consistent view, the logPage should be flushed into the disk before creating the iterator. So that's a time consuming operation.
 */
-func (l *LogFileManager) Iterator() *LogIterator {
-	err := l.Flush()
+func (l *LogFileManager) Iterator() (*LogIterator, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	err := l.writeBack()
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	segments := append([]string(nil), l.segments...)
+	return NewLogIterator(l.fileManager, segments, l.currentBlk)
+}
+
+/*
+IteratorFrom walks the log from the record of the lsn, or the oldest record after it, to the newest one.
+It flushes the logPage like the Iterator().
+*/
+func (l *LogFileManager) IteratorFrom(lsn uint64) (*LogForwardIterator, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	err := l.writeBack()
+	if err != nil {
+		return nil, err
+	}
+	segments := append([]string(nil), l.segments...)
+	return NewLogForwardIterator(l.fileManager, segments, l.currentBlk, lsn), nil
+}
+
+/*
+ReadAt returns the log record of the lsn. It fails if the lsn points to no record, or the record is truncated or invalid.
+
+The record in the currentBlk is read from the logPage, the older ones from the disk without holding the mutex.
+*/
+func (l *LogFileManager) ReadAt(lsn uint64) ([]byte, error) {
+	blockSize := l.fileManager.BlockSize()
+
+	l.mutex.Lock()
+	if lsn > l.latestLSN {
+		l.mutex.Unlock()
+		return nil, fmt.Errorf("no log record at LSN %d, the latest LSN is %d", lsn, l.latestLSN)
+	}
+	if l.ring != nil {
+		err := l.ring.writeThrough(lsn)
+		if err != nil {
+			l.mutex.Unlock()
+			return nil, err
+		}
+	}
+	blockId, offset, err := locate(l.segments, lsn, blockSize)
+	if err != nil {
+		l.mutex.Unlock()
+		return nil, err
+	}
+
+	segments := append([]string(nil), l.segments...)
+	var frame logFrame
+	var ok bool
+	if l.ring == nil && blockId.Equals(l.currentBlk) {
+		frame, ok = findFrame(l.logPage, offset, blockSize)
+		l.mutex.Unlock()
+	} else {
+		l.mutex.Unlock()
+		page := fm.NewPageBySize(blockSize)
+		_, err = l.fileManager.Read(blockId, page)
+		if err != nil {
+			return nil, err
+		}
+		frame, ok = findFrame(page, offset, blockSize)
+	}
+	if !ok || frame.kind == FRAGMENT_FIRST || frame.kind == FRAGMENT_MIDDLE {
+		return nil, fmt.Errorf("no log record at LSN %d", lsn)
+	}
+	if frame.kind == FRAGMENT_FULL {
+		return frame.record, nil
+	}
+
+	// the fragments before the LAST one are in the blocks written back already
+	fragments, _, ok, err := fragmentsBefore(l.fileManager, segments, blockId)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("the log record of LSN %d misses its fragments", lsn)
+	}
+	return bytes.Join(append(fragments, frame.record), nil), nil
+}
+
+// Segments returns the segment files, from the oldest to the newest
+func (l *LogFileManager) Segments() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.segments...)
+}
+
+/*
+TruncateBefore removes the segments whose records are all older than the lsn, i.e. the next segment starts at the lsn
+or before it. The segment being written is always kept. The caller makes sure the recovery needs nothing older than the lsn.
+
+The LSN of a large record is where it ends, its FIRST fragment may be in an older segment, which is kept too:
+
+	|segment0          |  |segment1          |
+	|...|FIRST|MIDDLE  |  |LAST|...          |
+	                        ⬆ lsn, the cut is at the FIRST, see recordStart()
+*/
+func (l *LogFileManager) TruncateBefore(lsn uint64) error {
+	return l.dropSegmentsBefore(lsn, l.fileManager.Remove)
+}
+
+// ArchiveBefore moves the segments TruncateBefore() would remove into the archiveDir
+func (l *LogFileManager) ArchiveBefore(lsn uint64, archiveDir string) error {
+	return l.dropSegmentsBefore(lsn, func(segment string) error {
+		return l.fileManager.MoveTo(segment, archiveDir)
+	})
+}
+
+func (l *LogFileManager) dropSegmentsBefore(lsn uint64, drop func(segment string) error) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	cut, err := l.recordStart(lsn)
+	if err != nil {
+		return err
+	}
+	for len(l.segments) > 1 {
+		nextStart, _ := l.segmentStart(l.segments[1])
+		if nextStart > cut {
+			break
+		}
+
+		err := drop(l.segments[0])
+		if err != nil {
+			return err
+		}
+		delete(l.unsynced, l.segments[0])
+		l.segments = l.segments[1:]
+	}
+
+	return nil
+}
+
+/*
+recordStart returns the LSN of the FIRST fragment if the record of the lsn is a large one, the lsn otherwise,
+e.g. the lsn points to no record. The caller holds the mutex.
+*/
+func (l *LogFileManager) recordStart(lsn uint64) (uint64, error) {
+	if lsn > l.latestLSN {
+		return lsn, nil
+	}
+	blockSize := l.fileManager.BlockSize()
+	blockId, offset, err := locate(l.segments, lsn, blockSize)
+	if err != nil {
+		return lsn, nil
+	}
+
+	// the fragments are read from the disk
+	err = l.writeBack()
+	if err != nil {
+		return 0, err
+	}
+	page := fm.NewPageBySize(blockSize)
+	_, err = l.fileManager.Read(blockId, page)
+	if err != nil {
+		return 0, err
+	}
+	frame, ok := findFrame(page, offset, blockSize)
+	if !ok || frame.kind != FRAGMENT_LAST {
+		return lsn, nil
+	}
+
+	_, firstLSN, ok, err := fragmentsBefore(l.fileManager, l.segments, blockId)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return lsn, nil
 	}
-	return NewLogIterator(l.fileManager, l.currentBlk)
+	return firstLSN, nil
 }
@@ -1,6 +1,7 @@
 package log_manager
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	fm "oh_my_godb/file_manager"
@@ -28,22 +29,29 @@ func makeLogRecord(strRecord string, intRecord uint64) []byte {
 	return buf
 }
 
-func createRecord(lm *LogFileManager, startLSN uint64, endLSN uint64) {
-	for i := startLSN; i < endLSN+1; i++ {
+// createRecord appends the records numbered from start to end, and returns their LSNs
+func createRecord(lm *LogFileManager, start uint64, end uint64) []uint64 {
+	lsns := make([]uint64, 0, end-start+1)
+	for i := start; i < end+1; i++ {
 		recordBytes := makeLogRecord(fmt.Sprintf("record%d", i), i)
 		//|LRNLen|LRN| ... |LR0Len|LRN|
-		_, err := lm.AppendLogRecordIntoPage(recordBytes)
+		lsn, err := lm.AppendLogRecordIntoPage(recordBytes)
 		if err != nil {
-			return
+			return lsns
 		}
+		lsns = append(lsns, lsn)
 	}
+	return lsns
 }
 
 func TestLogManager(t *testing.T) {
 	//prepare
 	var err error
 
-	logManager, err := NewLogManagerWithConfig("log_test", 200, "logfile")
+	//the iterator walks the whole file, so start from an empty log
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 200, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := NewLogManager(fileManager, "logfile")
 
 	if err != nil {
 		return
@@ -56,7 +64,8 @@ func TestLogManager(t *testing.T) {
 	// read the log record
 	recCount := endLSN
 	// for view consistency, the iterator will trigger flush
-	it := logManager.Iterator()
+	it, err := logManager.Iterator()
+	require.Nil(t, err)
 	for it.HasNext() {
 		logFileBlockBuf := it.Next()
 		// use the page to analyse the []byte
@@ -72,3 +81,386 @@ func TestLogManager(t *testing.T) {
 		recCount -= 1
 	}
 }
+
+func TestLogSegments(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 200, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := NewLogManagerWithSegmentSize(fileManager, "logfile", 2)
+	require.Nil(t, err)
+
+	lsns := createRecord(logManager, 1, 60)
+	segments := logManager.Segments()
+	require.Greater(t, len(segments), 2)
+	require.Equal(t, "logfile.00000000000000000000", segments[0])
+	require.Equal(t, "logfile.00000000000000000400", segments[1])
+
+	// the iterator crosses the segments
+	checkRecords := func(lm *LogFileManager, newest uint64, oldest uint64) {
+		recCount := newest
+		it, err := lm.Iterator()
+		require.Nil(t, err)
+		for it.HasNext() {
+			page := fm.NewPageByBytes(it.Next())
+			require.Equal(t, fmt.Sprintf("record%d", recCount), page.GetString(0))
+			recCount -= 1
+		}
+		require.Equal(t, oldest-1, recCount)
+	}
+	checkRecords(logManager, 60, 1)
+
+	// the LSN goes on after the restart
+	logManager, err = NewLogManagerWithSegmentSize(fileManager, "logfile", 2)
+	require.Nil(t, err)
+	require.Equal(t, lsns[59], logManager.LatestLSN())
+	require.Equal(t, segments, logManager.Segments())
+
+	// the segments holding the records older than the record30 only are removed
+	err = logManager.TruncateBefore(lsns[29])
+	require.Nil(t, err)
+	segments = logManager.Segments()
+	start, ok := logManager.segmentStart(segments[0])
+	require.True(t, ok)
+	require.Less(t, start, lsns[29])
+	nextStart, _ := logManager.segmentStart(segments[1])
+	require.Greater(t, nextStart, lsns[29])
+	oldest := uint64(0)
+	for oldest < 60 && lsns[oldest] < start {
+		oldest += 1
+	}
+	checkRecords(logManager, 60, oldest+1)
+
+	// the archived segments are moved out of the db dir, the one being written is kept
+	err = logManager.ArchiveBefore(lsns[59], "log_segment_test_archive")
+	require.Nil(t, err)
+	require.Equal(t, segments[:len(segments)-1], storage.Archived("log_segment_test_archive"))
+	require.Equal(t, segments[len(segments)-1:], logManager.Segments())
+
+	logManager, err = NewLogManagerWithSegmentSize(fileManager, "logfile", 2)
+	require.Nil(t, err)
+	require.Equal(t, lsns[59], logManager.LatestLSN())
+	lsn, err := logManager.AppendLogRecordIntoPage(makeLogRecord("record61", 61))
+	require.Nil(t, err)
+	require.Greater(t, lsn, lsns[59])
+}
+
+// flipRecord flips a byte of the record in the raw segment file, as a torn or decayed write would
+func flipRecord(t *testing.T, storage fm.Storage, segment string, record string) {
+	file, err := storage.Open(segment)
+	require.Nil(t, err)
+	size, err := file.Size()
+	require.Nil(t, err)
+	data := make([]byte, size)
+	_, err = file.ReadAt(data, 0)
+	require.Nil(t, err)
+
+	offset := bytes.Index(data, []byte(record))
+	require.GreaterOrEqual(t, offset, 0)
+	_, err = file.WriteAt([]byte{data[offset] ^ 0x01}, int64(offset))
+	require.Nil(t, err)
+}
+
+func readRecords(t *testing.T, lm *LogFileManager) []string {
+	records := make([]string, 0)
+	it, err := lm.Iterator()
+	require.Nil(t, err)
+	for it.HasNext() {
+		records = append(records, fm.NewPageByBytes(it.Next()).GetString(0))
+	}
+	return records
+}
+
+func TestLogEndsAtInvalidRecord(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 200, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	lsns := createRecord(logManager, 1, 20)
+	require.Nil(t, logManager.FlushByLSN(lsns[19]))
+	segment := logManager.Segments()[0]
+	blockNum, err := fileManager.BlockNum(segment)
+	require.Nil(t, err)
+
+	// the log ends right before the invalid record, the newer ones are dropped
+	flipRecord(t, storage, segment, "record10")
+	logManager, err = NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	require.Equal(t, lsns[8], logManager.LatestLSN())
+	expected := make([]string, 0)
+	for i := 9; i >= 1; i-- {
+		expected = append(expected, fmt.Sprintf("record%d", i))
+	}
+	require.Equal(t, expected, readRecords(t, logManager))
+	truncated, err := fileManager.BlockNum(segment)
+	require.Nil(t, err)
+	require.Less(t, truncated, blockNum)
+
+	// the new records follow the valid ones, the garbage never comes back
+	lsn, err := logManager.AppendLogRecordIntoPage(makeLogRecord("record10", 10))
+	require.Nil(t, err)
+	require.Equal(t, lsns[9], lsn)
+	require.Nil(t, logManager.FlushByLSN(lsn))
+	logManager, err = NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	require.Equal(t, lsns[9], logManager.LatestLSN())
+	require.Equal(t, append([]string{"record10"}, expected...), readRecords(t, logManager))
+}
+
+func TestLogIteratorStopsAtHole(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 200, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := NewLogManagerWithSegmentSize(fileManager, "logfile", 2)
+	require.Nil(t, err)
+	lsns := createRecord(logManager, 1, 60)
+	require.Nil(t, logManager.FlushByLSN(lsns[59]))
+
+	// an older segment decays, the records newer than the hole are still read, and nothing older
+	segments := logManager.Segments()
+	require.Greater(t, len(segments), 2)
+	secondStart, _ := logManager.segmentStart(segments[1])
+	decayed := 0
+	for lsns[decayed] < secondStart {
+		decayed += 1
+	}
+	decayedRecord := fmt.Sprintf("record%d", decayed+1)
+	flipRecord(t, storage, segments[1], decayedRecord)
+	records := readRecords(t, logManager)
+	require.Greater(t, len(records), 0)
+	require.Less(t, len(records), 60)
+	for i, record := range records {
+		require.Equal(t, fmt.Sprintf("record%d", 60-i), record)
+	}
+	require.NotContains(t, records, decayedRecord)
+}
+
+func TestReadAtAndForwardIterator(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 200, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := NewLogManagerWithSegmentSize(fileManager, "logfile", 2)
+	require.Nil(t, err)
+	lsns := createRecord(logManager, 1, 60)
+	require.Greater(t, len(logManager.Segments()), 2)
+
+	// the newer the record, the greater the LSN, and each one finds its record, the unflushed ones too
+	for i, lsn := range lsns {
+		if i > 0 {
+			require.Greater(t, lsn, lsns[i-1])
+		}
+		record, err := logManager.ReadAt(lsn)
+		require.Nil(t, err)
+		require.Equal(t, fmt.Sprintf("record%d", i+1), fm.NewPageByBytes(record).GetString(0))
+	}
+
+	// the forward iterator starts from the record of the LSN, or the first one after it
+	checkForward := func(from uint64, first int) {
+		it, err := logManager.IteratorFrom(from)
+		require.Nil(t, err)
+		for i := first; i < len(lsns); i++ {
+			require.True(t, it.HasNext())
+			require.Equal(t, fmt.Sprintf("record%d", i+1), fm.NewPageByBytes(it.Next()).GetString(0))
+			require.Equal(t, lsns[i], it.LSN())
+		}
+		require.False(t, it.HasNext())
+		require.Nil(t, it.Next())
+	}
+	checkForward(lsns[20], 20)
+	checkForward(lsns[20]+1, 21)
+	checkForward(0, 0)
+	checkForward(lsns[59]+1, 60)
+
+	// the LSNs survive the restart
+	logManager, err = NewLogManagerWithSegmentSize(fileManager, "logfile", 2)
+	require.Nil(t, err)
+	record, err := logManager.ReadAt(lsns[30])
+	require.Nil(t, err)
+	require.Equal(t, "record31", fm.NewPageByBytes(record).GetString(0))
+	checkForward(lsns[30], 30)
+
+	// no record at the LSN
+	for _, lsn := range []uint64{0, lsns[30] + 1, lsns[59] + 1} {
+		_, err = logManager.ReadAt(lsn)
+		require.NotNil(t, err)
+	}
+
+	// the truncated records can't be read
+	err = logManager.TruncateBefore(lsns[40])
+	require.Nil(t, err)
+	_, err = logManager.ReadAt(lsns[0])
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "truncated")
+	record, err = logManager.ReadAt(lsns[40])
+	require.Nil(t, err)
+	require.Equal(t, "record41", fm.NewPageByBytes(record).GetString(0))
+}
+
+// makeLargeRecord a record of the size, each byte tells the record and its position in it
+func makeLargeRecord(i int, size int) []byte {
+	record := make([]byte, size)
+	for j := range record {
+		record[j] = byte(i*31 + j)
+	}
+	return record
+}
+
+func TestLargeRecords(t *testing.T) {
+	for _, blockSize := range []uint64{MIN_LOG_BLOCK_SIZE, 20, 64} {
+		storage := fm.NewMemStorage()
+		fileManager, err := fm.NewFileManagerWithStorage(storage, blockSize, fm.SYNC_ON_LOG_FLUSH)
+		require.Nil(t, err)
+		logManager, err := NewLogManagerWithSegmentSize(fileManager, "logfile", 3)
+		require.Nil(t, err)
+
+		// the records fitting a block, crossing a few blocks, and crossing the segments
+		sizes := []int{0, 1, 3, 4, 5, 11, 50, 2, 200, 7, 1000, 0, 9}
+		records := make([][]byte, 0, len(sizes))
+		lsns := make([]uint64, 0, len(sizes))
+		for i, size := range sizes {
+			records = append(records, makeLargeRecord(i, size))
+			lsn, err := logManager.AppendLogRecordIntoPage(records[i])
+			require.Nil(t, err)
+			if i > 0 {
+				require.Greater(t, lsn, lsns[i-1])
+			}
+			lsns = append(lsns, lsn)
+		}
+		require.Greater(t, len(logManager.Segments()), 2)
+
+		checkRecords := func(lm *LogFileManager) {
+			it, err := lm.Iterator()
+			require.Nil(t, err)
+			for i := len(records) - 1; i >= 0; i-- {
+				require.True(t, it.HasNext(), "block size %d, record %d", blockSize, i)
+				require.Equal(t, records[i], it.Next())
+				require.Equal(t, lsns[i], it.LSN())
+			}
+			require.False(t, it.HasNext())
+
+			for i := range records {
+				record, err := lm.ReadAt(lsns[i])
+				require.Nil(t, err)
+				require.Equal(t, records[i], record)
+
+				// the record ending after the lsn is joined, even if its fragments start before
+				for _, from := range []uint64{lsns[i], lsns[i] - 1} {
+					forward, err := lm.IteratorFrom(from)
+					require.Nil(t, err)
+					for j := i; j < len(records); j++ {
+						require.True(t, forward.HasNext(), "block size %d, from %d, record %d", blockSize, from, j)
+						require.Equal(t, records[j], forward.Next())
+						require.Equal(t, lsns[j], forward.LSN())
+					}
+					require.False(t, forward.HasNext())
+				}
+			}
+		}
+		checkRecords(logManager)
+		require.Nil(t, logManager.FlushByLSN(lsns[len(lsns)-1]))
+
+		logManager, err = NewLogManagerWithSegmentSize(fileManager, "logfile", 3)
+		require.Nil(t, err)
+		require.Equal(t, lsns[len(lsns)-1], logManager.LatestLSN())
+		checkRecords(logManager)
+	}
+}
+
+func TestTruncateKeepsLargeRecord(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 64, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := NewLogManagerWithSegmentSize(fileManager, "logfile", 2)
+	require.Nil(t, err)
+
+	lsns := createRecord(logManager, 1, 5)
+	// 3 blocks at least, the fragments cross the segments
+	large, err := logManager.AppendLogRecordIntoPage(makeLargeRecord(6, 100))
+	require.Nil(t, err)
+	last, err := logManager.AppendLogRecordIntoPage(makeLargeRecord(7, 2))
+	require.Nil(t, err)
+	require.Nil(t, logManager.FlushByLSN(last))
+
+	// the segments before the one of the FIRST fragment are removed
+	segments := logManager.Segments()
+	require.Nil(t, logManager.TruncateBefore(large))
+	require.Less(t, len(logManager.Segments()), len(segments))
+	_, err = logManager.ReadAt(lsns[0])
+	require.NotNil(t, err)
+
+	checkRecords := func(lm *LogFileManager) {
+		record, err := lm.ReadAt(large)
+		require.Nil(t, err)
+		require.Equal(t, makeLargeRecord(6, 100), record)
+
+		forward, err := lm.IteratorFrom(large)
+
+		require.Nil(t, err)
+		require.Equal(t, makeLargeRecord(6, 100), forward.Next())
+		require.Equal(t, large, forward.LSN())
+		require.Equal(t, makeLargeRecord(7, 2), forward.Next())
+		require.False(t, forward.HasNext())
+	}
+	checkRecords(logManager)
+
+	logManager, err = NewLogManagerWithSegmentSize(fileManager, "logfile", 2)
+	require.Nil(t, err)
+	require.Equal(t, last, logManager.LatestLSN())
+	checkRecords(logManager)
+}
+
+func TestLargeRecordCutByCrash(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 20, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+
+	small, err := logManager.AppendLogRecordIntoPage(makeLargeRecord(1, 3))
+	require.Nil(t, err)
+	large, err := logManager.AppendLogRecordIntoPage(makeLargeRecord(2, 100))
+	require.Nil(t, err)
+	require.Nil(t, logManager.FlushByLSN(large))
+
+	// the block of the LAST fragment is lost, the FIRST and MIDDLE ones are left behind
+	segment := logManager.Segments()[0]
+	blockNum, err := fileManager.BlockNum(segment)
+	require.Nil(t, err)
+	require.Nil(t, fileManager.Truncate(segment, blockNum-1))
+
+	logManager, err = NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	require.Equal(t, small, logManager.LatestLSN())
+	_, err = logManager.ReadAt(large)
+	require.NotNil(t, err)
+
+	// the new records follow, the fragments left behind are never returned
+	next, err := logManager.AppendLogRecordIntoPage(makeLargeRecord(3, 30))
+	require.Nil(t, err)
+	require.Greater(t, next, small)
+	last, err := logManager.AppendLogRecordIntoPage(makeLargeRecord(4, 2))
+	require.Nil(t, err)
+
+	it, err := logManager.Iterator()
+
+	require.Nil(t, err)
+	require.Equal(t, makeLargeRecord(4, 2), it.Next())
+	require.Equal(t, makeLargeRecord(3, 30), it.Next())
+	require.Equal(t, makeLargeRecord(1, 3), it.Next())
+	require.False(t, it.HasNext())
+
+	forward, err := logManager.IteratorFrom(0)
+
+	require.Nil(t, err)
+	require.Equal(t, makeLargeRecord(1, 3), forward.Next())
+	require.Equal(t, makeLargeRecord(3, 30), forward.Next())
+	require.Equal(t, makeLargeRecord(4, 2), forward.Next())
+	require.Equal(t, last, forward.LSN())
+	require.False(t, forward.HasNext())
+
+	// a block too small for a fragment
+	fileManager, err = fm.NewFileManagerWithStorage(fm.NewMemStorage(), MIN_LOG_BLOCK_SIZE-1, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	_, err = NewLogManager(fileManager, "logfile")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,373 @@
+package log_manager
+
+import (
+	"fmt"
+	fm "oh_my_godb/file_manager"
+	"slices"
+	"sync"
+)
+
+const DEFAULT_LOG_BUFFERS = 8 // the buffers of the ring, see StartConcurrentAppend()
+
+/*
+logBuffer a block of the log held by the ring, the frames are reserved from the end of the block like the logPage.
+*/
+type logBuffer struct {
+	page         *fm.Page
+	blk          *fm.BlockId
+	segmentStart uint64
+	whereToWrite uint64   // the reserved frames start here, it's stored into the page once written
+	copying      []uint64 // the ends of the frames reserved but not copied yet, from the oldest to the newest
+	sealed       bool     // no more frame, the next ones go to the next buffer
+}
+
+/*
+logRing the buffers of the concurrent appends, the appenders only meet for the reservation of their frames.
+
+	appender1 --reserve--> |        |        |        |
+	appender2 --reserve--> | sealed | sealed |  tail  | --> the writer writes them in order --> |BlockN|BlockN+1|...
+	appender3 --reserve--> |        |        |        |
+	              ⬇ copy in parallel
+
+- the offset, hence the LSN, of a record is reserved in the tail under the mutex, the frame is copied without it
+- the tail is sealed once a record doesn't fit in it, the next buffer is the new tail, the appenders wait if the ring is full
+- the writer writes the sealed buffers whose copies are done from the oldest, and frees them
+- the tail is written only if a flush needs it, up to its oldest copy not done yet, it's written again later
+- the fragments of a large record are reserved and copied one by one, the other appenders wait for them
+*/
+type logRing struct {
+	logMgr      *LogFileManager
+	slots       []logBuffer
+	head        int        // the oldest buffer not written yet
+	used        int        // the buffers from the head, the last one is the tail, 1 at least
+	scratch     *fm.Page   // the copy of the tail written by the writer
+	zeros       []byte     // to clear a page
+	cond        *sync.Cond // on the logMgr.mutex, broadcast whenever the ring changes
+	writtenLSN  uint64     // the records up to it are in the files
+	flushTarget uint64     // the records up to it are to be written, even if they're in the tail
+	appenders   int        // the appenders in the ring, the ring stops only without them
+	fragmenting bool       // the fragments of a large record are being reserved
+	stopping    bool
+	err         error // the writer failed, the ring is broken
+	wg          sync.WaitGroup
+}
+
+/*
+StartConcurrentAppend the appenders reserve their records in a ring of log buffers and copy them in parallel,
+a background writer writes the buffers into the files in order, see logRing.
+
+@param buffers the blocks held by the ring, 2 at least
+*/
+func (l *LogFileManager) StartConcurrentAppend(buffers int) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.ring != nil {
+		return nil
+	}
+	// the ring starts from what's in the files
+	err := l.flush()
+	if err != nil {
+		return err
+	}
+
+	blockSize := l.fileManager.BlockSize()
+	r := &logRing{
+		logMgr:     l,
+		slots:      make([]logBuffer, max(buffers, 2)),
+		scratch:    fm.NewPageBySize(blockSize),
+		zeros:      make([]byte, blockSize),
+		cond:       sync.NewCond(l.mutex),
+		writtenLSN: l.latestLSN,
+	}
+	for i := range r.slots {
+		r.slots[i].page = fm.NewPageBySize(blockSize)
+	}
+
+	// the currentBlk is the first tail
+	tail := &r.slots[0]
+	tail.page.SetRawBytes(0, l.logPage.GetRawBytes(0, blockSize))
+	tail.blk = l.currentBlk
+	tail.segmentStart = l.currentStart
+	tail.whereToWrite = l.logPage.GetInt(0)
+	r.used = 1
+
+	r.wg.Add(1)
+	go r.run()
+
+	l.ring = r
+	return nil
+}
+
+/*
+StopConcurrentAppend the records appended are written before it returns, the appends use the logPage since then.
+The appenders arriving meanwhile wait for it.
+*/
+func (l *LogFileManager) StopConcurrentAppend() error {
+	l.mutex.Lock()
+	r := l.ring
+	if r == nil {
+		l.mutex.Unlock()
+		return nil
+	}
+	r.stopping = true
+	r.cond.Broadcast()
+	l.mutex.Unlock()
+
+	r.wg.Wait()
+	return r.err
+}
+
+func (r *logRing) tail() *logBuffer {
+	return &r.slots[(r.head+r.used-1)%len(r.slots)]
+}
+
+// pushTail the block after the tail is the new tail, in a new segment if the segment of the tail is full
+func (r *logRing) pushTail() {
+	l := r.logMgr
+	blockSize := l.fileManager.BlockSize()
+	tail := r.tail()
+	next := &r.slots[(r.head+r.used)%len(r.slots)]
+
+	if tail.blk.BlkNum()+1 < l.segmentBlocks {
+		next.blk = fm.NewBlockId(tail.blk.GetFilePath(), tail.blk.BlkNum()+1)
+		next.segmentStart = tail.segmentStart
+	} else {
+		next.segmentStart = tail.segmentStart + (tail.blk.BlkNum()+1)*blockSize
+		next.blk = fm.NewBlockId(fmt.Sprintf(SEGMENT_NAME_FORMAT, l.logFileName, next.segmentStart), 0)
+	}
+	// clear the records of the block held before, like the appendNewBlockAndMmap()
+	next.page.SetRawBytes(0, r.zeros)
+	next.whereToWrite = blockSize
+	next.copying = next.copying[:0]
+	next.sealed = false
+	r.used += 1
+}
+
+/*
+tailFor returns the tail once it has the need bytes before its whereToWrite. A tail without them is sealed and
+a new one is pushed, which waits for the writer to free a buffer if the ring is full.
+
+The fragments of a large record are consecutive, the other appenders wait till they're all reserved.
+*/
+func (r *logRing) tailFor(need uint64, fragment bool) (*logBuffer, error) {
+	for {
+		if r.err != nil {
+			return nil, r.err
+		}
+		if fragment || !r.fragmenting {
+			tail := r.tail()
+			if !tail.sealed && tail.whereToWrite >= need {
+				return tail, nil
+			}
+			if !tail.sealed {
+				tail.sealed = true
+				r.cond.Broadcast()
+			}
+			if r.used < len(r.slots) {
+				r.pushTail()
+				continue
+			}
+		}
+		r.cond.Wait()
+	}
+}
+
+// append the caller holds the mutex, which is released during the copy
+func (r *logRing) append(logRecord []byte) (uint64, error) {
+	l := r.logMgr
+	if r.err != nil {
+		return l.latestLSN, r.err
+	}
+	r.appenders += 1
+	defer func() {
+		r.appenders -= 1
+		r.cond.Broadcast()
+	}()
+
+	blockSize := l.fileManager.BlockSize()
+	recordSize := uint64(len(logRecord))
+	frameSize := recordSize + RECORD_FRAME_LEN
+	if frameSize+UINT64_LEN > blockSize || recordSize > MAX_FRAGMENT_LEN {
+		return r.appendFragments(logRecord)
+	}
+
+	tail, err := r.tailFor(frameSize+UINT64_LEN, false)
+	if err != nil {
+		return l.latestLSN, err
+	}
+	offset := tail.whereToWrite - frameSize
+	tail.whereToWrite = offset
+	tail.copying = append(tail.copying, offset+frameSize)
+	lsn := lsnOf(tail.segmentStart, tail.blk.BlkNum(), offset, blockSize)
+	l.latestLSN = lsn
+
+	// the buffer is held till the copy is done, nobody else touches the frame
+	l.mutex.Unlock()
+	writeRecord(tail.page, offset, FRAGMENT_FULL, logRecord)
+	l.mutex.Lock()
+
+	tail.copying = slices.DeleteFunc(tail.copying, func(end uint64) bool {
+		return end == offset+frameSize
+	})
+	return lsn, nil
+}
+
+// appendFragments like the LogFileManager.appendFragments(), the fragments are copied with the mutex held
+func (r *logRing) appendFragments(logRecord []byte) (uint64, error) {
+	l := r.logMgr
+	for r.fragmenting && r.err == nil {
+		r.cond.Wait()
+	}
+	r.fragmenting = true
+	defer func() {
+		r.fragmenting = false
+	}()
+
+	blockSize := l.fileManager.BlockSize()
+	kind := FRAGMENT_FIRST
+	rest := logRecord
+
+	for {
+		tail, err := r.tailFor(MIN_LOG_BLOCK_SIZE, true)
+		if err != nil {
+			return l.latestLSN, err
+		}
+
+		size := min(uint64(len(rest)), tail.whereToWrite-UINT64_LEN-RECORD_FRAME_LEN, MAX_FRAGMENT_LEN)
+		if size == uint64(len(rest)) {
+			kind = FRAGMENT_LAST
+		}
+		offset := tail.whereToWrite - RECORD_FRAME_LEN - size
+		writeRecord(tail.page, offset, kind, rest[:size])
+		tail.whereToWrite = offset
+		rest = rest[size:]
+
+		if kind == FRAGMENT_LAST {
+			l.latestLSN = lsnOf(tail.segmentStart, tail.blk.BlkNum(), offset, blockSize)
+			return l.latestLSN, nil
+		}
+
+		kind = FRAGMENT_MIDDLE
+		tail.sealed = true
+		r.cond.Broadcast()
+	}
+}
+
+// writeThrough waits till the records up to the lsn are in the files, the caller holds the mutex
+func (r *logRing) writeThrough(lsn uint64) error {
+	if lsn > r.flushTarget {
+		r.flushTarget = lsn
+		r.cond.Broadcast()
+	}
+	for r.writtenLSN < lsn && r.err == nil {
+		r.cond.Wait()
+	}
+	return r.err
+}
+
+// run the writer, the mutex is held except for the IO
+func (r *logRing) run() {
+	defer r.wg.Done()
+	l := r.logMgr
+	blockSize := l.fileManager.BlockSize()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for r.err == nil {
+		head := &r.slots[r.head]
+		// the newest frame copied, the older ones are all copied
+		copied := head.whereToWrite
+		if len(head.copying) > 0 {
+			copied = head.copying[0]
+		}
+		copiedLSN := lsnOf(head.segmentStart, head.blk.BlkNum(), copied, blockSize)
+
+		switch {
+		case head.sealed && len(head.copying) == 0:
+			// the head is never the last buffer, there's always a tail
+			if r.used == 1 {
+				r.pushTail()
+			}
+			head.page.SetInt(0, head.whereToWrite)
+			r.err = r.write(head, head.page)
+			if r.err != nil {
+				break
+			}
+			r.writtenLSN = max(r.writtenLSN, copiedLSN)
+			r.head = (r.head + 1) % len(r.slots)
+			r.used -= 1
+			r.cond.Broadcast()
+
+		case r.stopping && r.appenders == 0 && len(head.copying) == 0:
+			// the head is the tail, it's the currentBlk mapped into the logPage again
+			head.page.SetInt(0, head.whereToWrite)
+			r.err = r.write(head, head.page)
+			if r.err != nil {
+				break
+			}
+			l.logPage.SetRawBytes(0, head.page.GetRawBytes(0, blockSize))
+			r.writtenLSN = max(r.writtenLSN, l.latestLSN)
+			l.ring = nil
+			r.cond.Broadcast()
+			return
+
+		case !head.sealed && r.flushTarget > r.writtenLSN && copiedLSN >= r.flushTarget:
+			// the frames copied are written as they are, the ones being copied are not touched
+			r.scratch.SetRawBytes(0, r.zeros[:copied])
+			r.scratch.SetRawBytes(copied, head.page.GetRawBytes(copied, blockSize-copied))
+			r.scratch.SetInt(0, copied)
+			r.err = r.write(head, r.scratch)
+			if r.err != nil {
+				break
+			}
+			r.writtenLSN = max(r.writtenLSN, copiedLSN)
+			r.cond.Broadcast()
+
+		default:
+			r.cond.Wait()
+		}
+	}
+
+	r.cond.Broadcast()
+}
+
+/*
+write the page into the block of the buffer, the mutex is released meanwhile.
+
+Like the appendNewSegmentAndMmap(), the full segment is synced before the next segment is created by the Append(),
+which syncs the dir, or the new segment may be lost in a crash even after it's synced.
+*/
+func (r *logRing) write(buf *logBuffer, page *fm.Page) error {
+	l := r.logMgr
+	blk, segmentStart := buf.blk, buf.segmentStart
+	segment := blk.GetFilePath()
+	fullSegment := l.segments[len(l.segments)-1]
+	newSegment := segment != fullSegment
+
+	l.mutex.Unlock()
+	var err error
+	if newSegment {
+		err = l.fileManager.Sync(fullSegment)
+		if err == nil {
+			_, err = l.fileManager.Append(segment)
+		}
+	}
+	if err == nil {
+		_, err = l.fileManager.Write(blk, page)
+	}
+	l.mutex.Lock()
+
+	if err != nil {
+		return err
+	}
+	if newSegment {
+		delete(l.unsynced, fullSegment)
+		l.segments = append(l.segments, segment)
+		l.currentStart = segmentStart
+	}
+	l.unsynced[segment] = true
+	l.currentBlk = blk
+	return nil
+}
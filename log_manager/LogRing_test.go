@@ -0,0 +1,190 @@
+package log_manager
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	fm "oh_my_godb/file_manager"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentAppend(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 200, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := NewLogManagerWithSegmentSize(fileManager, "logfile", 3)
+	require.Nil(t, err)
+	_, err = logManager.AppendLogRecordIntoPage(makeLargeRecord(0, 10))
+	require.Nil(t, err)
+	require.Nil(t, logManager.StartConcurrentAppend(4))
+
+	// the appenders race for the buffers, a few records are split into fragments
+	var mu sync.Mutex
+	records := map[uint64][]byte{}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				size := 5 + (g*7+i)%40
+				if i%17 == 0 {
+					size = 500
+				}
+				record := makeLargeRecord(g*100+i, size)
+				lsn, err := logManager.AppendLogRecordIntoPage(record)
+				require.Nil(t, err)
+				if i%10 == 0 {
+					require.Nil(t, logManager.FlushByLSN(lsn))
+				}
+				mu.Lock()
+				records[lsn] = record
+				mu.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.Equal(t, 800, len(records))
+
+	lsns := make([]uint64, 0, len(records))
+	for lsn := range records {
+		lsns = append(lsns, lsn)
+	}
+	slices.Sort(lsns)
+	require.Equal(t, lsns[len(lsns)-1], logManager.LatestLSN())
+
+	// the records are in the order of the LSNs, with nothing else between them
+	checkRecords := func(lm *LogFileManager, newer ...[]byte) {
+		it, err := lm.Iterator()
+		require.Nil(t, err)
+		for _, record := range newer {
+			require.Equal(t, record, it.Next())
+		}
+		for i := len(lsns) - 1; i >= 0; i-- {
+			require.True(t, it.HasNext())
+			require.Equal(t, records[lsns[i]], it.Next())
+			require.Equal(t, lsns[i], it.LSN())
+		}
+		require.Equal(t, makeLargeRecord(0, 10), it.Next())
+
+		forward, err := lm.IteratorFrom(lsns[0])
+
+		require.Nil(t, err)
+		for _, lsn := range lsns {
+			require.Equal(t, records[lsn], forward.Next())
+			require.Equal(t, lsn, forward.LSN())
+		}
+		for _, lsn := range lsns[:100] {
+			record, err := lm.ReadAt(lsn)
+			require.Nil(t, err)
+			require.Equal(t, records[lsn], record)
+		}
+	}
+	checkRecords(logManager)
+
+	// back to the logPage, the LSN goes on
+	require.Nil(t, logManager.StopConcurrentAppend())
+	require.Nil(t, logManager.ring)
+	lsn, err := logManager.AppendLogRecordIntoPage(makeLargeRecord(1, 10))
+	require.Nil(t, err)
+	require.Greater(t, lsn, lsns[len(lsns)-1])
+	require.Nil(t, logManager.FlushByLSN(lsn))
+
+	logManager, err = NewLogManagerWithSegmentSize(fileManager, "logfile", 3)
+	require.Nil(t, err)
+	require.Equal(t, lsn, logManager.LatestLSN())
+	checkRecords(logManager, makeLargeRecord(1, 10))
+}
+
+func TestConcurrentAppendFlushByLSN(t *testing.T) {
+	storage := fm.NewCrashStorage(1)
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 200, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := NewLogManagerWithSegmentSize(fileManager, "logfile", 2)
+	require.Nil(t, err)
+	require.Nil(t, logManager.StartConcurrentAppend(2))
+	logManager.StartGroupCommit(0, 8)
+
+	var wg sync.WaitGroup
+	saved := make(chan uint64, 40)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				lsn, err := logManager.AppendLogRecordIntoPage(makeLogRecord(fmt.Sprintf("record%d", g*10+i), 0))
+				require.Nil(t, err)
+				require.Nil(t, logManager.FlushByLSN(lsn))
+				saved <- lsn
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(saved)
+
+	// the records not flushed yet may be lost, the saved ones survive
+	_, err = logManager.AppendLogRecordIntoPage(makeLogRecord("unsaved", 0))
+	require.Nil(t, err)
+	logManager.StopGroupCommit()
+	// the writer writes the rest without the sync
+	require.Nil(t, logManager.StopConcurrentAppend())
+	storage.Crash(fm.CRASH_DROP_UNSYNCED, "")
+
+	fileManager, err = fm.NewFileManagerWithStorage(storage, 200, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err = NewLogManagerWithSegmentSize(fileManager, "logfile", 2)
+	require.Nil(t, err)
+	for lsn := range saved {
+		_, err := logManager.ReadAt(lsn)
+		require.Nil(t, err)
+	}
+}
+
+/*
+BenchmarkConcurrentAppend the appenders append records of 100 bytes, e.g. go test -bench ConcurrentAppend -cpu 1,4
+
+	BenchmarkConcurrentAppend/single-page      2619288     410.3 ns/op    243.74 MB/s
+	BenchmarkConcurrentAppend/single-page-4    2072268     546.5 ns/op    182.98 MB/s
+	BenchmarkConcurrentAppend/ring-2-4         2936172     452.1 ns/op    221.17 MB/s
+	BenchmarkConcurrentAppend/ring-8-4         2679544     422.4 ns/op    236.73 MB/s
+
+The single-page copies the records with the mutex held, the ring copies them in parallel and writes the blocks
+in the background.
+*/
+func BenchmarkConcurrentAppend(b *testing.B) {
+	run := func(b *testing.B, logManager *LogFileManager) {
+		record := makeLargeRecord(0, 100)
+		b.SetParallelism(8)
+		b.SetBytes(int64(len(record)))
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, err := logManager.AppendLogRecordIntoPage(record)
+				if err != nil {
+					b.Error(err)
+				}
+			}
+		})
+	}
+	newManager := func(b *testing.B) *LogFileManager {
+		fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 4096, fm.SYNC_ON_LOG_FLUSH)
+		require.Nil(b, err)
+		logManager, err := NewLogManager(fileManager, "logfile")
+		require.Nil(b, err)
+		return logManager
+	}
+
+	b.Run("single-page", func(b *testing.B) {
+		run(b, newManager(b))
+	})
+
+	for _, buffers := range []int{2, DEFAULT_LOG_BUFFERS} {
+		b.Run(fmt.Sprintf("ring-%d", buffers), func(b *testing.B) {
+			logManager := newManager(b)
+			require.Nil(b, logManager.StartConcurrentAppend(buffers))
+			run(b, logManager)
+			require.Nil(b, logManager.StopConcurrentAppend())
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package metadata_manager
 
 import (
+	"fmt"
 	rm "oh_my_godb/record_manager"
 	"oh_my_godb/tx"
 )
@@ -10,12 +11,15 @@ When creating a new table, two special tables are created:
 1.tblcat(tableName string,slotSize int)
 2.fdlcat(tableName string, filedName string, type FIELD_TYPE, length, offset)
 
-
-
+tblcat has one row per table, fdlcat has one row per field of each table.
+They are stored as normal tables, tblcat.tbl and fdlcat.tbl, so the schemas survive a restart.
 */
 
 const (
 	MAX_NAME = 16
+
+	TABLE_CATALOG = "tblcat"
+	FIELD_CATALOG = "fdlcat"
 )
 
 type TableManager struct {
@@ -23,7 +27,11 @@ type TableManager struct {
 	fcatLayout *rm.Layout
 }
 
-func NewTableManager(isNew bool, txn *tx.Transaction) *TableManager {
+/*
+NewTableManager builds the layouts of the two catalog tables.
+If the database is new, the catalog tables are created and registered in themselves.
+*/
+func NewTableManager(isNew bool, txn *tx.Transaction) (*TableManager, error) {
 	tableMgr := &TableManager{}
 
 	tcatSchema := rm.NewSchema()
@@ -41,16 +49,179 @@ func NewTableManager(isNew bool, txn *tx.Transaction) *TableManager {
 	tableMgr.fcatLayout = rm.NewLayoutWithSchema(fcatSchema)
 
 	if isNew {
-		tableMgr.CreateTable("tblcat", tcatSchema, txn)
-		tableMgr.CreateTable("fdlcat", fcatSchema, txn)
+		err := tableMgr.CreateTable(TABLE_CATALOG, tcatSchema, txn)
+		if err != nil {
+			return nil, err
+		}
+		err = tableMgr.CreateTable(FIELD_CATALOG, fcatSchema, txn)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return tableMgr
+	return tableMgr, nil
 }
 
-func (t *TableManager) CreateTable(s string, schema *rm.Schema, txn *tx.Transaction) {
+/*
+CreateTable registers the table in tblcat and every field of it in fdlcat.
+
+The names are stored in fixed-length fields, names longer than MAX_NAME are rejected.
+A table already registered in tblcat is rejected too.
+*/
+func (t *TableManager) CreateTable(tblName string, schema *rm.Schema, txn *tx.Transaction) error {
+	if len(tblName) > MAX_NAME {
+		return fmt.Errorf("table name %s is longer than %d", tblName, MAX_NAME)
+	}
+	for _, fldName := range schema.Fields() {
+		if len(fldName) > MAX_NAME {
+			return fmt.Errorf("field name %s is longer than %d", fldName, MAX_NAME)
+		}
+	}
+
+	slotSize, err := t.slotSize(tblName, txn)
+	if err != nil {
+		return err
+	}
+	if slotSize >= 0 {
+		return fmt.Errorf("table %s already exists in %s", tblName, TABLE_CATALOG)
+	}
+
 	layout := rm.NewLayoutWithSchema(schema)
 
-	tcat := rm.NewTableScan(txn, "tblcat", t.tcatLayout)
+	//tblcat(tblName, slotSize)
+	tcat, err := rm.NewTableScan(txn, TABLE_CATALOG, t.tcatLayout)
+	if err != nil {
+		return err
+	}
+	defer tcat.Close()
+	err = tcat.Insert()
+	if err != nil {
+		return err
+	}
+	err = tcat.SetString("tblName", tblName)
+	if err != nil {
+		return err
+	}
+	err = tcat.SetInt("slotSize", layout.SlotSize())
+	if err != nil {
+		return err
+	}
 
+	//fdlcat(tblName, fldName, type, length, offset), one row per field
+	fcat, err := rm.NewTableScan(txn, FIELD_CATALOG, t.fcatLayout)
+	if err != nil {
+		return err
+	}
+	defer fcat.Close()
+	for _, fldName := range schema.Fields() {
+		err = fcat.Insert()
+		if err != nil {
+			return err
+		}
+		err = fcat.SetString("tblName", tblName)
+		if err != nil {
+			return err
+		}
+		err = fcat.SetString("fldName", fldName)
+		if err != nil {
+			return err
+		}
+		err = fcat.SetInt("type", int(schema.Type(fldName)))
+		if err != nil {
+			return err
+		}
+		err = fcat.SetInt("length", schema.Length(fldName))
+		if err != nil {
+			return err
+		}
+		err = fcat.SetInt("offset", layout.Offset(fldName))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+GetLayout reads the slotSize from tblcat and the fields from fdlcat, then rebuilds the Layout of the table.
+*/
+func (t *TableManager) GetLayout(tblName string, txn *tx.Transaction) (*rm.Layout, error) {
+	slotSize, err := t.slotSize(tblName, txn)
+	if err != nil {
+		return nil, err
+	}
+	if slotSize < 0 {
+		return nil, fmt.Errorf("table %s not found in %s", tblName, TABLE_CATALOG)
+	}
+
+	schema := rm.NewSchema()
+	offsets := make(map[string]int)
+	fcat, err := rm.NewTableScan(txn, FIELD_CATALOG, t.fcatLayout)
+	if err != nil {
+		return nil, err
+	}
+	defer fcat.Close()
+	for {
+		found, err := fcat.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			break
+		}
+
+		name, err := fcat.GetString("tblName")
+		if err != nil {
+			return nil, err
+		}
+		if name != tblName {
+			continue
+		}
+		fldName, err := fcat.GetString("fldName")
+		if err != nil {
+			return nil, err
+		}
+		fldType, err := fcat.GetInt("type")
+		if err != nil {
+			return nil, err
+		}
+		fldLen, err := fcat.GetInt("length")
+		if err != nil {
+			return nil, err
+		}
+		offsets[fldName], err = fcat.GetInt("offset")
+		if err != nil {
+			return nil, err
+		}
+		schema.AddField(fldName, rm.FIELD_TYPE(fldType), fldLen)
+	}
+
+	return rm.NewLayout(schema, offsets, slotSize), nil
+}
+
+// slotSize looks the table up in tblcat, -1 if it is not registered
+func (t *TableManager) slotSize(tblName string, txn *tx.Transaction) (int, error) {
+	tcat, err := rm.NewTableScan(txn, TABLE_CATALOG, t.tcatLayout)
+	if err != nil {
+		return -1, err
+	}
+	defer tcat.Close()
+	for {
+		found, err := tcat.Next()
+		if err != nil {
+			return -1, err
+		}
+		if !found {
+			return -1, nil
+		}
+
+		name, err := tcat.GetString("tblName")
+		if err != nil {
+			return -1, err
+		}
+		if name == tblName {
+			return tcat.GetInt("slotSize")
+		}
+	}
 }
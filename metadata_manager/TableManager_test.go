@@ -0,0 +1,106 @@
+package metadata_manager
+
+import (
+	"github.com/stretchr/testify/require"
+	bm "oh_my_godb/buffer_manager"
+	fm "oh_my_godb/file_manager"
+	lm "oh_my_godb/log_manager"
+	rm "oh_my_godb/record_manager"
+	"oh_my_godb/tx"
+	"testing"
+)
+
+// newTestTransaction a restart opens the same storage again
+func newTestTransaction(t *testing.T, storage fm.Storage) (*tx.Transaction, bool) {
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	bufferManager := bm.NewBufferManager(fileManager, logManager, 8)
+	versions := tx.NewVersionStore()
+
+	// the commits don't force the pages, the startup redoes them
+	if !fileManager.IsNew() {
+		txR, err := tx.NewTransaction(fileManager, logManager, bufferManager, versions)
+		require.Nil(t, err)
+		require.Nil(t, txR.Recover())
+	}
+
+	txn, err := tx.NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	return txn, fileManager.IsNew()
+}
+
+func TestTableManager(t *testing.T) {
+	storage := fm.NewMemStorage()
+	txn, isNew := newTestTransaction(t, storage)
+	require.True(t, isNew)
+	tableMgr, err := NewTableManager(isNew, txn)
+	require.Nil(t, err)
+
+	schema := rm.NewSchema()
+	schema.AddIntField("A")
+	schema.AddStringField("B", 9)
+	err = tableMgr.CreateTable("MyTable", schema, txn)
+	require.Nil(t, err)
+
+	err = tableMgr.CreateTable("aVeryVeryLongTableName", schema, txn)
+	require.NotNil(t, err)
+	txn.Commit()
+
+	// restart, the layout is rebuilt from the catalog files
+	txn, isNew = newTestTransaction(t, storage)
+	require.False(t, isNew)
+	tableMgr, err = NewTableManager(isNew, txn)
+	require.Nil(t, err)
+
+	expected := rm.NewLayoutWithSchema(schema)
+	layout, err := tableMgr.GetLayout("MyTable", txn)
+	require.Nil(t, err)
+	require.Equal(t, expected.SlotSize(), layout.SlotSize())
+	require.Equal(t, schema.Fields(), layout.Schema().Fields())
+	for _, fldName := range schema.Fields() {
+		require.Equal(t, schema.Type(fldName), layout.Schema().Type(fldName))
+		require.Equal(t, schema.Length(fldName), layout.Schema().Length(fldName))
+		require.Equal(t, expected.Offset(fldName), layout.Offset(fldName))
+	}
+
+	// the catalog tables are registered in themselves
+	tcatLayout, err := tableMgr.GetLayout(TABLE_CATALOG, txn)
+	require.Nil(t, err)
+	require.Equal(t, tableMgr.tcatLayout.SlotSize(), tcatLayout.SlotSize())
+
+	_, err = tableMgr.GetLayout("NoSuchTable", txn)
+	require.NotNil(t, err)
+	txn.Commit()
+}
+
+func TestCreateTableRejectsDuplicate(t *testing.T) {
+	storage := fm.NewMemStorage()
+	txn, isNew := newTestTransaction(t, storage)
+	tableMgr, err := NewTableManager(isNew, txn)
+	require.Nil(t, err)
+
+	schema := rm.NewSchema()
+	schema.AddIntField("A")
+	require.Nil(t, tableMgr.CreateTable("MyTable", schema, txn))
+
+	// neither tblcat nor fdlcat gets a second row for the table
+	other := rm.NewSchema()
+	other.AddStringField("B", 9)
+	require.NotNil(t, tableMgr.CreateTable("MyTable", other, txn))
+	require.NotNil(t, tableMgr.CreateTable(TABLE_CATALOG, other, txn))
+	require.Nil(t, txn.Commit())
+
+	// still rejected after a restart, the layout is the first one
+	txn, isNew = newTestTransaction(t, storage)
+	tableMgr, err = NewTableManager(isNew, txn)
+	require.Nil(t, err)
+	require.NotNil(t, tableMgr.CreateTable("MyTable", other, txn))
+
+	layout, err := tableMgr.GetLayout("MyTable", txn)
+	require.Nil(t, err)
+	require.Equal(t, schema.Fields(), layout.Schema().Fields())
+	require.Equal(t, rm.NewLayoutWithSchema(schema).SlotSize(), layout.SlotSize())
+	require.Nil(t, txn.Commit())
+}
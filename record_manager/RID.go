@@ -0,0 +1,34 @@
+package record_manager
+
+import "fmt"
+
+/*
+RID the record identifier, locates a record in the table file by (blkNum, slot)
+*/
+type RID struct {
+	blkNum int
+	slot   int
+}
+
+func NewRID(blkNum int, slot int) *RID {
+	return &RID{
+		blkNum: blkNum,
+		slot:   slot,
+	}
+}
+
+func (r *RID) BlockNumber() int {
+	return r.blkNum
+}
+
+func (r *RID) Slot() int {
+	return r.slot
+}
+
+func (r *RID) Equals(other *RID) bool {
+	return r.blkNum == other.blkNum && r.slot == other.slot
+}
+
+func (r *RID) ToString() string {
+	return fmt.Sprintf("[%d, %d]", r.blkNum, r.slot)
+}
@@ -0,0 +1,167 @@
+package record_manager
+
+import (
+	fm "oh_my_godb/file_manager"
+	"oh_my_godb/tx"
+)
+
+type SLOT_FLAG uint64
+
+const (
+	EMPTY SLOT_FLAG = iota
+	USED
+)
+
+/*
+RecordPage stores the records of one table in one block, all slots have the same size given by the Layout.
+
+|flag|field0|field1|...|flag|field0|field1|...|...|
+|    slot0            |    slot1            |...|
+
+- the flag is 8B, EMPTY(0) indicates the slot is free, USED(1) indicates the slot holds a record
+- the block is pinned while the RecordPage is alive, call Close() to unpin it
+*/
+type RecordPage struct {
+	tx     *tx.Transaction
+	blk    *fm.BlockId
+	layout LayoutInterface
+}
+
+func NewRecordPage(tx *tx.Transaction, blk *fm.BlockId, layout LayoutInterface) (*RecordPage, error) {
+	err := tx.Pin(blk)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RecordPage{
+		tx:     tx,
+		blk:    blk,
+		layout: layout,
+	}, nil
+}
+
+func (r *RecordPage) Block() *fm.BlockId {
+	return r.blk
+}
+
+func (r *RecordPage) GetInt(slot int, fieldName string) (int, error) {
+	fieldPos := r.fieldPos(slot, fieldName)
+	val, err := r.tx.GetInt(r.blk, fieldPos)
+	if err != nil {
+		return 0, err
+	}
+	return int(val), nil
+}
+
+func (r *RecordPage) SetInt(slot int, fieldName string, value int) error {
+	fieldPos := r.fieldPos(slot, fieldName)
+	return r.tx.SetInt(r.blk, fieldPos, uint64(value), true)
+}
+
+func (r *RecordPage) GetString(slot int, fieldName string) (string, error) {
+	fieldPos := r.fieldPos(slot, fieldName)
+	return r.tx.GetString(r.blk, fieldPos)
+}
+
+func (r *RecordPage) SetString(slot int, fieldName string, value string) error {
+	fieldPos := r.fieldPos(slot, fieldName)
+	return r.tx.SetString(r.blk, fieldPos, value, true)
+}
+
+/*
+Format marks every slot in the block as EMPTY and clears the fields.
+
+The changes are not logged, a freshly appended block has nothing to undo.
+*/
+func (r *RecordPage) Format() error {
+	slot := 0
+	for r.isValidSlot(slot) {
+		err := r.tx.SetInt(r.blk, r.offset(slot), uint64(EMPTY), false)
+		if err != nil {
+			return err
+		}
+
+		schema := r.layout.Schema()
+		for _, fieldName := range schema.Fields() {
+			fieldPos := r.fieldPos(slot, fieldName)
+			if schema.Type(fieldName) == INTEGER {
+				err = r.tx.SetInt(r.blk, fieldPos, 0, false)
+			} else {
+				err = r.tx.SetString(r.blk, fieldPos, "", false)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		slot += 1
+	}
+	return nil
+}
+
+func (r *RecordPage) Delete(slot int) error {
+	return r.setFlag(slot, EMPTY)
+}
+
+/*
+NextAfter returns the first USED slot after the given slot, -1 if there is none.
+
+Use -1 as the slot to search from the beginning of the block.
+*/
+func (r *RecordPage) NextAfter(slot int) (int, error) {
+	return r.searchAfter(slot, USED)
+}
+
+/*
+InsertAfter finds the first EMPTY slot after the given slot and marks it as USED, -1 if the block is full.
+*/
+func (r *RecordPage) InsertAfter(slot int) (int, error) {
+	newSlot, err := r.searchAfter(slot, EMPTY)
+	if err != nil {
+		return -1, err
+	}
+	if newSlot >= 0 {
+		err = r.setFlag(newSlot, USED)
+		if err != nil {
+			return -1, err
+		}
+	}
+	return newSlot, nil
+}
+
+func (r *RecordPage) Close() {
+	if r.blk != nil {
+		r.tx.Unpin(r.blk)
+	}
+}
+
+func (r *RecordPage) setFlag(slot int, flag SLOT_FLAG) error {
+	return r.tx.SetInt(r.blk, r.offset(slot), uint64(flag), true)
+}
+
+func (r *RecordPage) searchAfter(slot int, flag SLOT_FLAG) (int, error) {
+	slot += 1
+	for r.isValidSlot(slot) {
+		val, err := r.tx.GetInt(r.blk, r.offset(slot))
+		if err != nil {
+			return -1, err
+		}
+		if SLOT_FLAG(val) == flag {
+			return slot, nil
+		}
+		slot += 1
+	}
+	return -1, nil
+}
+
+// isValidSlot the whole slot must fit in the block
+func (r *RecordPage) isValidSlot(slot int) bool {
+	return r.offset(slot+1) <= r.tx.BlockSize()
+}
+
+func (r *RecordPage) offset(slot int) uint64 {
+	return uint64(slot * r.layout.SlotSize())
+}
+
+func (r *RecordPage) fieldPos(slot int, fieldName string) uint64 {
+	return r.offset(slot) + uint64(r.layout.Offset(fieldName))
+}
@@ -0,0 +1,203 @@
+package record_manager
+
+import (
+	fm "oh_my_godb/file_manager"
+	"oh_my_godb/tx"
+)
+
+/*
+TableScan walks through all records of the table file, tableName.tbl, block by block and slot by slot.
+
+|Block0              |Block1              |...|BlockN              |
+|slot0|slot1|...     |slot0|slot1|...     |...|slot0|slot1|...     |
+
+- only one block is pinned at a time, the one held by rp
+- Insert() appends a new block to the file once all blocks are full
+*/
+type TableScan struct {
+	tx          *tx.Transaction
+	layout      LayoutInterface
+	rp          *RecordPage
+	fileName    string
+	currentSlot int
+}
+
+func NewTableScan(tx *tx.Transaction, tableName string, layout LayoutInterface) (*TableScan, error) {
+	tableScan := &TableScan{
+		tx:          tx,
+		layout:      layout,
+		fileName:    tableName + ".tbl",
+		currentSlot: -1,
+	}
+
+	size, err := tx.Size(tableScan.fileName)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		//empty table file, at least one block is needed for inserting
+		err = tableScan.moveToNewBlock()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = tableScan.moveToBlock(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tableScan, nil
+}
+
+// FirstRecord positions the scan before the first record, call Next() to reach it
+func (t *TableScan) FirstRecord() error {
+	return t.moveToBlock(0)
+}
+
+/*
+Next moves to the next USED slot, crossing blocks if needed. Returns false at the end of the table.
+*/
+func (t *TableScan) Next() (bool, error) {
+	slot, err := t.rp.NextAfter(t.currentSlot)
+	if err != nil {
+		return false, err
+	}
+	t.currentSlot = slot
+	for t.currentSlot < 0 {
+		last, err := t.atLastBlock()
+		if err != nil {
+			return false, err
+		}
+		if last {
+			return false, nil
+		}
+		err = t.moveToBlock(int(t.rp.Block().BlkNum()) + 1)
+		if err != nil {
+			return false, err
+		}
+		slot, err = t.rp.NextAfter(t.currentSlot)
+		if err != nil {
+			return false, err
+		}
+		t.currentSlot = slot
+	}
+
+	return true, nil
+}
+
+func (t *TableScan) GetInt(fieldName string) (int, error) {
+	return t.rp.GetInt(t.currentSlot, fieldName)
+}
+
+func (t *TableScan) GetString(fieldName string) (string, error) {
+	return t.rp.GetString(t.currentSlot, fieldName)
+}
+
+func (t *TableScan) HasField(fieldName string) bool {
+	return t.layout.Schema().HasFields(fieldName)
+}
+
+func (t *TableScan) Close() {
+	if t.rp != nil {
+		t.rp.Close()
+		t.rp = nil
+	}
+}
+
+func (t *TableScan) SetInt(fieldName string, val int) error {
+	return t.rp.SetInt(t.currentSlot, fieldName, val)
+}
+
+func (t *TableScan) SetString(fieldName string, val string) error {
+	return t.rp.SetString(t.currentSlot, fieldName, val)
+}
+
+/*
+Insert finds an EMPTY slot after the current one and moves the scan onto it.
+If the remaining blocks are full, a new block is appended to the table file.
+*/
+func (t *TableScan) Insert() error {
+	slot, err := t.rp.InsertAfter(t.currentSlot)
+	if err != nil {
+		return err
+	}
+	t.currentSlot = slot
+	for t.currentSlot < 0 {
+		last, err := t.atLastBlock()
+		if err != nil {
+			return err
+		}
+		if last {
+			err = t.moveToNewBlock()
+		} else {
+			err = t.moveToBlock(int(t.rp.Block().BlkNum()) + 1)
+		}
+		if err != nil {
+			return err
+		}
+		slot, err = t.rp.InsertAfter(t.currentSlot)
+		if err != nil {
+			return err
+		}
+		t.currentSlot = slot
+	}
+	return nil
+}
+
+func (t *TableScan) Delete() error {
+	return t.rp.Delete(t.currentSlot)
+}
+
+// MoveToRid positions the scan on the record identified by rid
+func (t *TableScan) MoveToRid(rid *RID) error {
+	t.Close()
+	blk := fm.NewBlockId(t.fileName, uint64(rid.BlockNumber()))
+	rp, err := NewRecordPage(t.tx, blk, t.layout)
+	if err != nil {
+		return err
+	}
+	t.rp = rp
+	t.currentSlot = rid.Slot()
+	return nil
+}
+
+// GetRid returns the identifier of the current record
+func (t *TableScan) GetRid() *RID {
+	return NewRID(int(t.rp.Block().BlkNum()), t.currentSlot)
+}
+
+func (t *TableScan) moveToBlock(blkNum int) error {
+	t.Close()
+	blk := fm.NewBlockId(t.fileName, uint64(blkNum))
+	rp, err := NewRecordPage(t.tx, blk, t.layout)
+	if err != nil {
+		return err
+	}
+	t.rp = rp
+	t.currentSlot = -1
+	return nil
+}
+
+func (t *TableScan) moveToNewBlock() error {
+	t.Close()
+	blk, err := t.tx.Append(t.fileName)
+	if err != nil {
+		return err
+	}
+	rp, err := NewRecordPage(t.tx, blk, t.layout)
+	if err != nil {
+		return err
+	}
+	t.rp = rp
+	t.currentSlot = -1
+	return t.rp.Format()
+}
+
+func (t *TableScan) atLastBlock() (bool, error) {
+	size, err := t.tx.Size(t.fileName)
+	if err != nil {
+		return false, err
+	}
+	return t.rp.Block().BlkNum() == size-1, nil
+}
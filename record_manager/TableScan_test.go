@@ -0,0 +1,144 @@
+package record_manager
+
+import (
+	"github.com/stretchr/testify/require"
+	bm "oh_my_godb/buffer_manager"
+	fm "oh_my_godb/file_manager"
+	lm "oh_my_godb/log_manager"
+	"oh_my_godb/tx"
+	"testing"
+)
+
+func newTestTransaction(t *testing.T) *tx.Transaction {
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	bufferManager := bm.NewBufferManager(fileManager, logManager, 8)
+
+	txn, err := tx.NewTransaction(fileManager, logManager, bufferManager, tx.NewVersionStore())
+	require.Nil(t, err)
+	return txn
+}
+
+func newTestLayout() *Layout {
+	schema := NewSchema()
+	schema.AddIntField("A")
+	schema.AddStringField("B", 9)
+	return NewLayoutWithSchema(schema)
+}
+
+func TestRecordPage(t *testing.T) {
+	txn := newTestTransaction(t)
+	layout := newTestLayout()
+
+	blk, err := txn.Append("testfile")
+	require.Nil(t, err)
+	rp, err := NewRecordPage(txn, blk, layout)
+	require.Nil(t, err)
+	require.Nil(t, rp.Format())
+
+	/*
+		|flag|A |BLen|B |flag|A |BLen|B |...
+		|8B  |8B|8B  |9B|8B  |8B|8B  |9B|...
+	*/
+	slotCount := 0
+	slot, err := rp.InsertAfter(-1)
+	require.Nil(t, err)
+	for slot >= 0 {
+		require.Nil(t, rp.SetInt(slot, "A", slot))
+		require.Nil(t, rp.SetString(slot, "B", "rec"))
+		slotCount += 1
+		slot, err = rp.InsertAfter(slot)
+		require.Nil(t, err)
+	}
+	require.Equal(t, int(txn.BlockSize())/layout.SlotSize(), slotCount)
+
+	// delete the even slots
+	slot, err = rp.NextAfter(-1)
+	require.Nil(t, err)
+	for slot >= 0 {
+		a, err := rp.GetInt(slot, "A")
+		require.Nil(t, err)
+		if a%2 == 0 {
+			require.Nil(t, rp.Delete(slot))
+		}
+		slot, err = rp.NextAfter(slot)
+		require.Nil(t, err)
+	}
+
+	slot, err = rp.NextAfter(-1)
+	require.Nil(t, err)
+	for slot >= 0 {
+		a, err := rp.GetInt(slot, "A")
+		require.Nil(t, err)
+		require.Equal(t, 1, a%2)
+		b, err := rp.GetString(slot, "B")
+		require.Nil(t, err)
+		require.Equal(t, "rec", b)
+		slot, err = rp.NextAfter(slot)
+		require.Nil(t, err)
+	}
+
+	rp.Close()
+	txn.Commit()
+}
+
+func TestTableScan(t *testing.T) {
+	txn := newTestTransaction(t)
+	layout := newTestLayout()
+
+	// 50 records need more than one block, the scan appends the blocks
+	scan, err := NewTableScan(txn, "T", layout)
+	require.Nil(t, err)
+	for i := 0; i < 50; i++ {
+		require.Nil(t, scan.Insert())
+		require.Nil(t, scan.SetInt("A", i))
+		require.Nil(t, scan.SetString("B", "rec"))
+	}
+	size, err := txn.Size("T.tbl")
+	require.Nil(t, err)
+	require.Greater(t, size, uint64(1))
+
+	next := func() bool {
+		found, err := scan.Next()
+		require.Nil(t, err)
+		return found
+	}
+	getA := func() int {
+		a, err := scan.GetInt("A")
+		require.Nil(t, err)
+		return a
+	}
+
+	require.Nil(t, scan.FirstRecord())
+	deleted := 0
+	for next() {
+		if getA() < 25 {
+			require.Nil(t, scan.Delete())
+			deleted += 1
+		}
+	}
+	require.Equal(t, 25, deleted)
+
+	var rid *RID
+	require.Nil(t, scan.FirstRecord())
+	remaining := 0
+	for next() {
+		require.GreaterOrEqual(t, getA(), 25)
+		if getA() == 42 {
+			rid = scan.GetRid()
+		}
+		remaining += 1
+	}
+	require.Equal(t, 25, remaining)
+
+	require.NotNil(t, rid)
+	require.Nil(t, scan.MoveToRid(rid))
+	require.Equal(t, 42, getA())
+	require.True(t, scan.HasField("B"))
+	require.False(t, scan.HasField("C"))
+
+	scan.Close()
+	txn.Commit()
+}
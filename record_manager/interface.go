@@ -29,12 +29,27 @@ type LayoutInterface interface {
 
 type RecordManager interface {
 	Block() *fm.BlockId
-	GetInt(slot int, fieldName string) int
-	SetInt(slot int, fieldName string, value int)
-	GetString(slot int, fieldName string) string
-	SetString(slot int, fieldName string, value string)
-	Format() // set default value for the record
-	Delete(slot int)
-	NextAfter(slot int) int //TODO: ??? next valid slot value
-	InsertAfter(slot int) int
+	GetInt(slot int, fieldName string) (int, error)
+	SetInt(slot int, fieldName string, value int) error
+	GetString(slot int, fieldName string) (string, error)
+	SetString(slot int, fieldName string, value string) error
+	Format() error // set default value for the record
+	Delete(slot int) error
+	NextAfter(slot int) (int, error) //TODO: ??? next valid slot value
+	InsertAfter(slot int) (int, error)
+}
+
+type TableScanInterface interface {
+	FirstRecord() error
+	Next() (bool, error)
+	GetInt(fieldName string) (int, error)
+	GetString(fieldName string) (string, error)
+	HasField(fieldName string) bool
+	Close()
+	SetInt(fieldName string, val int) error
+	SetString(fieldName string, val string) error
+	Insert() error
+	Delete() error
+	MoveToRid(rid *RID) error
+	GetRid() *RID
 }
@@ -1,6 +1,7 @@
 package tx
 
 import (
+	"context"
 	bm "oh_my_godb/buffer_manager"
 	fm "oh_my_godb/file_manager"
 )
@@ -29,8 +30,12 @@ func (b *BufferList) getBuffer(blk *fm.BlockId) *bm.Buffer {
 }
 
 func (b *BufferList) Pin(blk *fm.BlockId) error {
+	return b.PinWithContext(context.Background(), blk)
+}
+
+func (b *BufferList) PinWithContext(ctx context.Context, blk *fm.BlockId) error {
 	// once the buffer has been pinned, add it into the buffers to follow
-	buff, err := b.bufferMgr.Pin(blk)
+	buff, err := b.bufferMgr.PinWithContext(ctx, blk)
 	if err != nil {
 		return err
 	}
@@ -47,15 +52,21 @@ func (b *BufferList) Unpin(blk *fm.BlockId) {
 		return
 	}
 
-	delete(b.buffers, blk)
-
 	b.bufferMgr.Unpin(buff)
 	for idx, pinedBlk := range b.pins {
-		if pinedBlk.Equals(blk) {
+		if pinedBlk == blk {
 			b.pins = append(b.pins[:idx], b.pins[idx+1:]...)
 			break
 		}
 	}
+
+	// the blk might be pinned more than once, keep the mapping until the last pin is released
+	for _, pinedBlk := range b.pins {
+		if pinedBlk == blk {
+			return
+		}
+	}
+	delete(b.buffers, blk)
 }
 
 func (b *BufferList) UnpinAll() {
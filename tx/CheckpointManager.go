@@ -0,0 +1,261 @@
+package tx
+
+import (
+	"log"
+	bm "oh_my_godb/buffer_manager"
+	fm "oh_my_godb/file_manager"
+	lm "oh_my_godb/log_manager"
+	"oh_my_godb/tx/logRecord"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+activeTxTable the running transactions of each log, i.e. each database, from the START to the COMMIT or ROLLBACK.
+
+The latch makes the checkpoint see a state matching the log: a log record and the change it describes,
+i.e. the START and the registration, the update and the page LSN, are done with the read latch held.
+The checkpoint takes the write latch, so each record before the CHECKPOINT is reflected in its content.
+
+A log is forgotten once its last running transaction ends, so the LogFileManager of a closed database isn't kept alive.
+*/
+type activeTxTable struct {
+	latch  sync.RWMutex
+	mu     sync.Mutex
+	active map[*lm.LogFileManager]map[int32]uint64 // txNum -> the LSN of its START
+}
+
+var (
+	txTableInstance *activeTxTable
+	txTableOnce     sync.Once
+)
+
+func getActiveTxTable() *activeTxTable {
+	txTableOnce.Do(func() {
+		txTableInstance = &activeTxTable{
+			active: make(map[*lm.LogFileManager]map[int32]uint64),
+		}
+	})
+	return txTableInstance
+}
+
+func (a *activeTxTable) begin(logMgr *lm.LogFileManager, txNum int32, startLSN uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.active[logMgr]; !ok {
+		a.active[logMgr] = make(map[int32]uint64)
+	}
+	a.active[logMgr][txNum] = startLSN
+}
+
+func (a *activeTxTable) end(logMgr *lm.LogFileManager, txNum int32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.active[logMgr], txNum)
+	if len(a.active[logMgr]) == 0 {
+		delete(a.active, logMgr)
+	}
+}
+
+func (a *activeTxTable) txNums(logMgr *lm.LogFileManager, except int32) []uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	txNums := make([]uint64, 0, len(a.active[logMgr]))
+	for txNum := range a.active[logMgr] {
+		if txNum != except {
+			txNums = append(txNums, uint64(txNum))
+		}
+	}
+	sort.Slice(txNums, func(i, j int) bool { return txNums[i] < txNums[j] })
+
+	return txNums
+}
+
+// oldestStartLSN returns false if no transaction is running
+func (a *activeTxTable) oldestStartLSN(logMgr *lm.LogFileManager, except int32) (uint64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	oldest, found := uint64(0), false
+	for txNum, startLSN := range a.active[logMgr] {
+		if txNum != except && (!found || startLSN < oldest) {
+			oldest, found = startLSN, true
+		}
+	}
+	return oldest, found
+}
+
+/*
+writeCheckpoint the transactions keep running meanwhile, a.k.a. the fuzzy checkpoint. Only the log is forced,
+the dirty pages are recorded rather than written back.
+
+A page written back is clean, but it may be still in the OS cache, so the written files are synced first.
+The pages written back during the sync are dirty before it, so the dirty pages before and after it are both recorded:
+
+	 beginLSN, dirty pages          SyncAll()          dirty pages, CHECKPOINT
+	-----------|-------------------------------------------|------------>
+	           before                                     after
+
+A page dirtied after the first snapshot and written back during the sync is in neither of them, and its write may be
+unsynced, so the redo starts from the beginLSN at the latest, it's taken along with the first snapshot.
+
+It returns the oldest LSN the recovery needs once the checkpoint is in the disk: the smallest one among the beginLSN,
+the recLSN of the dirty pages and the START of the running transactions, see RecoveryManager.analyze().
+
+@param except the transaction not listed as active, i.e. the recovering one
+*/
+func writeCheckpoint(
+	fileMgr *fm.FileManager, logMgr *lm.LogFileManager, bufferMgr *bm.BufferManager, except int32) (uint64, error) {
+	txTable := getActiveTxTable()
+
+	// the updates before the beginLSN have marked their pages dirty, see activeTxTable
+	txTable.latch.Lock()
+	beginLSN := logMgr.LatestLSN() + 1
+	dirtyPages := bufferMgr.DirtyPages()
+	txTable.latch.Unlock()
+
+	err := fileMgr.SyncAll()
+	if err != nil {
+		return 0, err
+	}
+
+	txTable.latch.Lock()
+	for blk, recLSN := range bufferMgr.DirtyPages() {
+		if before, ok := dirtyPages[blk]; !ok || recLSN < before {
+			dirtyPages[blk] = recLSN
+		}
+	}
+	lsn, err := logRecord.WriteCheckPointToLog(logMgr, beginLSN, txTable.txNums(logMgr, except), dirtyPages)
+	oldestLSN := beginLSN
+	if startLSN, ok := txTable.oldestStartLSN(logMgr, except); ok {
+		oldestLSN = min(oldestLSN, startLSN)
+	}
+	txTable.latch.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, recLSN := range dirtyPages {
+		oldestLSN = min(oldestLSN, recLSN)
+	}
+
+	return oldestLSN, logMgr.FlushByLSN(lsn)
+}
+
+/*
+CheckpointManager writes a checkpoint periodically, so the recovery scans the log back to the latest checkpoint,
+the START of the transactions running at that time and the smallest recLSN only, rather than the whole log.
+The log segments older than that are reclaimed by TruncateLog() or ArchiveLog().
+*/
+type CheckpointManager struct {
+	fileMgr   *fm.FileManager
+	logMgr    *lm.LogFileManager
+	bufferMgr *bm.BufferManager
+	neededLSN uint64 // the oldest LSN needed by the recovery since the latest checkpoint, 0 if no checkpoint yet
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	mu        sync.Mutex // guards stop and neededLSN
+}
+
+func NewCheckpointManager(
+	fileMgr *fm.FileManager, logMgr *lm.LogFileManager, bufferMgr *bm.BufferManager) *CheckpointManager {
+	return &CheckpointManager{
+		fileMgr:   fileMgr,
+		logMgr:    logMgr,
+		bufferMgr: bufferMgr,
+	}
+}
+
+func (c *CheckpointManager) Checkpoint() error {
+	neededLSN, err := writeCheckpoint(c.fileMgr, c.logMgr, c.bufferMgr, -1)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.neededLSN = max(c.neededLSN, neededLSN)
+
+	return nil
+}
+
+/*
+TruncateLog removes the log segments older than the latest checkpoint needs.
+The pages clean at the checkpoint may be only in the OS cache, they are synced first.
+*/
+func (c *CheckpointManager) TruncateLog() error {
+	neededLSN, err := c.syncBeforeTruncation()
+	if err != nil || neededLSN == 0 {
+		return err
+	}
+	return c.logMgr.TruncateBefore(neededLSN)
+}
+
+// ArchiveLog moves the log segments TruncateLog() would remove into the archiveDir
+func (c *CheckpointManager) ArchiveLog(archiveDir string) error {
+	neededLSN, err := c.syncBeforeTruncation()
+	if err != nil || neededLSN == 0 {
+		return err
+	}
+	return c.logMgr.ArchiveBefore(neededLSN, archiveDir)
+}
+
+func (c *CheckpointManager) syncBeforeTruncation() (uint64, error) {
+	c.mu.Lock()
+	neededLSN := c.neededLSN
+	c.mu.Unlock()
+
+	if neededLSN == 0 {
+		return 0, nil
+	}
+	return neededLSN, c.fileMgr.SyncAll()
+}
+
+// Start writes a checkpoint every interval until Stop(), it does nothing if already started
+func (c *CheckpointManager) Start(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stop != nil {
+		return
+	}
+	c.stop = make(chan struct{})
+
+	c.wg.Add(1)
+	go func(stop chan struct{}) {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				err := c.Checkpoint()
+				if err != nil {
+					log.Printf("fails to write the checkpoint: %v\n", err)
+				}
+			}
+		}
+	}(c.stop)
+}
+
+// Stop waits for the checkpoint being written, if any
+func (c *CheckpointManager) Stop() {
+	c.mu.Lock()
+	if c.stop == nil {
+		c.mu.Unlock()
+		return
+	}
+	close(c.stop)
+	c.stop = nil
+	c.mu.Unlock()
+
+	c.wg.Wait()
+}
@@ -0,0 +1,302 @@
+package tx
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	bm "oh_my_godb/buffer_manager"
+	fm "oh_my_godb/file_manager"
+	lm "oh_my_godb/log_manager"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverStopsAtFuzzyCheckpoint(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, logManager, bufferManager, versions := openRecoveryTestManagers(t, storage)
+	for i := 0; i < 2; i++ {
+		_, err := fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+	blk0 := fm.NewBlockId("testfile", 0)
+	blk1 := fm.NewBlockId("testfile", 1)
+
+	// a long history in the disk, no need to scan it
+	for i := uint64(1); i <= 20; i++ {
+		txn, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+		require.Nil(t, err)
+		require.Nil(t, txn.Pin(blk0))
+		require.Nil(t, txn.SetInt(blk0, 80, i, true))
+		require.Nil(t, txn.Commit())
+		require.Nil(t, bufferManager.FlushAll(txn.txNum))
+	}
+
+	// the loser is running during the checkpoint, its page is dirty
+	txL, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txL.Pin(blk1))
+	require.Nil(t, txL.SetInt(blk1, 80, 9999, true))
+
+	checkpointMgr := NewCheckpointManager(fileManager, logManager, bufferManager)
+	require.Nil(t, checkpointMgr.Checkpoint())
+
+	txW, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txW.Pin(blk0))
+	require.Nil(t, txW.SetInt(blk0, 80, 100, true))
+	require.Nil(t, txW.Commit())
+
+	require.Nil(t, bufferManager.FlushAll(txL.txNum))
+	crash(txL)
+
+	// restart
+	fileManager, logManager, bufferManager, versions = openRecoveryTestManagers(t, storage)
+	txR, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+
+	// the scan ends at the START of the loser, rather than the beginning of the log
+	records, winners, err := txR.recoveryMgr.analyze()
+	require.Nil(t, err)
+	oldest := records[len(records)-1].rec
+	require.Equal(t, START, oldest.Op())
+	require.Equal(t, uint64(txL.txNum), oldest.TxNumber())
+	require.True(t, winners[uint64(txW.txNum)])
+	require.False(t, winners[uint64(txL.txNum)])
+
+	require.Nil(t, txR.Recover())
+	require.Equal(t, uint64(100), readFromDisk(t, fileManager, blk0).GetInt(80))
+	require.Equal(t, uint64(0), readFromDisk(t, fileManager, blk1).GetInt(80))
+}
+
+func TestCheckpointManagerWritesPeriodically(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, logManager, bufferManager, versions := openRecoveryTestManagers(t, storage)
+	_, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	blk := fm.NewBlockId("testfile", 0)
+
+	checkpointMgr := NewCheckpointManager(fileManager, logManager, bufferManager)
+	checkpointMgr.Start(5 * time.Millisecond)
+
+	// the transactions run along with the checkpoints
+	for i := uint64(1); i <= 20; i++ {
+		txn, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+		require.Nil(t, err)
+		require.Nil(t, txn.Pin(blk))
+		require.Nil(t, txn.SetInt(blk, 80, i, true))
+		require.Nil(t, txn.Commit())
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	checkpointMgr.Stop()
+	checkpointMgr.Stop()
+
+	checkpoints := 0
+	iter, err := logManager.Iterator()
+	require.Nil(t, err)
+	for iter.HasNext() {
+		op := fm.NewPageByBytes(iter.Next()).GetInt(0)
+		if RECORD_TYPE(op) == CHECKPOINT {
+			checkpoints += 1
+		}
+	}
+	require.Greater(t, checkpoints, 0)
+
+	fileManager, logManager, bufferManager, versions = openRecoveryTestManagers(t, storage)
+	txR, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txR.Recover())
+	require.Equal(t, uint64(20), readFromDisk(t, fileManager, blk).GetInt(80))
+}
+
+func TestActiveTxTableForgetsIdleLog(t *testing.T) {
+	fileManager, logManager, bufferManager, versions := openRecoveryTestManagers(t, fm.NewMemStorage())
+	txTable := getActiveTxTable()
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	txB, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Equal(t, []uint64{uint64(txA.txNum), uint64(txB.txNum)}, txTable.txNums(logManager, -1))
+
+	require.Nil(t, txA.Commit())
+	require.Nil(t, txB.Rollback())
+	txTable.mu.Lock()
+	_, ok := txTable.active[logManager]
+	txTable.mu.Unlock()
+	require.False(t, ok)
+}
+
+// syncHookStorage the afterSync runs once a file is synced, it's cleared before running
+type syncHookStorage struct {
+	*fm.CrashStorage
+	afterSync func()
+}
+
+type syncHookFile struct {
+	fm.StorageFile
+	storage *syncHookStorage
+}
+
+func (s *syncHookStorage) Open(name string) (fm.StorageFile, error) {
+	file, err := s.CrashStorage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &syncHookFile{StorageFile: file, storage: s}, nil
+}
+
+func (f *syncHookFile) Sync() error {
+	err := f.StorageFile.Sync()
+	if hook := f.storage.afterSync; hook != nil {
+		f.storage.afterSync = nil
+		hook()
+	}
+	return err
+}
+
+func TestCheckpointRedoesPageWrittenDuringSync(t *testing.T) {
+	storage := &syncHookStorage{CrashStorage: fm.NewCrashStorage(1)}
+	fileManager, logManager, bufferManager, versions := openRecoveryTestManagers(t, storage)
+	for i := 0; i < 2; i++ {
+		_, err := fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+	require.Nil(t, fileManager.SyncAll())
+	require.Nil(t, storage.SyncDir())
+	blk0 := fm.NewBlockId("testfile", 0)
+	blk1 := fm.NewBlockId("testfile", 1)
+
+	// the testfile is left unsynced for the checkpoint
+	tx0, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, tx0.Pin(blk0))
+	require.Nil(t, tx0.SetInt(blk0, 80, 1, true))
+	require.Nil(t, tx0.Commit())
+	require.Nil(t, bufferManager.FlushAll(tx0.txNum))
+
+	// the blk1 is dirtied after the first snapshot and written back during the sync, its write isn't synced
+	storage.afterSync = func() {
+		txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+		require.Nil(t, err)
+		require.Nil(t, txA.Pin(blk1))
+		require.Nil(t, txA.SetInt(blk1, 80, 42, true))
+		require.Nil(t, txA.Commit())
+		require.Nil(t, bufferManager.FlushAll(txA.txNum))
+	}
+	require.Nil(t, NewCheckpointManager(fileManager, logManager, bufferManager).Checkpoint())
+	require.Nil(t, storage.afterSync)
+
+	storage.Crash(fm.CRASH_DROP_UNSYNCED, "")
+	fileManager, logManager, bufferManager, versions = openRecoveryTestManagers(t, storage)
+	require.Equal(t, uint64(0), readFromDisk(t, fileManager, blk1).GetInt(80))
+	txR, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txR.Recover())
+	require.Equal(t, uint64(1), readFromDisk(t, fileManager, blk0).GetInt(80))
+	require.Equal(t, uint64(42), readFromDisk(t, fileManager, blk1).GetInt(80))
+}
+
+func TestTruncateLogKeepsWhatRecoveryNeeds(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManagerWithSegmentSize(fileManager, "logfile", 1)
+	require.Nil(t, err)
+	bufferManager := bm.NewBufferManager(fileManager, logManager, 8)
+	versions := NewVersionStore()
+	for i := 0; i < 2; i++ {
+		_, err = fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+	blk0 := fm.NewBlockId("testfile", 0)
+	blk1 := fm.NewBlockId("testfile", 1)
+
+	for i := uint64(1); i <= 20; i++ {
+		txn, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+		require.Nil(t, err)
+		require.Nil(t, txn.Pin(blk0))
+		require.Nil(t, txn.SetString(blk0, 40, fmt.Sprintf("value%d", i), true))
+		require.Nil(t, txn.Commit())
+		require.Nil(t, bufferManager.FlushAll(txn.txNum))
+	}
+
+	// the loser started before the checkpoint, its segment is kept
+	txL, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txL.Pin(blk1))
+	require.Nil(t, txL.SetInt(blk1, 80, 9999, true))
+
+	checkpointMgr := NewCheckpointManager(fileManager, logManager, bufferManager)
+	require.Nil(t, checkpointMgr.TruncateLog()) // no checkpoint, nothing is removed
+	segments := len(logManager.Segments())
+	require.Nil(t, checkpointMgr.Checkpoint())
+	require.Nil(t, checkpointMgr.TruncateLog())
+	require.Less(t, len(logManager.Segments()), segments)
+
+	require.Nil(t, bufferManager.FlushAll(txL.txNum))
+	crash(txL)
+
+	fileManager, err = fm.NewFileManagerWithStorage(storage, 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err = lm.NewLogManagerWithSegmentSize(fileManager, "logfile", 1)
+	require.Nil(t, err)
+	bufferManager = bm.NewBufferManager(fileManager, logManager, 8)
+	versions = NewVersionStore()
+	txR, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txR.Recover())
+
+	require.Equal(t, "value20", readFromDisk(t, fileManager, blk0).GetString(40))
+	require.Equal(t, uint64(0), readFromDisk(t, fileManager, blk1).GetInt(80))
+}
+
+func TestTruncateLogKeepsLargeRecord(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManagerWithSegmentSize(fileManager, "logfile", 1)
+	require.Nil(t, err)
+	bufferManager := bm.NewBufferManager(fileManager, logManager, 8)
+	versions := NewVersionStore()
+	_, err = fileManager.Append("testfile")
+	require.Nil(t, err)
+	blk := fm.NewBlockId("testfile", 0)
+
+	for i := uint64(1); i <= 5; i++ {
+		txn, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+		require.Nil(t, err)
+		require.Nil(t, txn.Pin(blk))
+		require.Nil(t, txn.SetString(blk, 40, strings.Repeat("o", 300), true))
+		require.Nil(t, txn.SetInt(blk, 360, i, true))
+		require.Nil(t, txn.Commit())
+		require.Nil(t, bufferManager.FlushAll(txn.txNum))
+	}
+
+	// the SETSTRING holds the old and the new value, larger than a segment, its LSN is the recLSN of the page left dirty
+	committed := strings.Repeat("c", 300)
+	txn, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txn.Pin(blk))
+	require.Nil(t, txn.SetString(blk, 40, committed, true))
+	require.Nil(t, txn.Commit())
+
+	checkpointMgr := NewCheckpointManager(fileManager, logManager, bufferManager)
+	segments := len(logManager.Segments())
+	require.Nil(t, checkpointMgr.Checkpoint())
+	require.Nil(t, checkpointMgr.TruncateLog())
+	require.Less(t, len(logManager.Segments()), segments)
+
+	// the page is lost, the redo reads the record from its FIRST fragment
+	fileManager, err = fm.NewFileManagerWithStorage(storage, 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err = lm.NewLogManagerWithSegmentSize(fileManager, "logfile", 1)
+	require.Nil(t, err)
+	bufferManager = bm.NewBufferManager(fileManager, logManager, 8)
+	txR, err := NewTransaction(fileManager, logManager, bufferManager, NewVersionStore())
+	require.Nil(t, err)
+	require.Nil(t, txR.Recover())
+
+	require.Equal(t, committed, readFromDisk(t, fileManager, blk).GetString(40))
+	require.Equal(t, uint64(5), readFromDisk(t, fileManager, blk).GetInt(360))
+}
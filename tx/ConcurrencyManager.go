@@ -0,0 +1,87 @@
+package tx
+
+import (
+	"math"
+	fm "oh_my_godb/file_manager"
+)
+
+const (
+	SHARED_LOCK    = "S"
+	EXCLUSIVE_LOCK = "X"
+
+	EOF_BLK_NUM = math.MaxUint64 // the blkNum of the dummy block standing for the end of the file
+)
+
+/*
+ConcurrencyManager each transaction has its own ConcurrencyManager, all of them share the same LockTable.
+
+- it remembers the locks held by the transaction, so the LockTable is asked only once per block
+- for a lock held already, the LockTable is only asked whether the transaction has been wounded, see WOUND_WAIT
+- strict two-phase locking: the locks are only released by Release() on Commit/Rollback
+- XLock = SLock + upgrade, the LockTable.XLock relies on that
+*/
+type ConcurrencyManager struct {
+	lockTable *LockTable
+	lockMap   map[fm.BlockId]string // blk -> SHARED_LOCK or EXCLUSIVE_LOCK
+	txNum     int32                 // identifies the transaction in the wait-for graph of the LockTable
+}
+
+func NewConcurrencyManager(txNum int32) *ConcurrencyManager {
+	return &ConcurrencyManager{
+		lockTable: GetLockTable(),
+		lockMap:   make(map[fm.BlockId]string),
+		txNum:     txNum,
+	}
+}
+
+func (c *ConcurrencyManager) SLock(blk *fm.BlockId) error {
+	_, ok := c.lockMap[*blk]
+	if ok {
+		return c.lockTable.CheckWounded(blk, c.txNum)
+	}
+
+	err := c.lockTable.SLock(blk, c.txNum)
+	if err != nil {
+		return err
+	}
+	c.lockMap[*blk] = SHARED_LOCK
+	return nil
+}
+
+func (c *ConcurrencyManager) XLock(blk *fm.BlockId) error {
+	if c.hasXLock(blk) {
+		return c.lockTable.CheckWounded(blk, c.txNum)
+	}
+
+	err := c.SLock(blk)
+	if err != nil {
+		return err
+	}
+
+	err = c.lockTable.XLock(blk, c.txNum)
+	if err != nil {
+		return err
+	}
+	c.lockMap[*blk] = EXCLUSIVE_LOCK
+
+	return nil
+}
+
+// Release releases all locks held by the transaction
+func (c *ConcurrencyManager) Release() {
+	for blk := range c.lockMap {
+		c.lockTable.UnLock(&blk, c.txNum)
+	}
+	c.lockTable.endTx(c.txNum)
+	c.lockMap = make(map[fm.BlockId]string)
+}
+
+func (c *ConcurrencyManager) hasXLock(blk *fm.BlockId) bool {
+	lockType, ok := c.lockMap[*blk]
+	return ok && lockType == EXCLUSIVE_LOCK
+}
+
+// eofBlock the dummy block locked by Size() and Append(), so a reader of the size conflicts with an appender
+func eofBlock(fileName string) *fm.BlockId {
+	return fm.NewBlockId(fileName, EOF_BLK_NUM)
+}
@@ -0,0 +1,222 @@
+package tx
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	bm "oh_my_godb/buffer_manager"
+	fm "oh_my_godb/file_manager"
+	lm "oh_my_godb/log_manager"
+	"testing"
+	"time"
+)
+
+func newConcurrencyTestManagers(t *testing.T) (*fm.FileManager, *lm.LogFileManager, *bm.BufferManager, *VersionStore) {
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	bufferManager := bm.NewBufferManager(fileManager, logManager, 8)
+
+	for i := 0; i < 2; i++ {
+		_, err = fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+
+	return fileManager, logManager, bufferManager, NewVersionStore()
+}
+
+func TestSharedLocksDoNotBlock(t *testing.T) {
+	fileManager, logManager, bufferManager, versions := newConcurrencyTestManagers(t)
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	txB, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	blk := fm.NewBlockId("testfile", 1)
+
+	require.Nil(t, txA.Pin(blk))
+	_, err = txA.GetInt(blk, 0)
+	require.Nil(t, err)
+
+	done := make(chan error)
+	go func() {
+		err := txB.Pin(blk)
+		if err == nil {
+			_, err = txB.GetInt(blk, 0)
+		}
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		require.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the SLock of txB is blocked by the SLock of txA")
+	}
+
+	txA.Commit()
+	txB.Commit()
+}
+
+func TestXLockWaitsForCommit(t *testing.T) {
+	fileManager, logManager, bufferManager, versions := newConcurrencyTestManagers(t)
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	txB, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	blkA := fm.NewBlockId("testfile", 1)
+	blkB := fm.NewBlockId("testfile", 1) // another pointer to the same block
+
+	require.Nil(t, txA.Pin(blkA))
+	_, err = txA.GetInt(blkA, 0)
+	require.Nil(t, err)
+
+	done := make(chan error)
+	go func() {
+		err := txB.Pin(blkB)
+		if err == nil {
+			err = txB.SetInt(blkB, 0, 99, true)
+		}
+		done <- err
+	}()
+
+	// txB can't get the XLock while txA holds the SLock
+	select {
+	case <-done:
+		t.Fatal("the XLock of txB is granted while txA holds the SLock")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	txA.Commit()
+
+	select {
+	case err = <-done:
+		require.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the XLock of txB is not granted after txA committed")
+	}
+
+	// txC reads the value once txB releases its XLock
+	txC, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	txB.Commit()
+	require.Nil(t, txC.Pin(blkA))
+	val, err := txC.GetInt(blkA, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(99), val)
+	txC.Commit()
+}
+
+func TestAppendLocksEndOfFile(t *testing.T) {
+	fileManager, logManager, bufferManager, versions := newConcurrencyTestManagers(t)
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	txB, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+
+	size, err := txA.Size("testfile")
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), size)
+
+	var blk *fm.BlockId
+	done := make(chan error)
+	go func() {
+		var err error
+		blk, err = txB.Append("testfile")
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("txB appends to the file while txA holds the SLock of its end")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	txA.Commit()
+	require.Nil(t, <-done)
+	require.NotNil(t, blk)
+	require.Equal(t, uint64(2), blk.BlkNum())
+	txB.Commit()
+}
+
+func TestPinAbortRollsBack(t *testing.T) {
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	bufferManager := bm.NewBufferManager(fileManager, logManager, 2)
+	versions := NewVersionStore()
+	for i := 0; i < 3; i++ {
+		_, err = fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	txB, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	blk0, blk1, blk2 := fm.NewBlockId("testfile", 0), fm.NewBlockId("testfile", 1), fm.NewBlockId("testfile", 2)
+
+	require.Nil(t, txA.Pin(blk0))
+	require.Nil(t, txB.Pin(blk1))
+	require.Nil(t, txB.SetInt(blk1, 0, 7, true))
+
+	// both buffers are pinned, txB gives up and releases its buffer and its XLock
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = txB.PinWithContext(ctx, blk2)
+	var abortErr *bm.ErrBufferAbort
+	require.True(t, errors.As(err, &abortErr))
+	require.Equal(t, uint32(1), bufferManager.Available())
+
+	// the change of txB is undone
+	require.Nil(t, txA.Pin(blk1))
+	require.Nil(t, txA.SetInt(blk1, 8, 8, true))
+	val, err := txA.GetInt(blk1, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), val)
+	require.Nil(t, txA.Commit())
+}
+
+func TestRollbackStopsWhenPinFails(t *testing.T) {
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	bufferManager := bm.NewBufferManager(fileManager, logManager, 1)
+	versions := NewVersionStore()
+	for i := 0; i < 2; i++ {
+		_, err = fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	txB, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	blk0, blk1 := fm.NewBlockId("testfile", 0), fm.NewBlockId("testfile", 1)
+
+	require.Nil(t, txA.Pin(blk0))
+	require.Nil(t, txA.SetInt(blk0, 0, 7, true))
+	txA.Unpin(blk0)
+	require.Nil(t, txB.Pin(blk1))
+
+	// the undo of txA can't pin blk0, the rollback stops with the error rather than the process
+	err = txA.Rollback()
+	var abortErr *bm.ErrBufferAbort
+	require.True(t, errors.As(err, &abortErr))
+
+	// once a buffer is free, the rollback is done again
+	require.Nil(t, txB.Commit())
+	require.Nil(t, txA.Rollback())
+	txC, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txC.Pin(blk0))
+	val, err := txC.GetInt(blk0, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), val)
+	require.Nil(t, txC.Commit())
+}
@@ -0,0 +1,235 @@
+package tx
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	bm "oh_my_godb/buffer_manager"
+	fm "oh_my_godb/file_manager"
+	lm "oh_my_godb/log_manager"
+	"testing"
+)
+
+const (
+	CRASH_TEST_FILE   = "crashfile"
+	CRASH_TEST_BLOCKS = 6
+	CRASH_TEST_SLOTS  = 8  // the ints at the offsets 0, 48, .. of each block
+	CRASH_TEST_STRIDE = 48 // spread over the page, so a torn write tears them
+)
+
+type crashSlot struct {
+	blk    int
+	offset uint64
+}
+
+type crashTestTx struct {
+	txn    *Transaction
+	blocks []int
+	writes map[crashSlot]uint64 // the latest value written into each slot
+}
+
+/*
+crashHarness runs a random workload on a CrashStorage, crashes it and checks the recovered state:
+
+- the values committed before the crash point are there, unless overwritten by a later commit
+- the values of the transactions rolled back or running at the crash are not
+
+A commit returning after the crash point may or may not survive, so each slot has a set of the allowed values.
+*/
+type crashHarness struct {
+	t             *testing.T
+	rnd           *rand.Rand
+	storage       *fm.CrashStorage
+	blocks        []*fm.BlockId // the Transaction finds the pinned buffers by the pointer
+	slots         []crashSlot
+	fileMgr       *fm.FileManager
+	logMgr        *lm.LogFileManager
+	bufferMgr     *bm.BufferManager
+	versions      *VersionStore
+	checkpointMgr *CheckpointManager
+	running       []*crashTestTx
+	owned         map[int]bool // the blocks used by the running transactions, so they never wait for the locks
+	allowed       map[crashSlot][]uint64
+	nextValue     uint64
+}
+
+func newCrashHarness(t *testing.T, seed int64) *crashHarness {
+	h := &crashHarness{
+		t:       t,
+		rnd:     rand.New(rand.NewSource(seed)),
+		storage: fm.NewCrashStorage(seed),
+		owned:   make(map[int]bool),
+		allowed: make(map[crashSlot][]uint64),
+	}
+	for blk := 0; blk < CRASH_TEST_BLOCKS; blk++ {
+		h.blocks = append(h.blocks, fm.NewBlockId(CRASH_TEST_FILE, uint64(blk)))
+	}
+	h.open()
+	// a failed check leaves the transactions running, their locks would block the next test
+	t.Cleanup(func() {
+		for _, tt := range h.running {
+			crash(tt.txn)
+		}
+	})
+
+	for i := 0; i < CRASH_TEST_BLOCKS; i++ {
+		_, err := h.fileMgr.Append(CRASH_TEST_FILE)
+		require.Nil(t, err)
+	}
+	require.Nil(t, h.fileMgr.SyncAll())
+	for blk := 0; blk < CRASH_TEST_BLOCKS; blk++ {
+		for i := uint64(0); i < CRASH_TEST_SLOTS; i++ {
+			slot := crashSlot{blk, i * CRASH_TEST_STRIDE}
+			h.slots = append(h.slots, slot)
+			h.allowed[slot] = []uint64{0}
+		}
+	}
+
+	return h
+}
+
+// open the managers on the storage, i.e. a restart, with few buffers so the uncommitted pages are stolen
+func (h *crashHarness) open() {
+	var err error
+	h.fileMgr, err = fm.NewFileManagerWithStorage(h.storage, 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(h.t, err)
+	h.logMgr, err = lm.NewLogManagerWithSegmentSize(h.fileMgr, "logfile", 4)
+	require.Nil(h.t, err)
+	h.bufferMgr = bm.NewBufferManager(h.fileMgr, h.logMgr, 5)
+	h.versions = NewVersionStore()
+	h.checkpointMgr = NewCheckpointManager(h.fileMgr, h.logMgr, h.bufferMgr)
+}
+
+func (h *crashHarness) begin() {
+	free := make([]int, 0)
+	for blk := 0; blk < CRASH_TEST_BLOCKS; blk++ {
+		if !h.owned[blk] {
+			free = append(free, blk)
+		}
+	}
+	if len(free) == 0 {
+		return
+	}
+	h.rnd.Shuffle(len(free), func(i, j int) { free[i], free[j] = free[j], free[i] })
+
+	txn, err := NewTransaction(h.fileMgr, h.logMgr, h.bufferMgr, h.versions)
+	require.Nil(h.t, err)
+	tt := &crashTestTx{
+		txn:    txn,
+		blocks: free[:min(len(free), 1+h.rnd.Intn(2))],
+		writes: make(map[crashSlot]uint64),
+	}
+	for _, blk := range tt.blocks {
+		h.owned[blk] = true
+		require.Nil(h.t, tt.txn.Pin(h.blocks[blk]))
+	}
+	h.running = append(h.running, tt)
+}
+
+func (h *crashHarness) write(tt *crashTestTx) {
+	slot := crashSlot{tt.blocks[h.rnd.Intn(len(tt.blocks))], uint64(h.rnd.Intn(CRASH_TEST_SLOTS)) * CRASH_TEST_STRIDE}
+	h.nextValue += 1
+
+	err := tt.txn.SetInt(h.blocks[slot.blk], slot.offset, h.nextValue, true)
+	require.Nil(h.t, err)
+	tt.writes[slot] = h.nextValue
+}
+
+func (h *crashHarness) end(i int, commit bool) {
+	tt := h.running[i]
+	h.running = append(h.running[:i], h.running[i+1:]...)
+	for _, blk := range tt.blocks {
+		delete(h.owned, blk)
+	}
+
+	if !commit {
+		require.Nil(h.t, tt.txn.Rollback())
+		return
+	}
+
+	require.Nil(h.t, tt.txn.Commit())
+	durable := !h.storage.Crashed()
+	for slot, value := range tt.writes {
+		if durable {
+			h.allowed[slot] = []uint64{value}
+		} else {
+			h.allowed[slot] = append(h.allowed[slot], value)
+		}
+	}
+}
+
+func (h *crashHarness) run(steps int) {
+	for step := 0; step < steps; step++ {
+		switch n := h.rnd.Intn(100); {
+		case n < 15 && len(h.running) < 2:
+			h.begin()
+		case n < 70 && len(h.running) > 0:
+			h.write(h.running[h.rnd.Intn(len(h.running))])
+		case n < 82 && len(h.running) > 0:
+			h.end(h.rnd.Intn(len(h.running)), true)
+		case n < 88 && len(h.running) > 0:
+			h.end(h.rnd.Intn(len(h.running)), false)
+		case n < 94:
+			require.Nil(h.t, h.checkpointMgr.Checkpoint())
+		case n < 97:
+			require.Nil(h.t, h.checkpointMgr.TruncateLog())
+		default:
+			// steal the pages of a running transaction
+			if len(h.running) > 0 {
+				require.Nil(h.t, h.bufferMgr.FlushAll(h.running[h.rnd.Intn(len(h.running))].txn.txNum))
+			}
+		}
+	}
+}
+
+// crashAndRecover the running transactions are lost along with what isn't durable at the crash point
+func (h *crashHarness) crashAndRecover(mode fm.CRASH_MODE) {
+	for _, tt := range h.running {
+		crash(tt.txn)
+	}
+	h.running = nil
+	h.owned = make(map[int]bool)
+
+	// any file may be torn, the log ends at its first invalid record
+	h.storage.Crash(mode, "")
+	h.open()
+	txR, err := NewTransaction(h.fileMgr, h.logMgr, h.bufferMgr, h.versions)
+	require.Nil(h.t, err)
+	require.Nil(h.t, txR.Recover())
+
+	txn, err := NewTransaction(h.fileMgr, h.logMgr, h.bufferMgr, h.versions)
+	require.Nil(h.t, err)
+	values := make(map[crashSlot]uint64)
+	for _, slot := range h.slots {
+		require.Nil(h.t, txn.Pin(h.blocks[slot.blk]))
+		value, err := txn.GetInt(h.blocks[slot.blk], slot.offset)
+		require.Nil(h.t, err)
+		txn.Unpin(h.blocks[slot.blk])
+		values[slot] = value
+	}
+	require.Nil(h.t, txn.Commit())
+
+	for slot, value := range values {
+		require.Contains(h.t, h.allowed[slot], value, "block %d offset %d", slot.blk, slot.offset)
+		// the recovered value is committed since then
+		h.allowed[slot] = []uint64{value}
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	modes := []fm.CRASH_MODE{fm.CRASH_DROP_UNSYNCED, fm.CRASH_KEEP_SOME, fm.CRASH_TORN_WRITE}
+
+	for seed := int64(1); seed <= 50; seed++ {
+		for _, mode := range modes {
+			t.Run(fmt.Sprintf("seed%d_mode%d", seed, mode), func(t *testing.T) {
+				h := newCrashHarness(t, seed)
+				// the recovered database crashes again
+				for round := 0; round < 3; round++ {
+					h.storage.CrashAfter(h.rnd.Intn(300))
+					h.run(200)
+					h.crashAndRecover(mode)
+				}
+			})
+		}
+	}
+}
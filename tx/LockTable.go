@@ -9,18 +9,43 @@ import (
 )
 
 const (
-	MAX_WAITING_TIME = 3 //TODO: replace me with 10sec in prod
+	MAX_WAITING_TIME = 3 // seconds
+)
+
+// ErrDeadlock is returned to the transaction chosen as the victim of a deadlock, it must roll back
+var ErrDeadlock = errors.New("deadlock detected")
+
+// ErrLockTimeout is returned once a lock request waits longer than MAX_WAITING_TIME, it's taken as a deadlock
+var ErrLockTimeout = fmt.Errorf("lock wait timeout, %w", ErrDeadlock)
+
+/*
+DEADLOCK_POLICY decides what happens when a lock request has to wait.
+The age of a transaction is its txNum, the smaller the older, see getNextTxNum().
+
+	           requester is older   requester is younger
+	WAIT_DIE   wait                 die (abort itself)
+	WOUND_WAIT wound (abort holder) wait
+
+- DETECTION lets everyone wait and breaks the cycles of the wait-for graph, fewer aborts
+- WAIT_DIE and WOUND_WAIT never build a cycle, so no graph search, lower latency but more aborts
+- WAIT_DIE aborts the requester before it waits, WOUND_WAIT aborts the holders and waits for them
+*/
+type DEADLOCK_POLICY int
+
+const (
+	DETECTION DEADLOCK_POLICY = iota
+	WAIT_DIE
+	WOUND_WAIT
 )
 
 /*
 LockTable
 
-在java中，可直接使用JUC中的RWLock来替换，而不需要自己去维护下面这三个状态
+在java中，可直接使用JUC中的RWLock来替换，而不需要自己去维护下面这两个状态
 
-基本逻辑如下，针对于每个block，维护3个东西
+基本逻辑如下，针对于每个block，维护2个东西
 - lockMap: 锁的状态，-1表示XLock，>0表示SLock，0表示无锁
-- notifyChan: 等待锁的channel，这个其实就是一个阻塞队列
-- notifyWg: 等待锁的等待组
+- notifyChan: 等待锁的channel，这个其实就是一个阻塞队列，释放锁时close掉，唤醒所有等待者
 
 此时退化成如何设计单个RWLock
 
@@ -29,138 +54,301 @@ LockTable
 R ⭕ ❌
 W ❌ ❌
 1. 对于R锁，检查是否有W锁，如果有，则阻塞等待notifyChan
-2. 对于W锁，则要同时监测两个部分，
+2. 对于W锁，检查是否有其他的R锁，调用者自己已经持有一个R锁(see ConcurrencyManager.XLock)，所以 >1 才需要等待
+
+Deadlock detection, the wait-for graph is built from two more maps:
+- holders: blk -> the transactions holding a lock on it
+- waitingOn: txNum -> the blk the transaction is blocked on
+
+	txA --waits for--> blk1 --held by--> txB --waits for--> blk2 --held by--> txA
+
+Each time a transaction is about to block, the graph is searched for a cycle back to it.
+Only the new edge can close a cycle, so the search starts from the new waiter.
+The youngest transaction, the greatest txNum, of the cycle is the victim and gets ErrDeadlock.
+
+- the blocks are keyed by value, different *fm.BlockId pointing to the same block share the same lock
+- a LockTable is shared by all transactions, see GetLockTable()
+- MAX_WAITING_TIME is kept as the last resort, e.g. a lock held by a transaction that never ends
+- the waiter that times out gets ErrLockTimeout and rolls back like a victim
 */
 type LockTable struct {
 	// blockId->lockVal, -1 indicates XLock, >0 indicates SLock, 0 indicates no lock
-	lockMap    map[*fm.BlockId]int64
-	notifyChan map[*fm.BlockId]chan struct{}
-	notifyWg   map[*fm.BlockId]*sync.WaitGroup
+	lockMap    map[fm.BlockId]int64
+	notifyChan map[fm.BlockId]chan struct{}
+	holders    map[fm.BlockId]map[int32]bool
+	waitingOn  map[int32]fm.BlockId
+	aborted    map[int32]bool // victims chosen while they were waiting, or wounded
+	policy     DEADLOCK_POLICY
 	methodLock *sync.Mutex
-	RWLock     *sync.RWMutex
+}
+
+var lockTableOnce sync.Once
+
+var lockTable *LockTable
+
+// GetLockTable returns the LockTable shared by all transactions
+func GetLockTable() *LockTable {
+	lockTableOnce.Do(func() {
+		lockTable = NewLockTable()
+	})
+	return lockTable
 }
 
 func NewLockTable() *LockTable {
+	return NewLockTableWithPolicy(DETECTION)
+}
+
+func NewLockTableWithPolicy(policy DEADLOCK_POLICY) *LockTable {
 	return &LockTable{
-		lockMap:    make(map[*fm.BlockId]int64),
-		notifyChan: make(map[*fm.BlockId]chan struct{}),
-		notifyWg:   make(map[*fm.BlockId]*sync.WaitGroup),
+		lockMap:    make(map[fm.BlockId]int64),
+		notifyChan: make(map[fm.BlockId]chan struct{}),
+		holders:    make(map[fm.BlockId]map[int32]bool),
+		waitingOn:  make(map[int32]fm.BlockId),
+		aborted:    make(map[int32]bool),
+		policy:     policy,
+		methodLock: new(sync.Mutex),
 	}
 }
 
-func (l *LockTable) SLock(blk *fm.BlockId) error {
+// SetDeadlockPolicy only affects the lock requests made afterward
+func (l *LockTable) SetDeadlockPolicy(policy DEADLOCK_POLICY) {
 	l.methodLock.Lock()
 	defer l.methodLock.Unlock()
 
-	l.initWaitingOnBlk(blk)
-
-	start := time.Now()
-	for l.hasXLock(blk) && !l.waitTooLong(start) {
-		//l.waitGivenTimeOut(blk)
-
-		func(blk *fm.BlockId) {
-			wg, exist := l.notifyWg[blk]
-			if !exist {
-				var newWg sync.WaitGroup
-				l.notifyWg[blk] = &newWg
-				wg = &newWg
-			}
+	l.policy = policy
+}
 
-			wg.Add(1)
-			defer wg.Done()
+func (l *LockTable) SLock(blk *fm.BlockId, txNum int32) error {
+	l.methodLock.Lock()
+	defer l.methodLock.Unlock()
 
-			l.methodLock.Unlock()
+	l.initWaitingOnBlk(blk)
 
-			select {
-			case <-time.After(MAX_WAITING_TIME * time.Second):
-				fmt.Println("routine wake up for timeout")
-			case <-l.notifyChan[blk]:
-				fmt.Println("routine wake up for notify channel")
-			}
+	err := l.checkWounded(blk, txNum)
+	if err != nil {
+		return err
+	}
 
-			l.methodLock.Lock()
-		}(blk)
+	start := time.Now()
+	for l.hasXLock(blk) && !l.waitTooLong(start) {
+		err := l.waitOrAbort(blk, txNum)
+		if err != nil {
+			return err
+		}
 	}
 
 	if l.hasXLock(blk) {
-		fmt.Println("SLock() fails to XLock()")
-		return errors.New("SLock() fails to XLock()")
+		return l.timeoutErr(blk, txNum)
 	}
 
 	val := l.getLockVal(blk) //counter
-	l.lockMap[blk] = val + 1
+	l.lockMap[*blk] = val + 1
+	l.addHolder(blk, txNum)
 	return nil
 }
 
-func (l *LockTable) XLock(blk *fm.BlockId) error {
+/*
+XLock the caller must have held the SLock on the blk, check the ConcurrencyManager.XLock
+*/
+func (l *LockTable) XLock(blk *fm.BlockId, txNum int32) error {
 	l.methodLock.Lock()
 	defer l.methodLock.Unlock()
 
 	l.initWaitingOnBlk(blk)
 
+	err := l.checkWounded(blk, txNum)
+	if err != nil {
+		return err
+	}
+
 	start := time.Now()
 
 	for l.hasOtherSLocks(blk) && !l.waitTooLong(start) {
-		l.waitGivenTimeOut(blk)
+		err := l.waitOrAbort(blk, txNum)
+		if err != nil {
+			return err
+		}
 	}
 
 	if l.hasOtherSLocks(blk) {
-		return errors.New("XLock() fails to SLock()")
+		return l.timeoutErr(blk, txNum)
 	}
 
-	l.lockMap[blk] = -1 // -1 indicates the mutex
+	l.lockMap[*blk] = -1 // -1 indicates the mutex
+	l.addHolder(blk, txNum)
 
 	return nil
 }
 
-func (l *LockTable) UnLock(blk *fm.BlockId) {
+func (l *LockTable) UnLock(blk *fm.BlockId, txNum int32) {
 	l.methodLock.Lock()
 	defer l.methodLock.Unlock()
 
 	val := l.getLockVal(blk)
 
-	if val >= 1 {
-		l.lockMap[blk] = val - 1
+	if val > 1 {
+		l.lockMap[*blk] = val - 1
 	} else {
-		l.lockMap[blk] = 0
-		l.notifyAll(blk)
+		delete(l.lockMap, *blk)
 	}
+	l.removeHolder(blk, txNum)
+
+	//wake up the waiters even if SLocks remain, the one left might be held by a waiting XLock()
+	l.notifyAll(blk)
 
 }
 
 func (l *LockTable) initWaitingOnBlk(blk *fm.BlockId) {
 
-	_, ok := l.notifyChan[blk]
+	_, ok := l.notifyChan[*blk]
 	if !ok {
-		l.notifyChan[blk] = make(chan struct{})
+		l.notifyChan[*blk] = make(chan struct{})
 	}
+}
 
-	_, ok = l.notifyWg[blk]
-	if !ok {
-		l.notifyWg[blk] = &sync.WaitGroup{}
+/*
+waitOrAbort registers txNum as waiting on blk and applies the DEADLOCK_POLICY before blocking.
+
+DETECTION checks the wait-for graph:
+- if txNum itself is the victim, it gives up at once
+- if another transaction of the cycle is the victim, it is marked as aborted and woken up
+*/
+func (l *LockTable) waitOrAbort(blk *fm.BlockId, txNum int32) error {
+	l.waitingOn[txNum] = *blk
+	defer delete(l.waitingOn, txNum)
+
+	switch l.policy {
+	case WAIT_DIE:
+		for holder := range l.holders[*blk] {
+			if holder != txNum && txNum > holder {
+				return l.deadlockErr(blk, txNum)
+			}
+		}
+	case WOUND_WAIT:
+		for holder := range l.holders[*blk] {
+			if holder != txNum && txNum < holder {
+				l.abort(holder)
+			}
+		}
+	default:
+		victim, found := l.findDeadlockVictim(txNum)
+		if found {
+			if victim == txNum {
+				return l.deadlockErr(blk, txNum)
+			}
+			l.abort(victim)
+		}
 	}
+
+	l.waitGivenTimeOut(blk)
+
+	return l.checkWounded(blk, txNum)
 }
 
 /*
-!key
+abort marks txNum as aborted, if it is waiting, it is woken up to find out.
+A wounded transaction which is running finds out at its next read or write, even of a block it has locked
+already, see CheckWounded(). It rolls back then and its locks wake up the wounder.
+It never finds out if it commits before that, the wounder is woken up by the commit too.
 */
-func (l *LockTable) waitGivenTimeOut(blk *fm.BlockId) {
-	wg, exist := l.notifyWg[blk]
-	if !exist {
-		var newWg sync.WaitGroup
-		l.notifyWg[blk] = &newWg
-		wg = &newWg
+func (l *LockTable) abort(txNum int32) {
+	l.aborted[txNum] = true
+	victimBlk, waiting := l.waitingOn[txNum]
+	if waiting {
+		l.notifyAll(&victimBlk)
+	}
+}
+
+// CheckWounded is asked by the ConcurrencyManager for the locks it holds already, the LockTable isn't involved otherwise
+func (l *LockTable) CheckWounded(blk *fm.BlockId, txNum int32) error {
+	l.methodLock.Lock()
+	defer l.methodLock.Unlock()
+
+	return l.checkWounded(blk, txNum)
+}
+
+func (l *LockTable) checkWounded(blk *fm.BlockId, txNum int32) error {
+	if l.aborted[txNum] {
+		delete(l.aborted, txNum)
+		return l.deadlockErr(blk, txNum)
 	}
+	return nil
+}
 
-	wg.Add(1)
-	defer wg.Done()
+func (l *LockTable) deadlockErr(blk *fm.BlockId, txNum int32) error {
+	return fmt.Errorf("transaction %d waiting on block %d of %s: %w",
+		txNum, blk.BlkNum(), blk.GetFilePath(), ErrDeadlock)
+}
+
+func (l *LockTable) timeoutErr(blk *fm.BlockId, txNum int32) error {
+	return fmt.Errorf("transaction %d waiting on block %d of %s: %w",
+		txNum, blk.BlkNum(), blk.GetFilePath(), ErrLockTimeout)
+}
+
+// endTx forgets an abort that the transaction never found out, it has committed or rolled back
+func (l *LockTable) endTx(txNum int32) {
+	l.methodLock.Lock()
+	defer l.methodLock.Unlock()
+
+	delete(l.aborted, txNum)
+}
+
+/*
+findDeadlockVictim searches the wait-for graph for a cycle going back to txNum, returns the youngest transaction in it.
+*/
+func (l *LockTable) findDeadlockVictim(txNum int32) (int32, bool) {
+	visited := make(map[int32]bool)
+	path := make([]int32, 0)
+
+	var dfs func(cur int32) bool
+	dfs = func(cur int32) bool {
+		path = append(path, cur)
+		blk, waiting := l.waitingOn[cur]
+		if waiting {
+			for holder := range l.holders[blk] {
+				if holder == cur || l.aborted[holder] {
+					continue
+				}
+				if holder == txNum {
+					return true
+				}
+				if !visited[holder] {
+					visited[holder] = true
+					if dfs(holder) {
+						return true
+					}
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+
+	if !dfs(txNum) {
+		return 0, false
+	}
+
+	victim := path[0]
+	for _, cur := range path {
+		if cur > victim {
+			victim = cur
+		}
+	}
+	return victim, true
+}
+
+/*
+!key
+
+the channel is fetched before releasing the methodLock, so a notifyAll() between Unlock() and select can't be missed
+*/
+func (l *LockTable) waitGivenTimeOut(blk *fm.BlockId) {
+	notify := l.notifyChan[*blk]
 
 	l.methodLock.Unlock()
 	select {
 	case <-time.After(MAX_WAITING_TIME * time.Second):
-		fmt.Println("routine wake up for timeout")
-	case <-l.notifyChan[blk]:
-		fmt.Println("routine wake up for notify channel")
+	case <-notify:
 	}
 
 	l.methodLock.Lock()
@@ -168,23 +356,46 @@ func (l *LockTable) waitGivenTimeOut(blk *fm.BlockId) {
 
 /*
 !key
+
+closing the channel wakes up all waiters, then a new channel is prepared for the next round
 */
 func (l *LockTable) notifyAll(blk *fm.BlockId) {
+	notify, ok := l.notifyChan[*blk]
+	if !ok {
+		return
+	}
 
-	go func() {
-		l.notifyWg[blk].Wait()
-		l.notifyChan[blk] = make(chan struct{})
-	}()
+	close(notify)
+	l.notifyChan[*blk] = make(chan struct{})
+}
 
-	close(l.notifyChan[blk])
+func (l *LockTable) addHolder(blk *fm.BlockId, txNum int32) {
+	txs, ok := l.holders[*blk]
+	if !ok {
+		txs = make(map[int32]bool)
+		l.holders[*blk] = txs
+	}
+	txs[txNum] = true
+}
+
+func (l *LockTable) removeHolder(blk *fm.BlockId, txNum int32) {
+	txs, ok := l.holders[*blk]
+	if !ok {
+		return
+	}
+	delete(txs, txNum)
+	if len(txs) == 0 {
+		delete(l.holders, *blk)
+	}
 }
 
 func (l *LockTable) hasXLock(blk *fm.BlockId) bool {
 	return l.getLockVal(blk) < 0
 }
 
+// hasOtherSLocks the SLock held by the caller itself doesn't count
 func (l *LockTable) hasOtherSLocks(blk *fm.BlockId) bool {
-	return l.getLockVal(blk) > 0
+	return l.getLockVal(blk) > 1
 }
 
 func (l *LockTable) waitTooLong(start time.Time) bool {
@@ -198,9 +409,8 @@ func (l *LockTable) waitTooLong(start time.Time) bool {
 }
 
 func (l *LockTable) getLockVal(blk *fm.BlockId) int64 {
-	val, ok := l.lockMap[blk]
+	val, ok := l.lockMap[*blk]
 	if !ok {
-		l.lockMap[blk] = 0
 		return 0
 	}
 	return val
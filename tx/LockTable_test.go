@@ -0,0 +1,370 @@
+package tx
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	fm "oh_my_godb/file_manager"
+	"testing"
+	"time"
+)
+
+/*
+prepareCrossLocks builds half of the classic deadlock:
+
+	tx1 --holds--> blk1
+	tx2 --holds--> blk2
+*/
+func prepareCrossLocks(t *testing.T, lt *LockTable, blk1, blk2 *fm.BlockId) {
+	require.Nil(t, lt.SLock(blk1, 1))
+	require.Nil(t, lt.XLock(blk1, 1))
+	require.Nil(t, lt.SLock(blk2, 2))
+	require.Nil(t, lt.XLock(blk2, 2))
+}
+
+func TestDeadlockRequesterIsVictim(t *testing.T) {
+	lt := NewLockTable()
+	blk1 := fm.NewBlockId("testfile", 1)
+	blk2 := fm.NewBlockId("testfile", 2)
+	prepareCrossLocks(t, lt, blk1, blk2)
+
+	// tx1 waits for blk2
+	done := make(chan error)
+	go func() {
+		done <- lt.SLock(fm.NewBlockId("testfile", 2), 1)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// tx2 closes the cycle, it is the youngest, so it gives up at once
+	start := time.Now()
+	err := lt.SLock(fm.NewBlockId("testfile", 1), 2)
+	require.True(t, errors.Is(err, ErrDeadlock))
+	require.Less(t, time.Since(start).Seconds(), float64(MAX_WAITING_TIME))
+
+	// tx2 rolls back, tx1 gets blk2
+	lt.UnLock(blk2, 2)
+	require.Nil(t, <-done)
+}
+
+func TestDeadlockWaiterIsVictim(t *testing.T) {
+	lt := NewLockTable()
+	blk1 := fm.NewBlockId("testfile", 1)
+	blk2 := fm.NewBlockId("testfile", 2)
+	prepareCrossLocks(t, lt, blk1, blk2)
+
+	// tx2 waits for blk1
+	victim := make(chan error)
+	go func() {
+		victim <- lt.SLock(fm.NewBlockId("testfile", 1), 2)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// tx1 closes the cycle, the waiting tx2 is younger and is woken up with ErrDeadlock
+	start := time.Now()
+	done := make(chan error)
+	go func() {
+		done <- lt.SLock(fm.NewBlockId("testfile", 2), 1)
+	}()
+
+	err := <-victim
+	require.True(t, errors.Is(err, ErrDeadlock))
+
+	lt.UnLock(blk2, 2)
+	require.Nil(t, <-done)
+	require.Less(t, time.Since(start).Seconds(), float64(MAX_WAITING_TIME))
+}
+
+func TestDeadlockOnUpgrade(t *testing.T) {
+	lt := NewLockTable()
+	blk := fm.NewBlockId("testfile", 1)
+
+	require.Nil(t, lt.SLock(blk, 1))
+	require.Nil(t, lt.SLock(blk, 2))
+
+	done := make(chan error)
+	go func() {
+		done <- lt.XLock(blk, 1)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// both hold the SLock and want the XLock
+	err := lt.XLock(blk, 2)
+	require.True(t, errors.Is(err, ErrDeadlock))
+
+	lt.UnLock(blk, 2)
+	require.Nil(t, <-done)
+}
+
+func TestDeadlockVictimRollsBack(t *testing.T) {
+	fileManager, logManager, bufferManager, versions := newConcurrencyTestManagers(t)
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	txB, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	blk1 := fm.NewBlockId("testfile", 0)
+	blk2 := fm.NewBlockId("testfile", 1)
+
+	require.Nil(t, txA.Pin(blk1))
+	require.Nil(t, txA.SetInt(blk1, 0, 1, true))
+	require.Nil(t, txB.Pin(blk2))
+	require.Nil(t, txB.SetInt(blk2, 0, 2, true))
+
+	done := make(chan error)
+	go func() {
+		err := txA.Pin(blk2)
+		if err == nil {
+			err = txA.SetInt(blk2, 0, 11, true)
+		}
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// txB is younger, it is rolled back by itself and releases blk2
+	require.Nil(t, txB.Pin(blk1))
+	err = txB.SetInt(blk1, 0, 22, true)
+	require.True(t, errors.Is(err, ErrDeadlock))
+
+	require.Nil(t, <-done)
+	val, err := txA.GetInt(blk2, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(11), val)
+	txA.Commit()
+}
+
+func TestLockTimeoutRollsBack(t *testing.T) {
+	fileManager, logManager, bufferManager, versions := newConcurrencyTestManagers(t)
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	txB, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	blk1 := fm.NewBlockId("testfile", 0)
+	blk2 := fm.NewBlockId("testfile", 1)
+
+	require.Nil(t, txA.Pin(blk1))
+	require.Nil(t, txA.SetInt(blk1, 0, 1, true))
+	require.Nil(t, txB.Pin(blk2))
+	require.Nil(t, txB.SetInt(blk2, 0, 2, true))
+
+	// no cycle, txB waits until it gives up, then it's rolled back like a victim
+	require.Nil(t, txB.Pin(blk1))
+	err = txB.SetInt(blk1, 0, 22, true)
+	require.True(t, errors.Is(err, ErrLockTimeout))
+	require.True(t, errors.Is(err, ErrDeadlock))
+
+	// blk2 is released and restored
+	start := time.Now()
+	require.Nil(t, txA.Pin(blk2))
+	val, err := txA.GetInt(blk2, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), val)
+	require.Less(t, time.Since(start).Seconds(), float64(MAX_WAITING_TIME))
+	require.Nil(t, txA.Commit())
+}
+
+func TestWaitDie(t *testing.T) {
+	lt := NewLockTableWithPolicy(WAIT_DIE)
+	blk1 := fm.NewBlockId("testfile", 1)
+	blk2 := fm.NewBlockId("testfile", 2)
+	prepareCrossLocks(t, lt, blk1, blk2)
+
+	// tx2 is younger than the holder tx1, it dies without waiting
+	start := time.Now()
+	err := lt.SLock(blk1, 2)
+	require.True(t, errors.Is(err, ErrDeadlock))
+	require.Less(t, time.Since(start).Seconds(), 0.5)
+
+	// tx1 is older than the holder tx2, it waits
+	done := make(chan error)
+	go func() {
+		done <- lt.SLock(blk2, 1)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("tx1 gets blk2 while tx2 holds the XLock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	lt.UnLock(blk2, 2)
+	require.Nil(t, <-done)
+}
+
+func TestWoundWait(t *testing.T) {
+	lt := NewLockTableWithPolicy(WOUND_WAIT)
+	blk1 := fm.NewBlockId("testfile", 1)
+	blk2 := fm.NewBlockId("testfile", 2)
+	prepareCrossLocks(t, lt, blk1, blk2)
+
+	// tx2 is younger than the holder tx1, it waits
+	wounded := make(chan error)
+	go func() {
+		wounded <- lt.SLock(blk1, 2)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// tx1 is older than the holder tx2, it wounds tx2 and waits for its rollback
+	done := make(chan error)
+	go func() {
+		done <- lt.SLock(blk2, 1)
+	}()
+
+	err := <-wounded
+	require.True(t, errors.Is(err, ErrDeadlock))
+
+	lt.UnLock(blk2, 2)
+	require.Nil(t, <-done)
+}
+
+func TestWoundedHolderAbortsOnNextRequest(t *testing.T) {
+	lt := NewLockTableWithPolicy(WOUND_WAIT)
+	blk1 := fm.NewBlockId("testfile", 1)
+	blk2 := fm.NewBlockId("testfile", 2)
+
+	require.Nil(t, lt.SLock(blk1, 2))
+	require.Nil(t, lt.XLock(blk1, 2))
+
+	// tx1 wounds the running tx2
+	done := make(chan error)
+	go func() {
+		done <- lt.SLock(blk1, 1)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	err := lt.SLock(blk2, 2)
+	require.True(t, errors.Is(err, ErrDeadlock))
+
+	lt.UnLock(blk1, 2)
+	require.Nil(t, <-done)
+}
+
+func TestWoundedHolderWakesWounderOnRelease(t *testing.T) {
+	lt := NewLockTableWithPolicy(WOUND_WAIT)
+	blk := fm.NewBlockId("testfile", 1)
+
+	require.Nil(t, lt.SLock(blk, 2))
+	require.Nil(t, lt.XLock(blk, 2))
+
+	// tx1 wounds tx2, which makes no further lock request before it ends
+	done := make(chan error)
+	go func() {
+		done <- lt.SLock(blk, 1)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	lt.UnLock(blk, 2)
+	lt.endTx(2)
+
+	select {
+	case err := <-done:
+		require.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("tx1 isn't woken up by the release of the wounded tx2")
+	}
+}
+
+func TestWoundedHolderRollsBackOnNextAccess(t *testing.T) {
+	GetLockTable().SetDeadlockPolicy(WOUND_WAIT)
+	defer GetLockTable().SetDeadlockPolicy(DETECTION)
+
+	fileManager, logManager, bufferManager, versions := newConcurrencyTestManagers(t)
+	txOld, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	txYoung, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	blk := fm.NewBlockId("testfile", 0)
+
+	require.Nil(t, txYoung.Pin(blk))
+	require.Nil(t, txYoung.SetInt(blk, 0, 22, true))
+
+	require.Nil(t, txOld.Pin(blk))
+	done := make(chan error)
+	go func() {
+		_, err := txOld.GetInt(blk, 0)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// txYoung only reads the block it has locked already, the LockTable is never asked for a lock again
+	_, err = txYoung.GetInt(blk, 0)
+	require.True(t, errors.Is(err, ErrDeadlock))
+
+	select {
+	case err = <-done:
+		require.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("txOld isn't woken up by the rollback of the wounded txYoung")
+	}
+	val, err := txOld.GetInt(blk, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), val)
+	require.Nil(t, txOld.Commit())
+}
+
+/*
+TestPoliciesNeverHang runs transactions locking random blocks in random order, so deadlocks happen all the time.
+An aborted transaction releases its locks and retries with the same txNum, i.e. it keeps its age.
+None of the lock requests may end up by the MAX_WAITING_TIME timeout.
+*/
+func TestPoliciesNeverHang(t *testing.T) {
+	policies := []DEADLOCK_POLICY{DETECTION, WAIT_DIE, WOUND_WAIT}
+	for _, policy := range policies {
+		lt := NewLockTableWithPolicy(policy)
+
+		const workers = 8
+		const txPerWorker = 10
+		const blkCount = 4
+
+		result := make(chan error, workers)
+		for w := 0; w < workers; w++ {
+			go func(w int) {
+				rnd := rand.New(rand.NewSource(int64(w)))
+				for i := 0; i < txPerWorker; i++ {
+					txNum := int32(w*txPerWorker + i + 1)
+					for {
+						held := make([]*fm.BlockId, 0)
+						var err error
+						for _, n := range rnd.Perm(blkCount)[:2] {
+							blk := fm.NewBlockId("testfile", uint64(n))
+							err = lt.SLock(blk, txNum)
+							if err != nil {
+								break
+							}
+							held = append(held, blk)
+							err = lt.XLock(blk, txNum)
+							if err != nil {
+								break
+							}
+							time.Sleep(time.Millisecond)
+						}
+						for _, blk := range held {
+							lt.UnLock(blk, txNum)
+						}
+						lt.endTx(txNum)
+
+						if err == nil {
+							break
+						}
+						if errors.Is(err, ErrLockTimeout) || !errors.Is(err, ErrDeadlock) {
+							result <- err
+							return
+						}
+						// back off, otherwise the retry grabs the lock again before the woken waiters
+						time.Sleep(time.Duration(1+rnd.Intn(5)) * time.Millisecond)
+					}
+				}
+				result <- nil
+			}(w)
+		}
+
+		for w := 0; w < workers; w++ {
+			select {
+			case err := <-result:
+				require.Nil(t, err, "policy %d", policy)
+			case <-time.After(10 * time.Second):
+				t.Fatalf("policy %d hangs", policy)
+			}
+		}
+	}
+}
@@ -14,9 +14,10 @@ type RecoveryManager struct {
 	txNum     int32
 }
 
+// NewRecoveryManager writes the START of the txn, the txn is active once it returns without an error
 func NewRecoveryManager(
 	tx *Transaction, logMgr *lm.LogFileManager,
-	bufferMgr *bm.BufferManager, txNum int32) *RecoveryManager {
+	bufferMgr *bm.BufferManager, txNum int32) (*RecoveryManager, error) {
 	rm := &RecoveryManager{
 		logMgr:    logMgr,
 		bufferMgr: bufferMgr,
@@ -26,20 +27,28 @@ func NewRecoveryManager(
 
 	p := fm.NewPageBySize(32)
 	p.SetInt(0, uint64(START))
-	p.SetInt(0, uint64(txNum))
+	p.SetInt(UINT64_LEN, uint64(txNum))
 	startRecord := logRecord.NewStartRecord(p, logMgr)
-	_, err := startRecord.WriteToLog()
+
+	txTable := getActiveTxTable()
+	txTable.latch.RLock()
+	defer txTable.latch.RUnlock()
+
+	lsn, err := startRecord.WriteToLog()
 	if err != nil {
-		return nil
+		return nil, err
 	}
+	txTable.begin(logMgr, txNum, lsn)
 
-	return rm
+	return rm, nil
 }
 
+/*
+Commit no-force, only the log is forced. The dirty pages are written back whenever the BufferManager replaces them,
+the committed changes missing in the disk are redone by Recover().
+*/
 func (r *RecoveryManager) Commit() error {
-	r.bufferMgr.FlushAll(r.txNum)
-
-	lsn, err := logRecord.WriteCommitRecordLog(r.logMgr, uint64(r.txNum))
+	lsn, err := r.writeEndLog(logRecord.WriteCommitRecordLog)
 	if err != nil {
 		return err
 	}
@@ -54,11 +63,12 @@ func (r *RecoveryManager) Commit() error {
 
 func (r *RecoveryManager) Rollback() error {
 
-	r.doRollback()
-
-	r.bufferMgr.FlushAll(r.txNum)
+	err := r.doRollback()
+	if err != nil {
+		return err
+	}
 
-	lsn, err := logRecord.WriteRollBackLog(r.logMgr, uint64(r.txNum))
+	lsn, err := r.writeEndLog(logRecord.WriteRollBackLog)
 	if err != nil {
 		return err
 	}
@@ -71,21 +81,40 @@ func (r *RecoveryManager) Rollback() error {
 	return nil
 }
 
+// writeEndLog writes the COMMIT or ROLLBACK, the txn isn't active since then
+func (r *RecoveryManager) writeEndLog(
+	write func(lgmr *lm.LogFileManager, txNum uint64) (uint64, error)) (uint64, error) {
+
+	txTable := getActiveTxTable()
+	txTable.latch.RLock()
+	defer txTable.latch.RUnlock()
+
+	lsn, err := write(r.logMgr, uint64(r.txNum))
+	if err != nil {
+		return lsn, err
+	}
+	txTable.end(r.logMgr, r.txNum)
+
+	return lsn, nil
+}
+
 // Recover if found the START but not no COMMIT found, the DBMS should automatically call Recover()
 func (r *RecoveryManager) Recover() error {
-	r.doRecover()
-
-	r.bufferMgr.FlushAll(r.txNum)
-	//CheckPoint indicates the DBMS that Recovery() is used
-	lsn, err := logRecord.WriteCheckPointToLog(r.logMgr)
+	err := r.doRecover()
 	if err != nil {
 		return err
 	}
 
-	err = r.logMgr.FlushByLSN(lsn)
+	err = r.bufferMgr.FlushAll(r.txNum)
 	if err != nil {
 		return err
 	}
+	//CheckPoint indicates the DBMS that Recovery() is used, the recovering txn ends without COMMIT
+	_, err = writeCheckpoint(r.tx.fileMgr, r.logMgr, r.bufferMgr, r.txNum)
+	if err != nil {
+		return err
+	}
+	getActiveTxTable().end(r.logMgr, r.txNum)
 
 	return nil
 }
@@ -95,9 +124,7 @@ func (r *RecoveryManager) SetInt(buffer *bm.Buffer, offset uint64, value uint64)
 	oldVal := buffer.Contents().GetInt(offset)
 	blk := buffer.Block()
 
-	buffer.Contents().SetInt(offset, value) //redundant
-
-	return logRecord.WriteSetIntLog(r.logMgr, uint64(r.txNum), blk, offset, oldVal)
+	return logRecord.WriteSetIntLog(r.logMgr, uint64(r.txNum), blk, offset, oldVal, value)
 
 }
 
@@ -106,9 +133,7 @@ func (r *RecoveryManager) SetString(buffer *bm.Buffer, offset uint64, value stri
 	oldVal := buffer.Contents().GetString(offset)
 	blk := buffer.Block()
 
-	buffer.Contents().SetString(offset, value) //redundant, consider to remove this statement
-
-	return logRecord.WriteSetStringLog(r.logMgr, uint64(r.txNum), blk, offset, oldVal)
+	return logRecord.WriteSetStringLog(r.logMgr, uint64(r.txNum), blk, offset, oldVal, value)
 
 }
 
@@ -116,7 +141,7 @@ func (r *RecoveryManager) CreateRecord(bytes []byte) LogRecordInterface {
 	page := fm.NewPageByBytes(bytes)
 	switch RECORD_TYPE(page.GetInt(0)) {
 	case CHECKPOINT:
-		return logRecord.NewCheckPointRecord()
+		return logRecord.NewCheckPointRecord(page)
 	case START:
 		return logRecord.NewStartRecord(page, r.logMgr)
 	case COMMIT:
@@ -127,51 +152,237 @@ func (r *RecoveryManager) CreateRecord(bytes []byte) LogRecordInterface {
 		return logRecord.NewSetIntRecord(page)
 	case SETSTRING:
 		return logRecord.NewSetStringRecord(page)
+	case COMPENSATION:
+		return logRecord.NewCompensationRecord(page)
 	default:
 		panic("unknown record type")
 	}
 }
 
+// compensableRecord the SETINT and SETSTRING, they write a CLR when undone
+type compensableRecord interface {
+	UpdateRecordInterface
+	WriteCompensationToLog(lgmr *lm.LogFileManager) (uint64, error)
+}
+
+// lsnRecord a log record along with its LSN
+type lsnRecord struct {
+	lsn uint64
+	rec LogRecordInterface
+}
+
 /*
-Aim for a specific txn
+Aim for a specific txn. Walks the log backwards from the end to the START of the txn.
+
+A CLR found on the way means the latest update of the txn not yet skipped has been undone already,
+as the updates are undone from the newest to the oldest.
 */
-func (r *RecoveryManager) doRollback() {
-	iter := r.logMgr.Iterator()
+func (r *RecoveryManager) doRollback() error {
+	undone := 0
+
+	iter, err := r.logMgr.Iterator()
+	if err != nil {
+		return err
+	}
 	for iter.HasNext() {
-		rec := iter.Next()
-		logRecord := r.CreateRecord(rec)
-		if logRecord.TxNumber() != uint64(r.txNum) {
-			if logRecord.Op() == START {
-				return
+		rec := r.CreateRecord(iter.Next())
+		if rec.TxNumber() != uint64(r.txNum) {
+			continue
+		}
+
+		switch rec.Op() {
+		case START:
+			return nil
+		case COMPENSATION:
+			undone += 1
+		case SETINT, SETSTRING:
+			if undone > 0 {
+				undone -= 1
+				continue
+			}
+			err := r.undo(rec.(compensableRecord))
+			if err != nil {
+				return err
 			}
-			logRecord.Undo(r.tx)
 		}
 	}
 
+	// the START isn't reached, a log block failing to be read isn't the end of the log
+	return iter.Err()
 }
 
 /*
-Aim for all txns
+Aim for all txns, the ARIES-like recovery:
+
+1. analysis: walk the log backwards to the latest CHECKPOINT, every txn without COMMIT or ROLLBACK is a loser.
+Then keep walking until the START of the losers listed by the CHECKPOINT, its BeginLSN and the smallest recLSN
+of its dirty pages, nothing older is needed. A quiescent CHECKPOINT ends the walk at its BeginLSN.
+The log ends at its first invalid record, e.g. torn by the crash, the LogFileManager drops what follows it on the start.
+
+2. redo: repeat the history forwards, including the losers and the CLRs. The record is skipped if the page LSN
+shows the page contains it already.
+
+3. undo: walk backwards and undo the losers' updates with CLRs, then end each loser with a ROLLBACK.
+
+	|START 1|SETINT 1|CHECKPOINT [1]|START 2|SETINT 2|COMMIT 1|SETSTRING 2|  crash
+	 ---------------------------- redo ---------------------------------->
+	                                 <-------------- undo 2 --------------
 */
-func (r *RecoveryManager) doRecover() {
+func (r *RecoveryManager) doRecover() error {
+	records, winners, err := r.analyze()
+	if err != nil {
+		return err
+	}
 
-	finishedTxSet := make(map[uint64]bool)
+	// redo
+	for i := len(records) - 1; i >= 0; i-- {
+		rec, ok := records[i].rec.(UpdateRecordInterface)
+		if !ok {
+			continue
+		}
+		err := r.redo(rec, records[i].lsn)
+		if err != nil {
+			return err
+		}
+	}
 
-	iter := r.logMgr.Iterator()
+	// undo
+	undone := make(map[uint64]int)
+	for _, lr := range records {
+		txNum := lr.rec.TxNumber()
+		if winners[txNum] || txNum == uint64(r.txNum) {
+			continue
+		}
+
+		switch lr.rec.Op() {
+		case START:
+			_, err := logRecord.WriteRollBackLog(r.logMgr, txNum)
+			if err != nil {
+				return err
+			}
+		case COMPENSATION:
+			undone[txNum] += 1
+		case SETINT, SETSTRING:
+			if undone[txNum] > 0 {
+				undone[txNum] -= 1
+				continue
+			}
+			err := r.undo(lr.rec.(compensableRecord))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return r.logMgr.Flush()
+}
+
+// analyze returns the records needed by the recovery, from the newest to the oldest, and the finished txns
+func (r *RecoveryManager) analyze() ([]lsnRecord, map[uint64]bool, error) {
+	records := make([]lsnRecord, 0)
+	winners := make(map[uint64]bool)
+	started := make(map[uint64]bool)
+
+	var checkpoint *logRecord.CheckPointRecord
+	var redoLSN uint64                 // nothing older is redone, known since the CHECKPOINT
+	pendingLosers := map[uint64]bool{} // the losers whose START isn't reached yet, known since the CHECKPOINT
+
+	iter, err := r.logMgr.Iterator()
+	if err != nil {
+		return nil, nil, err
+	}
 	for iter.HasNext() {
-		rec := iter.Next()
-		logRecord := r.CreateRecord(rec)
+		rec := r.CreateRecord(iter.Next())
+		lsn := iter.LSN()
 
-		/*TODO: ????*/
-		if logRecord.Op() == COMMIT || logRecord.Op() == ROLLBACK {
-			finishedTxSet[logRecord.TxNumber()] = true
+		if checkpoint != nil && len(pendingLosers) == 0 && lsn < redoLSN {
+			break
 		}
 
-		/*这个tx只有start而没有commit或rollback，说明是未完成的tx，需要回滚*/
-		existed, ok := finishedTxSet[logRecord.TxNumber()]
-		if !ok || !existed {
-			logRecord.Undo(r.tx)
+		switch rec.Op() {
+		case CHECKPOINT:
+			if checkpoint != nil {
+				continue // an older one
+			}
+			checkpoint = rec.(*logRecord.CheckPointRecord)
+			redoLSN = min(lsn, checkpoint.BeginLSN())
+			if minRecLSN, ok := checkpoint.MinRecLSN(); ok {
+				redoLSN = min(redoLSN, minRecLSN)
+			}
+			for _, txNum := range checkpoint.ActiveTxNums() {
+				if !winners[txNum] && !started[txNum] {
+					pendingLosers[txNum] = true
+				}
+			}
+			continue
+		case COMMIT, ROLLBACK:
+			winners[rec.TxNumber()] = true
+			delete(pendingLosers, rec.TxNumber())
+		case START:
+			started[rec.TxNumber()] = true
+			delete(pendingLosers, rec.TxNumber())
 		}
+
+		records = append(records, lsnRecord{lsn: lsn, rec: rec})
+	}
+	if iter.Err() != nil {
+		return nil, nil, iter.Err()
+	}
+
+	return records, winners, nil
+}
+
+func (r *RecoveryManager) redo(rec UpdateRecordInterface, lsn uint64) error {
+	blk := rec.Block()
+	err := r.tx.Pin(blk)
+	if err != nil {
+		return err
+	}
+	defer r.tx.Unpin(blk)
+
+	buff := r.tx.myBuffers.getBuffer(blk)
+	if buff.LSN() >= lsn {
+		return nil
+	}
+
+	// a torn page is repaired by the redo, see Buffer.Repair()
+	buff.Repair()
+	err = rec.Redo(r.tx)
+	if err != nil {
+		return err
+	}
+	buff.SetModified(r.txNum, lsn)
+	return nil
+}
+
+/*
+undo the CLR is logged once the value is restored, along with the page LSN, see activeTxTable.
+If the page is written back before the CLR, the update is just undone again by the recovery.
+
+A failure stops the rollback before the CLR, the update is still to be undone by a later Rollback() or the recovery.
+*/
+func (r *RecoveryManager) undo(rec compensableRecord) error {
+	blk := rec.Block()
+	err := r.tx.Pin(blk)
+	if err != nil {
+		return err
+	}
+	defer r.tx.Unpin(blk)
+
+	err = rec.Undo(r.tx)
+	if err != nil {
+		return err
 	}
 
+	txTable := getActiveTxTable()
+	txTable.latch.RLock()
+	defer txTable.latch.RUnlock()
+
+	lsn, err := rec.WriteCompensationToLog(r.logMgr)
+	if err != nil {
+		return err
+	}
+	r.tx.myBuffers.getBuffer(blk).SetModified(r.txNum, lsn)
+
+	return nil
 }
@@ -0,0 +1,348 @@
+package tx
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	bm "oh_my_godb/buffer_manager"
+	fm "oh_my_godb/file_manager"
+	lm "oh_my_godb/log_manager"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// openRecoveryTestManagers opening them again on the same storage is a restart
+func openRecoveryTestManagers(
+	t *testing.T, storage fm.Storage) (*fm.FileManager, *lm.LogFileManager, *bm.BufferManager, *VersionStore) {
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManager(fileManager, "logfile")
+	require.Nil(t, err)
+	bufferManager := bm.NewBufferManager(fileManager, logManager, 8)
+
+	return fileManager, logManager, bufferManager, NewVersionStore()
+}
+
+// readFromDisk bypasses the buffers, so only what has been written back is seen
+func readFromDisk(t *testing.T, fileManager *fm.FileManager, blk *fm.BlockId) *fm.Page {
+	p := fm.NewPageBySize(fileManager.BlockSize())
+	_, err := fileManager.Read(blk, p)
+	require.Nil(t, err)
+	return p
+}
+
+// crash drops the transaction without COMMIT or ROLLBACK, only its locks, versions and activeness are cleaned up
+func crash(txn *Transaction) {
+	txn.concurMgr.Release()
+	txn.versions.Abort(txn.txNum)
+	getActiveTxTable().end(txn.logMgr, txn.txNum)
+}
+
+// faultyLogStorage the writes of the log segments fail while failWrites is set, the reads of the failReads one too
+type faultyLogStorage struct {
+	*fm.MemStorage
+	failWrites atomic.Bool
+	failReads  atomic.Pointer[string]
+}
+
+type faultyLogFile struct {
+	fm.StorageFile
+	storage *faultyLogStorage
+	name    string
+}
+
+func (s *faultyLogStorage) Open(name string) (fm.StorageFile, error) {
+	file, err := s.MemStorage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyLogFile{StorageFile: file, storage: s, name: name}, nil
+}
+
+func (f *faultyLogFile) WriteAt(p []byte, off int64) (int, error) {
+	if strings.HasPrefix(f.name, "logfile.") && f.storage.failWrites.Load() {
+		return 0, errors.New("injected log write failure")
+	}
+	return f.StorageFile.WriteAt(p, off)
+}
+
+func (f *faultyLogFile) ReadAt(p []byte, off int64) (int, error) {
+	if name := f.storage.failReads.Load(); name != nil && *name == f.name {
+		return 0, errors.New("injected log read failure")
+	}
+	return f.StorageFile.ReadAt(p, off)
+}
+
+func TestRecoverRedoesCommittedAndUndoesUncommitted(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, logManager, bufferManager, versions := openRecoveryTestManagers(t, storage)
+	for i := 0; i < 2; i++ {
+		_, err := fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+	blk0 := fm.NewBlockId("testfile", 0)
+	blk1 := fm.NewBlockId("testfile", 1)
+
+	// the initial state is on the disk
+	tx0, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, tx0.Pin(blk1))
+	require.Nil(t, tx0.SetInt(blk1, 80, 1, true))
+	require.Nil(t, tx0.SetString(blk1, 40, "one", true))
+	require.Nil(t, tx0.Commit())
+	require.Nil(t, bufferManager.FlushAll(tx0.txNum))
+
+	// committed, but no-force leaves the pages in the buffers
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txA.Pin(blk0))
+	require.Nil(t, txA.SetInt(blk0, 80, 2, true))
+	require.Nil(t, txA.SetString(blk0, 40, "two", true))
+	require.Nil(t, txA.Commit())
+	require.Equal(t, uint64(0), readFromDisk(t, fileManager, blk0).GetInt(80))
+
+	// uncommitted, but its pages are stolen
+	txB, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txB.Pin(blk1))
+	require.Nil(t, txB.SetInt(blk1, 80, 9999, true))
+	require.Nil(t, txB.SetString(blk1, 40, "lost", true))
+	require.Nil(t, bufferManager.FlushAll(txB.txNum))
+	require.Equal(t, uint64(9999), readFromDisk(t, fileManager, blk1).GetInt(80))
+	crash(txB)
+
+	// restart
+	fileManager, logManager, bufferManager, versions = openRecoveryTestManagers(t, storage)
+	txR, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txR.Recover())
+
+	p0 := readFromDisk(t, fileManager, blk0)
+	require.Equal(t, uint64(2), p0.GetInt(80))
+	require.Equal(t, "two", p0.GetString(40))
+	p1 := readFromDisk(t, fileManager, blk1)
+	require.Equal(t, uint64(1), p1.GetInt(80))
+	require.Equal(t, "one", p1.GetString(40))
+
+	// the undo of txB is logged, from the newest: CHECKPOINT, ROLLBACK txB, CLR, CLR, START txR
+	iter, err := logManager.Iterator()
+	require.Nil(t, err)
+	ops := make([]RECORD_TYPE, 0)
+	for i := 0; i < 5 && iter.HasNext(); i++ {
+		rec := txR.recoveryMgr.CreateRecord(iter.Next())
+		if rec.Op() == ROLLBACK || rec.Op() == COMPENSATION {
+			require.Equal(t, uint64(txB.txNum), rec.TxNumber())
+		}
+		ops = append(ops, rec.Op())
+	}
+	require.Equal(t, []RECORD_TYPE{CHECKPOINT, ROLLBACK, COMPENSATION, COMPENSATION, START}, ops)
+
+	// recovering again stops at the CHECKPOINT, nothing changes
+	txR2, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txR2.Recover())
+	p1 = readFromDisk(t, fileManager, blk1)
+	require.Equal(t, uint64(1), p1.GetInt(80))
+	require.Equal(t, "one", p1.GetString(40))
+}
+
+func TestRollbackWritesCompensationRecords(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, logManager, bufferManager, versions := openRecoveryTestManagers(t, storage)
+	_, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	blk := fm.NewBlockId("testfile", 0)
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txA.Pin(blk))
+	require.Nil(t, txA.SetInt(blk, 80, 7, true))
+	require.Nil(t, txA.SetInt(blk, 80, 8, true))
+	require.Nil(t, txA.Rollback())
+
+	// the rollback is never undone again by the recovery, the history including the CLRs is redone
+	fileManager, logManager, bufferManager, versions = openRecoveryTestManagers(t, storage)
+	txR, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txR.Recover())
+	require.Equal(t, uint64(0), readFromDisk(t, fileManager, blk).GetInt(80))
+
+	compensations := 0
+	iter, err := logManager.Iterator()
+	require.Nil(t, err)
+	for iter.HasNext() {
+		rec := txR.recoveryMgr.CreateRecord(iter.Next())
+		if rec.Op() == COMPENSATION {
+			require.Equal(t, uint64(txA.txNum), rec.TxNumber())
+			compensations += 1
+		}
+	}
+	require.Equal(t, 2, compensations)
+}
+
+func TestRecoverRepairsTornPage(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, logManager, bufferManager, versions := openRecoveryTestManagers(t, storage)
+	_, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	blk := fm.NewBlockId("testfile", 0)
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txA.Pin(blk))
+	value := uint64(7<<32 | 7)
+	require.Nil(t, txA.SetInt(blk, 80, value, true))
+	require.Nil(t, txA.Commit())
+	require.Nil(t, bufferManager.FlushAll(txA.txNum))
+
+	// the write of the page is torn, the value is half old
+	file, err := storage.Open("testfile")
+	require.Nil(t, err)
+	_, err = file.WriteAt([]byte{0, 0, 0, 0}, int64(fm.BLOCK_HEADER_LEN+80+4))
+	require.Nil(t, err)
+
+	// the transactions never see the torn page
+	fileManager, logManager, bufferManager, versions = openRecoveryTestManagers(t, storage)
+	txB, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txB.Pin(blk))
+	_, err = txB.GetInt(blk, 80)
+	var corruptErr *fm.ErrCorruptBlock
+	require.True(t, errors.As(err, &corruptErr))
+	require.True(t, corruptErr.Blk.Equals(blk))
+	require.True(t, errors.As(txB.SetInt(blk, 80, 9, true), &corruptErr))
+	require.Nil(t, txB.Rollback())
+
+	// the committed value is redone from the log
+	txR, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txR.Recover())
+	require.Equal(t, value, readFromDisk(t, fileManager, blk).GetInt(80))
+}
+
+func TestRecoverLargeLogRecords(t *testing.T) {
+	storage := fm.NewMemStorage()
+	fileManager, logManager, bufferManager, versions := openRecoveryTestManagers(t, storage)
+	for i := 0; i < 2; i++ {
+		_, err := fileManager.Append("testfile")
+		require.Nil(t, err)
+	}
+	blk0 := fm.NewBlockId("testfile", 0)
+	blk1 := fm.NewBlockId("testfile", 1)
+	// the SETSTRING records hold the old and the new value, larger than a log block
+	committed := strings.Repeat("c", 300)
+	lost := strings.Repeat("l", 300)
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txA.Pin(blk0))
+	require.Nil(t, txA.Pin(blk1))
+	require.Nil(t, txA.SetString(blk0, 40, committed, true))
+	require.Nil(t, txA.SetString(blk1, 40, committed, true))
+	require.Nil(t, txA.Commit())
+	require.Nil(t, bufferManager.FlushAll(txA.txNum))
+
+	// rolled back from the fragments
+	txB, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txB.Pin(blk0))
+	require.Nil(t, txB.SetString(blk0, 40, lost, true))
+	require.Nil(t, txB.Rollback())
+	require.Equal(t, committed, readFromDisk(t, fileManager, blk0).GetString(40))
+
+	// uncommitted, but its page is stolen
+	txC, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txC.Pin(blk1))
+	require.Nil(t, txC.SetString(blk1, 40, lost, true))
+	require.Nil(t, bufferManager.FlushAll(txC.txNum))
+	crash(txC)
+
+	fileManager, logManager, bufferManager, versions = openRecoveryTestManagers(t, storage)
+	txR, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txR.Recover())
+	require.Equal(t, committed, readFromDisk(t, fileManager, blk0).GetString(40))
+	require.Equal(t, committed, readFromDisk(t, fileManager, blk1).GetString(40))
+}
+
+func TestRollbackFailsWhenLogCantBeWritten(t *testing.T) {
+	storage := &faultyLogStorage{MemStorage: fm.NewMemStorage()}
+	fileManager, logManager, bufferManager, versions := openRecoveryTestManagers(t, storage)
+	_, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	blk := fm.NewBlockId("testfile", 0)
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txA.Pin(blk))
+	require.Nil(t, txA.SetInt(blk, 80, 7, true))
+
+	// the log can't be written back for the iterator, the rollback and the recovery fail rather than panic
+	storage.failWrites.Store(true)
+	require.NotNil(t, txA.Rollback())
+	txR, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.NotNil(t, txR.Recover())
+
+	storage.failWrites.Store(false)
+	require.Nil(t, txA.Rollback())
+	require.Nil(t, txR.Recover())
+	require.Equal(t, uint64(0), readFromDisk(t, fileManager, blk).GetInt(80))
+}
+
+func TestRollbackFailsWhenLogCantBeRead(t *testing.T) {
+	storage := &faultyLogStorage{MemStorage: fm.NewMemStorage()}
+	fileManager, err := fm.NewFileManagerWithStorage(storage, 400, fm.SYNC_ON_LOG_FLUSH)
+	require.Nil(t, err)
+	logManager, err := lm.NewLogManagerWithSegmentSize(fileManager, "logfile", 1)
+	require.Nil(t, err)
+	bufferManager := bm.NewBufferManager(fileManager, logManager, 8)
+	versions := NewVersionStore()
+	_, err = fileManager.Append("testfile")
+	require.Nil(t, err)
+	blk := fm.NewBlockId("testfile", 0)
+
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txA.Pin(blk))
+	for i := uint64(1); i <= 20; i++ {
+		require.Nil(t, txA.SetInt(blk, 8*i, i, true))
+	}
+	segments := logManager.Segments()
+	require.Greater(t, len(segments), 2)
+
+	// the oldest segment holds the START and the first updates, it's not the end of the log
+	storage.failReads.Store(&segments[0])
+	require.NotNil(t, txA.Rollback())
+	txR, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.NotNil(t, txR.Recover())
+
+	// no ROLLBACK is written, the rest of the updates are undone later
+	storage.failReads.Store(nil)
+	require.Nil(t, txA.Rollback())
+	require.Nil(t, txR.Recover())
+	page := readFromDisk(t, fileManager, blk)
+	for i := uint64(1); i <= 20; i++ {
+		require.Equal(t, uint64(0), page.GetInt(8*i))
+	}
+}
+
+func TestNewTransactionFailsWhenStartCantBeLogged(t *testing.T) {
+	storage := &faultyLogStorage{MemStorage: fm.NewMemStorage()}
+	fileManager, logManager, bufferManager, versions := openRecoveryTestManagers(t, storage)
+
+	// the STARTs fill the log block, the full block can't be written back
+	storage.failWrites.Store(true)
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		_, err = NewTransaction(fileManager, logManager, bufferManager, versions)
+	}
+	require.NotNil(t, err)
+
+	storage.failWrites.Store(false)
+	txA, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txA.Commit())
+}
@@ -1,6 +1,7 @@
 package tx
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -21,59 +22,127 @@ func getNextTxNum() int32 {
 	return nextTxNum
 }
 
+/*
+ISOLATION_LEVEL
+
+- SERIALIZABLE: strict two-phase locking, readers take the SLock and block the writers
+- SNAPSHOT: readers take no lock and see the values committed before the transaction started, see VersionStore.
+Writers still take the XLock, and Commit() fails with ErrWriteConflict if another transaction committed
+one of the written values after the start.
+*/
+type ISOLATION_LEVEL int
+
+const (
+	SERIALIZABLE ISOLATION_LEVEL = iota
+	SNAPSHOT
+)
+
 type Transaction struct {
-	//concurMgr *ConcurrencyManager
+	concurMgr   *ConcurrencyManager
 	recoveryMgr *RecoveryManager
 	fileMgr     *fm.FileManager
 	logMgr      *lm.LogFileManager
 	bufferMgr   *bm.BufferManager
 	myBuffers   *BufferList
+	versions    *VersionStore
+	isolation   ISOLATION_LEVEL
+	startTs     uint64 // only for SNAPSHOT
 	txNum       int32
+	rollingBack bool // the undo may fail to pin or lock too, it doesn't roll back again
 }
 
-func (t *Transaction) RollBack() error {
-	//TODO implement me
-	panic("implement me")
+/*
+NewTransaction the versions are shared by the transactions of the same database, like the bufferMgr,
+see NewVersionStore(). It fails if the START can't be logged.
+*/
+func NewTransaction(
+	fileMgr *fm.FileManager,
+	logMgr *lm.LogFileManager,
+	bufferMgr *bm.BufferManager,
+	versions *VersionStore) (*Transaction, error) {
+	return NewTransactionWithIsolation(fileMgr, logMgr, bufferMgr, versions, SERIALIZABLE)
 }
 
-func NewTransaction(
+func NewTransactionWithIsolation(
 	fileMgr *fm.FileManager,
 	logMgr *lm.LogFileManager,
-	bufferMgr *bm.BufferManager) *Transaction {
+	bufferMgr *bm.BufferManager,
+	versions *VersionStore,
+	isolation ISOLATION_LEVEL) (*Transaction, error) {
 
 	tx := &Transaction{
 		fileMgr:   fileMgr,
 		logMgr:    logMgr,
 		bufferMgr: bufferMgr,
 		myBuffers: NewBufferList(bufferMgr),
+		versions:  versions,
+		isolation: isolation,
 		txNum:     getNextTxNum(),
 	}
 
-	//TODO: create concurMgr
-	//TODO: create recoveryMgr
+	tx.concurMgr = NewConcurrencyManager(tx.txNum)
+	if isolation == SNAPSHOT {
+		tx.startTs = tx.versions.Begin(tx.txNum)
+	}
 
-	return tx
+	recoveryMgr, err := NewRecoveryManager(tx, logMgr, bufferMgr, tx.txNum)
+	if err != nil {
+		if isolation == SNAPSHOT {
+			tx.versions.Abort(tx.txNum)
+		}
+		return nil, err
+	}
+	tx.recoveryMgr = recoveryMgr
+
+	return tx, nil
 }
 
-func (t *Transaction) Commit() {
-	t.recoveryMgr.Commit()
-	r := fmt.Sprintf("transaction %d committed\n", t.txNum)
-	log.Printf(r)
+/*
+Commit a SNAPSHOT transaction is rolled back instead if it has a write-write conflict, and returns the ErrWriteConflict.
+
+The XLocks are held until the versions are published, so the written values can't be committed by others in between.
+*/
+func (t *Transaction) Commit() error {
+	if t.isolation == SNAPSHOT {
+		err := t.versions.CheckConflict(t.txNum, t.startTs)
+		if err != nil {
+			rollbackErr := t.Rollback()
+			if rollbackErr != nil {
+				return rollbackErr
+			}
+			return err
+		}
+	}
+
+	err := t.recoveryMgr.Commit()
+	if err != nil {
+		return err
+	}
+	t.versions.Commit(t.txNum)
+
+	log.Printf("transaction %d committed\n", t.txNum)
 
+	t.concurMgr.Release()
 	t.myBuffers.UnpinAll()
+
+	return nil
 }
 
 func (t *Transaction) Rollback() error {
+	t.rollingBack = true
+	defer func() {
+		t.rollingBack = false
+	}()
+
 	err := t.recoveryMgr.Rollback()
 	if err != nil {
 		return err
 	}
+	t.versions.Abort(t.txNum)
 
-	r := fmt.Sprintf("transaction %d rolled back\n", t.txNum)
-	log.Printf(r)
-
-	//TODO: release the concurMgr
+	log.Printf("transaction %d rolled back\n", t.txNum)
 
+	t.concurMgr.Release()
 	t.myBuffers.UnpinAll()
 
 	return nil
@@ -81,60 +150,129 @@ func (t *Transaction) Rollback() error {
 
 /*
 Recover once the system shut down unexpectedly, the DBMS uses this to recover the DB state.
+It should be called by a fresh transaction before any other transaction starts.
 */
-func (t *Transaction) Recover() {
-	t.bufferMgr.FlushAll(t.txNum)
-	t.recoveryMgr.Recover()
+func (t *Transaction) Recover() error {
+	err := t.recoveryMgr.Recover()
+	if err != nil {
+		return err
+	}
+	t.versions.Commit(t.txNum)
+
+	t.concurMgr.Release()
+	t.myBuffers.UnpinAll()
+
+	return nil
 }
 
-func (t *Transaction) Pin(blk *fm.BlockId) {
-	t.myBuffers.Pin(blk)
+/*
+Pin once no buffer is freed for the blk in time, the transaction is rolled back at once to release its pins,
+like a victim of a deadlock, and the caller gets the *bm.ErrBufferAbort.
+*/
+func (t *Transaction) Pin(blk *fm.BlockId) error {
+	return t.PinWithContext(context.Background(), blk)
+}
+
+// PinWithContext like the Pin(), it waits for a buffer till the ctx is done, see BufferManager.PinWithContext()
+func (t *Transaction) PinWithContext(ctx context.Context, blk *fm.BlockId) error {
+	err := t.myBuffers.PinWithContext(ctx, blk)
+	if err != nil {
+		log.Printf("transaction %d fails to pin block %d of %s: %v\n", t.txNum, blk.BlkNum(), blk.GetFilePath(), err)
+		return t.abortOnDeadlock(err)
+	}
+	return nil
 }
 
 func (t *Transaction) Unpin(blk *fm.BlockId) {
 	t.myBuffers.Unpin(blk)
 }
 
+// bufferNotExist the blk isn't pinned by the transaction, e.g. its Pin() has failed
 func (t *Transaction) bufferNotExist(blk *fm.BlockId) error {
-	errStr := fmt.Sprintf("No buffer found for given blk %d in the file: %s\n",
-		blk.BlkNum(), blk.GetFilePath())
-
-	log.Fatal(errStr)
-	return errors.New(errStr)
+	return fmt.Errorf("transaction %d: no buffer found for block %d in the file %s",
+		t.txNum, blk.BlkNum(), blk.GetFilePath())
 }
 
-func (t *Transaction) GetInt(blk *fm.BlockId, offset uint64) (uint64, error) {
-	// TODO: use the concurMgr to add `shared lock`, read lock
-	// TODO: the lock shouldn't be explicitly released
+// pinnedBuffer returns the buffer pinned for the blk, or the *fm.ErrCorruptBlock if its page is corrupt
+func (t *Transaction) pinnedBuffer(blk *fm.BlockId) (*bm.Buffer, error) {
 	buff := t.myBuffers.getBuffer(blk)
 	if buff == nil {
-		return -1, t.bufferNotExist(blk)
+		return nil, t.bufferNotExist(blk)
+	}
+	err := buff.Corrupt()
+	if err != nil {
+		return nil, err
+	}
+	return buff, nil
+}
+
+func (t *Transaction) GetInt(blk *fm.BlockId, offset uint64) (uint64, error) {
+	if t.isolation == SNAPSHOT {
+		buff, err := t.pinnedBuffer(blk)
+		if err != nil {
+			return 0, err
+		}
+		val := t.versions.Read(t.txNum, t.startTs, blk, offset, func() any {
+			return buff.Contents().GetInt(offset)
+		})
+		return val.(uint64), nil
+	}
+
+	err := t.concurMgr.SLock(blk)
+	if err != nil {
+		return 0, t.abortOnDeadlock(err)
+	}
+
+	buff, err := t.pinnedBuffer(blk)
+	if err != nil {
+		return 0, err
 	}
 
 	return buff.Contents().GetInt(offset), nil
 }
 
 func (t *Transaction) GetString(blk *fm.BlockId, offset uint64) (string, error) {
-	// TODO: use the concurMgr to add `shared lock`, read lock
+	if t.isolation == SNAPSHOT {
+		buff, err := t.pinnedBuffer(blk)
+		if err != nil {
+			return "", err
+		}
+		val := t.versions.Read(t.txNum, t.startTs, blk, offset, func() any {
+			return buff.Contents().GetString(offset)
+		})
+		return val.(string), nil
+	}
 
-	buff := t.myBuffers.getBuffer(blk)
-	if buff == nil {
-		return "", t.bufferNotExist(blk)
+	err := t.concurMgr.SLock(blk)
+	if err != nil {
+		return "", t.abortOnDeadlock(err)
+	}
+
+	buff, err := t.pinnedBuffer(blk)
+	if err != nil {
+		return "", err
 	}
 
 	return buff.Contents().GetString(offset), nil
 }
 
 func (t *Transaction) SetInt(blk *fm.BlockId, offset uint64, val uint64, okToLog bool) error {
-	// TODO: use the concurMgr to add `exclusive lock`, write lock
+	err := t.concurMgr.XLock(blk)
+	if err != nil {
+		return t.abortOnDeadlock(err)
+	}
 
-	buff := t.myBuffers.getBuffer(blk)
-	if buff == nil {
-		return t.bufferNotExist(blk)
+	buff, err := t.pinnedBuffer(blk)
+	if err != nil {
+		return err
 	}
 
 	var lsn uint64
-	var err error
+
+	// the log record and the page LSN are seen by the checkpoint together
+	txTable := getActiveTxTable()
+	txTable.latch.RLock()
+	defer txTable.latch.RUnlock()
 
 	if okToLog {
 		lsn, err = t.recoveryMgr.SetInt(buff, offset, uint64(val))
@@ -143,6 +281,9 @@ func (t *Transaction) SetInt(blk *fm.BlockId, offset uint64, val uint64, okToLog
 		}
 	}
 
+	// once the write can't fail any more, but before touching the page, see VersionStore.Write
+	t.versions.Write(t.txNum, blk, offset, buff.Contents().GetInt(offset), val)
+
 	p := buff.Contents()
 	p.SetInt(offset, uint64(val))
 	buff.SetModified(t.txNum, lsn)
@@ -151,15 +292,22 @@ func (t *Transaction) SetInt(blk *fm.BlockId, offset uint64, val uint64, okToLog
 }
 
 func (t *Transaction) SetString(blk *fm.BlockId, offset uint64, val string, okToLog bool) error {
-	// TODO: use the concurMgr to add `exclusive lock`, write lock
+	err := t.concurMgr.XLock(blk)
+	if err != nil {
+		return t.abortOnDeadlock(err)
+	}
 
-	buff := t.myBuffers.getBuffer(blk)
-	if buff == nil {
-		return t.bufferNotExist(blk)
+	buff, err := t.pinnedBuffer(blk)
+	if err != nil {
+		return err
 	}
 
 	var lsn uint64
-	var err error
+
+	// the log record and the page LSN are seen by the checkpoint together
+	txTable := getActiveTxTable()
+	txTable.latch.RLock()
+	defer txTable.latch.RUnlock()
 
 	if okToLog {
 		lsn, err = t.recoveryMgr.SetString(buff, offset, val)
@@ -168,6 +316,9 @@ func (t *Transaction) SetString(blk *fm.BlockId, offset uint64, val string, okTo
 		}
 	}
 
+	// once the write can't fail any more, but before touching the page, see VersionStore.Write
+	t.versions.Write(t.txNum, blk, offset, buff.Contents().GetString(offset), val)
+
 	p := buff.Contents()
 	p.SetString(offset, val)
 	buff.SetModified(t.txNum, lsn)
@@ -175,28 +326,60 @@ func (t *Transaction) SetString(blk *fm.BlockId, offset uint64, val string, okTo
 	return nil
 }
 
-func (t *Transaction) Size(fileName string) uint64 {
-	// TODO: shared Lock
-	//dummyBlk := fm.NewBlockId(fileName, uint64(EOF))
-	// t.concurMgr.Slock(dummyBlk
+/*
+Size the SLock on the dummy EOF block keeps other transactions from appending to the file meanwhile.
+
+A SNAPSHOT transaction doesn't lock, it may see the blocks appended by others, but their records are still
+invisible as the slot flags written by them are versioned.
+*/
+func (t *Transaction) Size(fileName string) (uint64, error) {
+	if t.isolation == SNAPSHOT {
+		return t.fileMgr.BlockNum(fileName)
+	}
 
-	s, _ := t.fileMgr.BlockNum(fileName)
+	err := t.concurMgr.SLock(eofBlock(fileName))
+	if err != nil {
+		return 0, t.abortOnDeadlock(err)
+	}
 
-	return s
+	return t.fileMgr.BlockNum(fileName)
 }
 
-func (t *Transaction) Append(fileName string) *fm.BlockId {
-	// TODO: use the concurMgr to add `exclusive lock`, write lock
-	// dummyBlk:=fm.NewBlockId(fileName, uint64(EOF))
-	// t.concurMgr.Xlock(dummyBlk)
+func (t *Transaction) Append(fileName string) (*fm.BlockId, error) {
+	err := t.concurMgr.XLock(eofBlock(fileName))
+	if err != nil {
+		return nil, t.abortOnDeadlock(err)
+	}
 
 	blk, err := t.fileMgr.Append(fileName)
-
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	return &blk
+	return &blk, nil
+}
+
+/*
+abortOnDeadlock once the LockTable chooses this transaction as the victim of a deadlock, it is rolled back at once,
+so the other transactions of the cycle can move on. The caller still gets the ErrDeadlock.
+A lock wait timeout wraps ErrDeadlock too, see ErrLockTimeout.
+The *bm.ErrBufferAbort is a deadlock on the buffers, it's handled the same way.
+*/
+func (t *Transaction) abortOnDeadlock(err error) error {
+	var bufferAbort *bm.ErrBufferAbort
+	if !errors.Is(err, ErrDeadlock) && !errors.As(err, &bufferAbort) {
+		return err
+	}
+	if t.rollingBack {
+		return err
+	}
+
+	log.Printf("transaction %d is the victim of a deadlock, rolling back\n", t.txNum)
+	rollbackErr := t.Rollback()
+	if rollbackErr != nil {
+		return rollbackErr
+	}
+	return err
 }
 
 func (t *Transaction) BlockSize() uint64 {
@@ -0,0 +1,236 @@
+package tx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	fm "oh_my_godb/file_manager"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// ErrWriteConflict is returned by the Commit of a snapshot transaction which wrote a value committed by another one after its start
+var ErrWriteConflict = errors.New("write-write conflict")
+
+/*
+VersionStore keeps the committed versions of the values that are being written, for the snapshot transactions.
+
+The pages are still updated in place, the store only remembers what the page held before:
+
+	(blk, offset) -> |base|v1, commitTs1|v2, commitTs2|...|pending of the running writer|
+
+- base: the committed value before the first tracked write, i.e. what the page held
+- versions: the values published by Commit(), in ascending commitTs
+- writer/pending: the running transaction writing the value, at most one as writers hold the XLock
+
+A snapshot transaction reading at startTs gets the newest version with commitTs <= startTs, or the base.
+If there is no chain at all, the page holds the latest committed value and is read directly.
+
+- every write is tracked, whatever the isolation of the writer, otherwise snapshots could see uncommitted data
+- chains nobody needs any more, all versions visible to every running snapshot, are dropped by prune()
+- a VersionStore belongs to one database and is shared by its transactions, like the BufferManager
+
+A chain kept for the running snapshots waits in retired, in the order of its latest commitTs,
+so the end of a snapshot only visits the chains it may release rather than all of them:
+
+	retired: |key1, ts3|key2, ts5|key1, ts8|...   oldest snapshot at ts5 -> key1 and key2 are checked
+*/
+type VersionStore struct {
+	chains       map[versionKey]*versionChain
+	writes       map[int32][]versionKey // txNum -> the keys written by the running transaction
+	snapshots    map[int32]uint64       // txNum -> startTs of the running snapshot transactions
+	retired      []retiredChain
+	lastCommitTs uint64
+	mu           sync.Mutex
+}
+
+type versionKey struct {
+	blk    fm.BlockId
+	offset uint64
+}
+
+type version struct {
+	commitTs uint64
+	value    any // uint64 or string
+}
+
+type versionChain struct {
+	base     any
+	versions []version
+	writer   int32 // -1 if nobody is writing
+	pending  any
+}
+
+// retiredChain a stale entry, the chain has been dropped or written since, is skipped
+type retiredChain struct {
+	key      versionKey
+	chain    *versionChain
+	commitTs uint64
+}
+
+func NewVersionStore() *VersionStore {
+	return &VersionStore{
+		chains:    make(map[versionKey]*versionChain),
+		writes:    make(map[int32][]versionKey),
+		snapshots: make(map[int32]uint64),
+	}
+}
+
+// Begin registers a snapshot transaction and returns its startTs
+func (v *VersionStore) Begin(txNum int32) uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.snapshots[txNum] = v.lastCommitTs
+	return v.lastCommitTs
+}
+
+/*
+Write must be called BEFORE the page is modified, so a snapshot reader never reads a page being modified.
+
+@param before the value in the page now
+@param after the value going to be written
+*/
+func (v *VersionStore) Write(txNum int32, blk *fm.BlockId, offset uint64, before any, after any) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key := versionKey{*blk, offset}
+	chain, ok := v.chains[key]
+	if !ok {
+		chain = &versionChain{base: before, writer: -1}
+		v.chains[key] = chain
+	}
+
+	if chain.writer != txNum {
+		chain.writer = txNum
+		v.writes[txNum] = append(v.writes[txNum], key)
+	}
+	chain.pending = after
+}
+
+/*
+Read returns the value visible at startTs. The readPage is only called, under the lock of the store,
+if the page holds the visible value, so no writer can modify it meanwhile.
+*/
+func (v *VersionStore) Read(txNum int32, startTs uint64, blk *fm.BlockId, offset uint64, readPage func() any) any {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	chain, ok := v.chains[versionKey{*blk, offset}]
+	if !ok || chain.writer == txNum {
+		return readPage()
+	}
+
+	for i := len(chain.versions) - 1; i >= 0; i-- {
+		if chain.versions[i].commitTs <= startTs {
+			return chain.versions[i].value
+		}
+	}
+	return chain.base
+}
+
+/*
+CheckConflict first committer wins, a value written by txNum must not have been committed by others after startTs.
+*/
+func (v *VersionStore) CheckConflict(txNum int32, startTs uint64) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, key := range v.writes[txNum] {
+		chain := v.chains[key]
+		last := len(chain.versions) - 1
+		if last >= 0 && chain.versions[last].commitTs > startTs {
+			return fmt.Errorf("transaction %d writes block %d of %s at %d: %w",
+				txNum, key.blk.BlkNum(), key.blk.GetFilePath(), key.offset, ErrWriteConflict)
+		}
+	}
+	return nil
+}
+
+// Commit publishes the values written by txNum with a new commitTs
+func (v *VersionStore) Commit(txNum int32) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.lastCommitTs += 1
+	for _, key := range v.writes[txNum] {
+		chain := v.chains[key]
+		chain.versions = append(chain.versions, version{v.lastCommitTs, chain.pending})
+		chain.writer = -1
+		chain.pending = nil
+	}
+	v.end(txNum)
+}
+
+// Abort discards the values written by txNum, the page has been restored by the rollback
+func (v *VersionStore) Abort(txNum int32) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, key := range v.writes[txNum] {
+		chain := v.chains[key]
+		chain.writer = -1
+		chain.pending = nil
+	}
+	v.end(txNum)
+}
+
+/*
+end only the chains written by txNum, and the retired ones its snapshot may have kept, are pruned.
+*/
+func (v *VersionStore) end(txNum int32) {
+	written := v.writes[txNum]
+	delete(v.writes, txNum)
+	delete(v.snapshots, txNum)
+
+	oldestTs := v.oldestSnapshot()
+	for _, key := range written {
+		chain := v.chains[key]
+		if !v.prune(key, chain, oldestTs) {
+			v.retire(key, chain)
+		}
+	}
+
+	for len(v.retired) > 0 && v.retired[0].commitTs <= oldestTs {
+		retired := v.retired[0]
+		v.retired = v.retired[1:]
+		if v.chains[retired.key] == retired.chain {
+			v.prune(retired.key, retired.chain, oldestTs)
+		}
+	}
+}
+
+// retire a committed chain is the newest one, the chain given back by an abort may have to go before others
+func (v *VersionStore) retire(key versionKey, chain *versionChain) {
+	commitTs := chain.versions[len(chain.versions)-1].commitTs
+	i := sort.Search(len(v.retired), func(i int) bool { return v.retired[i].commitTs > commitTs })
+	v.retired = slices.Insert(v.retired, i, retiredChain{key, chain, commitTs})
+}
+
+func (v *VersionStore) oldestSnapshot() uint64 {
+	oldestTs := uint64(math.MaxUint64)
+	for _, startTs := range v.snapshots {
+		if startTs < oldestTs {
+			oldestTs = startTs
+		}
+	}
+	return oldestTs
+}
+
+/*
+prune drops the chain if its latest version is visible to all running snapshots, the page holds it.
+It returns false if the chain is kept for them. A chain being written again is left to the end of its writer.
+*/
+func (v *VersionStore) prune(key versionKey, chain *versionChain, oldestTs uint64) bool {
+	if chain.writer >= 0 {
+		return true
+	}
+	last := len(chain.versions) - 1
+	if last < 0 || chain.versions[last].commitTs <= oldestTs {
+		delete(v.chains, key)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package tx
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	fm "oh_my_godb/file_manager"
+	"testing"
+	"time"
+)
+
+func TestVersionStoreRead(t *testing.T) {
+	vs := NewVersionStore()
+	blk := fm.NewBlockId("testfile", 1)
+	page := uint64(1)
+	readPage := func() any { return page }
+
+	snapshot1 := vs.Begin(1)
+
+	// tx2 writes 2 but doesn't commit yet
+	vs.Write(2, blk, 0, page, uint64(2))
+	page = 2
+	require.Equal(t, uint64(1), vs.Read(1, snapshot1, blk, 0, readPage))
+	require.Equal(t, uint64(2), vs.Read(2, 0, blk, 0, readPage)) // its own write
+
+	vs.Commit(2)
+	snapshot3 := vs.Begin(3)
+	require.Equal(t, uint64(1), vs.Read(1, snapshot1, blk, 0, readPage))
+	require.Equal(t, uint64(2), vs.Read(3, snapshot3, blk, 0, readPage))
+
+	// once nobody needs the old version any more, the chain is dropped
+	vs.Commit(1)
+	vs.Commit(3)
+	require.Empty(t, vs.chains)
+}
+
+func TestVersionStoreRetiresChainsForSnapshots(t *testing.T) {
+	vs := NewVersionStore()
+	blk := fm.NewBlockId("testfile", 1)
+	page := map[uint64]uint64{0: 0, 8: 0}
+
+	write := func(txNum int32, offset uint64, value uint64) {
+		vs.Write(txNum, blk, offset, page[offset], value)
+		page[offset] = value
+	}
+
+	snapshot1 := vs.Begin(1)
+	write(2, 0, 2)
+	vs.Commit(2)
+	write(3, 8, 3)
+	vs.Commit(3)
+	require.Len(t, vs.chains, 2)
+	require.Len(t, vs.retired, 2)
+
+	// the aborted write goes back to the retired chain, its page is restored by the rollback
+	write(4, 0, 4)
+	vs.Abort(4)
+	page[0] = 2
+	require.Len(t, vs.chains, 2)
+	require.Equal(t, uint64(0), vs.Read(1, snapshot1, blk, 0, func() any { return page[0] }))
+
+	// neither chain is released by a transaction which touched nothing
+	vs.Commit(5)
+	require.Len(t, vs.chains, 2)
+
+	vs.Commit(1)
+	require.Empty(t, vs.chains)
+	require.Empty(t, vs.retired)
+}
+
+func TestSnapshotReaderDoesNotBlockWriter(t *testing.T) {
+	fileManager, logManager, bufferManager, versions := newConcurrencyTestManagers(t)
+	blk := fm.NewBlockId("testfile", 1)
+
+	txW, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txW.Pin(blk))
+	require.Nil(t, txW.SetInt(blk, 0, 1, true))
+	require.Nil(t, txW.SetString(blk, 8, "one", true))
+	require.Nil(t, txW.Commit())
+
+	txR, err := NewTransactionWithIsolation(fileManager, logManager, bufferManager, versions, SNAPSHOT)
+	require.Nil(t, err)
+	require.Nil(t, txR.Pin(blk))
+	val, err := txR.GetInt(blk, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), val)
+
+	// the writer isn't blocked by the reader
+	done := make(chan error)
+	txW, err = NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	go func() {
+		err := txW.Pin(blk)
+		if err == nil {
+			err = txW.SetInt(blk, 0, 2, true)
+		}
+		if err == nil {
+			err = txW.SetString(blk, 8, "two", true)
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		require.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the writer is blocked by the snapshot reader")
+	}
+
+	// neither the uncommitted nor the committed values are visible to the snapshot
+	val, err = txR.GetInt(blk, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), val)
+	require.Nil(t, txW.Commit())
+	val, err = txR.GetInt(blk, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), val)
+	str, err := txR.GetString(blk, 8)
+	require.Nil(t, err)
+	require.Equal(t, "one", str)
+	require.Nil(t, txR.Commit())
+
+	// a new snapshot sees the new values
+	txR, err = NewTransactionWithIsolation(fileManager, logManager, bufferManager, versions, SNAPSHOT)
+	require.Nil(t, err)
+	require.Nil(t, txR.Pin(blk))
+	val, err = txR.GetInt(blk, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), val)
+	require.Nil(t, txR.Commit())
+}
+
+func TestSnapshotWriteConflict(t *testing.T) {
+	fileManager, logManager, bufferManager, versions := newConcurrencyTestManagers(t)
+	blk := fm.NewBlockId("testfile", 1)
+
+	tx1, err := NewTransactionWithIsolation(fileManager, logManager, bufferManager, versions, SNAPSHOT)
+	require.Nil(t, err)
+	tx2, err := NewTransactionWithIsolation(fileManager, logManager, bufferManager, versions, SNAPSHOT)
+	require.Nil(t, err)
+
+	require.Nil(t, tx1.Pin(blk))
+	require.Nil(t, tx1.SetInt(blk, 0, 1, true))
+	require.Nil(t, tx1.Commit())
+
+	// tx2 started before tx1 committed, its write conflicts
+	require.Nil(t, tx2.Pin(blk))
+	require.Nil(t, tx2.SetInt(blk, 0, 2, true))
+	err = tx2.Commit()
+	require.True(t, errors.Is(err, ErrWriteConflict))
+
+	// tx2 has been rolled back
+	tx3, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, tx3.Pin(blk))
+	val, err := tx3.GetInt(blk, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), val)
+	require.Nil(t, tx3.Commit())
+}
+
+func TestFailedWriteIsNotVersioned(t *testing.T) {
+	storage := &faultyLogStorage{MemStorage: fm.NewMemStorage()}
+	fileManager, logManager, bufferManager, versions := openRecoveryTestManagers(t, storage)
+	_, err := fileManager.Append("testfile")
+	require.Nil(t, err)
+	blk := fm.NewBlockId("testfile", 0)
+
+	// the old snapshot keeps the chain of the value
+	txOld, err := NewTransactionWithIsolation(fileManager, logManager, bufferManager, versions, SNAPSHOT)
+	require.Nil(t, err)
+
+	txW, err := NewTransaction(fileManager, logManager, bufferManager, versions)
+	require.Nil(t, err)
+	require.Nil(t, txW.Pin(blk))
+
+	// the records fill the log block, the full block can't be written back
+	storage.failWrites.Store(true)
+	written := uint64(0)
+	for val := uint64(1); val < 1000; val++ {
+		if txW.SetInt(blk, 0, val, true) != nil {
+			break
+		}
+		written = val
+	}
+	require.Less(t, written, uint64(999))
+	storage.failWrites.Store(false)
+	require.Nil(t, txW.Commit())
+
+	// the page never got the failed value, neither does the committed version
+	txS, err := NewTransactionWithIsolation(fileManager, logManager, bufferManager, versions, SNAPSHOT)
+	require.Nil(t, err)
+	require.Nil(t, txS.Pin(blk))
+	val, err := txS.GetInt(blk, 0)
+	require.Nil(t, err)
+	require.Equal(t, written, val)
+	require.Nil(t, txS.Commit())
+	require.Nil(t, txOld.Commit())
+}
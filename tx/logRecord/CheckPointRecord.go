@@ -1,38 +1,169 @@
 package logRecord
 
 import (
+	"fmt"
 	"math"
 	fm "oh_my_godb/file_manager"
 	lg "oh_my_godb/log_manager"
-	"oh_my_godb/tx"
+	"sort"
+	"strings"
 )
 
+/*
+<CHECKPOINT [3 5] [testfile:1@42]>
+
+<OP BeginLSN ActiveTxNums DirtyPages>
+
+- BeginLSN, where the log ends once the checkpoint begins. A page dirtied later may be written back before the DirtyPages
+are taken, without being synced, so the changes from the BeginLSN on may miss in the disk
+- ActiveTxNums, the transactions running when the checkpoint is written. Their START may be older than the checkpoint
+- DirtyPages, the blocks not written back yet, along with their recLSN. The changes older than the smallest recLSN are in the disk
+
+A checkpoint without active transactions and dirty pages is quiescent, nothing before its BeginLSN is needed by the recovery.
+*/
+
 type CheckPointRecord struct {
+	beginLSN     uint64
+	activeTxNums []uint64
+	dirtyPages   map[fm.BlockId]uint64
 }
 
-func NewCheckPointRecord() *CheckPointRecord {
-	return &CheckPointRecord{}
+/*
+NewCheckPointRecord the page's layout is:
+
+| CHECKPOINT | beginLSN | txCount | txNum_0 | ... | dirtyCount | fileName_0 | blkNum_0 | recLSN_0 | ... |
+*/
+func NewCheckPointRecord(p *fm.Page) *CheckPointRecord {
+	c := &CheckPointRecord{
+		activeTxNums: make([]uint64, 0),
+		dirtyPages:   make(map[fm.BlockId]uint64),
+	}
+
+	pos := UINT64_LEN
+	c.beginLSN = p.GetInt(pos)
+	pos += UINT64_LEN
+	txCount := p.GetInt(pos)
+	pos += UINT64_LEN
+	for i := uint64(0); i < txCount; i++ {
+		c.activeTxNums = append(c.activeTxNums, p.GetInt(pos))
+		pos += UINT64_LEN
+	}
+
+	dirtyCount := p.GetInt(pos)
+	pos += UINT64_LEN
+	for i := uint64(0); i < dirtyCount; i++ {
+		fileName := p.GetString(pos)
+		pos += fm.MaxLengthForStr(fileName)
+		blkNum := p.GetInt(pos)
+		pos += UINT64_LEN
+		c.dirtyPages[*fm.NewBlockId(fileName, blkNum)] = p.GetInt(pos)
+		pos += UINT64_LEN
+	}
+
+	return c
 }
 
-func (c *CheckPointRecord) Op() tx.RECORD_TYPE {
-	return tx.CHECKPOINT
+func (c *CheckPointRecord) Op() RECORD_TYPE {
+	return CHECKPOINT
 }
 
 func (c *CheckPointRecord) TxNumber() uint64 {
 	return math.MaxUint64 //它没有对应的交易号
 }
 
-func (c *CheckPointRecord) Undo(_ tx.TransactionInterface) {
-	return
+func (c *CheckPointRecord) Undo(_ TransactionInterface) error {
+	return nil
+}
+
+func (c *CheckPointRecord) Redo(_ TransactionInterface) error {
+	return nil
+}
+
+// BeginLSN the redo starts from it at the latest
+func (c *CheckPointRecord) BeginLSN() uint64 {
+	return c.beginLSN
+}
+
+func (c *CheckPointRecord) ActiveTxNums() []uint64 {
+	return c.activeTxNums
+}
+
+func (c *CheckPointRecord) DirtyPages() map[fm.BlockId]uint64 {
+	return c.dirtyPages
+}
+
+// MinRecLSN returns false if no page is dirty
+func (c *CheckPointRecord) MinRecLSN() (uint64, bool) {
+	if len(c.dirtyPages) == 0 {
+		return 0, false
+	}
+
+	minLSN := uint64(math.MaxUint64)
+	for _, recLSN := range c.dirtyPages {
+		minLSN = min(minLSN, recLSN)
+	}
+	return minLSN, true
 }
 
 func (c *CheckPointRecord) ToString() string {
-	return "<CHECKPOINT>"
+	if len(c.activeTxNums) == 0 && len(c.dirtyPages) == 0 {
+		return "<CHECKPOINT>"
+	}
+
+	pages := make([]string, 0, len(c.dirtyPages))
+	for _, blk := range sortedBlocks(c.dirtyPages) {
+		pages = append(pages, fmt.Sprintf("%s:%d@%d", blk.GetFilePath(), blk.BlkNum(), c.dirtyPages[blk]))
+	}
+	return fmt.Sprintf("<CHECKPOINT %v [%s]>", c.activeTxNums, strings.Join(pages, " "))
 }
 
-func WriteCheckPointToLog(lgmr *lg.LogFileManager) (uint64, error) {
-	rec := make([]byte, tx.UINT64_LEN)
+func WriteCheckPointToLog(lgmr *lg.LogFileManager,
+	beginLSN uint64, activeTxNums []uint64, dirtyPages map[fm.BlockId]uint64) (uint64, error) {
+
+	recLen := UINT64_LEN + UINT64_LEN + UINT64_LEN + uint64(len(activeTxNums))*UINT64_LEN + UINT64_LEN
+	for blk := range dirtyPages {
+		recLen += fm.MaxLengthForStr(blk.GetFilePath()) + 2*UINT64_LEN
+	}
+
+	rec := make([]byte, recLen)
 	p := fm.NewPageByBytes(rec)
-	p.SetInt(0, uint64(tx.CHECKPOINT))
+	p.SetInt(0, uint64(CHECKPOINT))
+
+	pos := UINT64_LEN
+	p.SetInt(pos, beginLSN)
+	pos += UINT64_LEN
+	p.SetInt(pos, uint64(len(activeTxNums)))
+	pos += UINT64_LEN
+	for _, txNum := range activeTxNums {
+		p.SetInt(pos, txNum)
+		pos += UINT64_LEN
+	}
+
+	p.SetInt(pos, uint64(len(dirtyPages)))
+	pos += UINT64_LEN
+	for _, blk := range sortedBlocks(dirtyPages) {
+		p.SetString(pos, blk.GetFilePath())
+		pos += fm.MaxLengthForStr(blk.GetFilePath())
+		p.SetInt(pos, blk.BlkNum())
+		pos += UINT64_LEN
+		p.SetInt(pos, dirtyPages[blk])
+		pos += UINT64_LEN
+	}
+
 	return lgmr.AppendLogRecordIntoPage(rec)
 }
+
+// sortedBlocks the dirty pages by the file and the block number, so the same table is always encoded and shown alike
+func sortedBlocks(dirtyPages map[fm.BlockId]uint64) []fm.BlockId {
+	blks := make([]fm.BlockId, 0, len(dirtyPages))
+	for blk := range dirtyPages {
+		blks = append(blks, blk)
+	}
+	sort.Slice(blks, func(i, j int) bool {
+		if blks[i].GetFilePath() != blks[j].GetFilePath() {
+			return blks[i].GetFilePath() < blks[j].GetFilePath()
+		}
+		return blks[i].BlkNum() < blks[j].BlkNum()
+	})
+	return blks
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	fm "oh_my_godb/file_manager"
 	lg "oh_my_godb/log_manager"
-	"oh_my_godb/tx"
 )
 
 type CommitRecord struct {
@@ -13,20 +12,26 @@ type CommitRecord struct {
 
 func NewCommitRecord(p *fm.Page) *CommitRecord {
 	return &CommitRecord{
-		tx_num: p.GetInt(tx.UINT64_LEN),
+		tx_num: p.GetInt(UINT64_LEN),
 	}
 }
 
-func (r *CommitRecord) Op() tx.RECORD_TYPE {
-	return tx.COMMIT
+func (r *CommitRecord) Op() RECORD_TYPE {
+	return COMMIT
 }
 
 func (r *CommitRecord) TxNumber() uint64 {
 	return r.tx_num
 }
 
-func (r *CommitRecord) Undo(_ tx.TransactionInterface) {
+func (r *CommitRecord) Undo(_ TransactionInterface) error {
 	//它没有回滚操作
+	return nil
+}
+
+func (r *CommitRecord) Redo(_ TransactionInterface) error {
+	//nothing to redo
+	return nil
 }
 
 func (r *CommitRecord) ToString() string {
@@ -34,10 +39,10 @@ func (r *CommitRecord) ToString() string {
 }
 
 func WriteCommitRecordLog(lgmr *lg.LogFileManager, tx_num uint64) (uint64, error) {
-	rec := make([]byte, 2*tx.UINT64_LEN)
+	rec := make([]byte, 2*UINT64_LEN)
 	p := fm.NewPageByBytes(rec)
-	p.SetInt(0, uint64(tx.COMMIT))
-	p.SetInt(tx.UINT64_LEN, tx_num)
+	p.SetInt(0, uint64(COMMIT))
+	p.SetInt(UINT64_LEN, tx_num)
 
 	return lgmr.AppendLogRecordIntoPage(rec)
 }
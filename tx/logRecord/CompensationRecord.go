@@ -0,0 +1,143 @@
+package logRecord
+
+import (
+	"fmt"
+	fm "oh_my_godb/file_manager"
+	lg "oh_my_godb/log_manager"
+)
+
+/*
+<COMPENSATION, 2, testfile, 1, 80, SETINT, 1>
+
+<OP TxNum FileName BlkNum Offset ValueType Value>
+
+- a compensation log record(CLR) is written when an update is undone, the Value is the before-image of that update
+- a CLR is redo-only, it is never undone. The recovery counts the CLRs of a transaction to skip the updates already undone
+*/
+
+const COMPENSATION_RECORD_FORMAT = "<COMPENSATION %d %d %d %v>"
+
+type CompensationRecord struct {
+	txNum     uint64
+	offset    uint64
+	valueType RECORD_TYPE // SETINT or SETSTRING
+	intVal    uint64
+	strVal    string
+	blk       *fm.BlockId
+}
+
+/*
+NewCompensationRecord the page's layout is:
+
+| COMPENSATION | txNum | fileName | blkNum | offset | valueType | value |
+*/
+func NewCompensationRecord(p *fm.Page) *CompensationRecord {
+	txNumPos := UINT64_LEN
+	txNum := p.GetInt(txNumPos)
+
+	fileNamePos := txNumPos + UINT64_LEN
+	fileName := p.GetString(fileNamePos)
+
+	blkNumPos := fileNamePos + fm.MaxLengthForStr(fileName)
+	blkNum := p.GetInt(blkNumPos)
+
+	offsetPos := blkNumPos + UINT64_LEN
+	offset := p.GetInt(offsetPos)
+
+	valueTypePos := offsetPos + UINT64_LEN
+	valueType := RECORD_TYPE(p.GetInt(valueTypePos))
+
+	rec := &CompensationRecord{
+		txNum:     txNum,
+		offset:    offset,
+		valueType: valueType,
+		blk:       fm.NewBlockId(fileName, blkNum),
+	}
+
+	valuePos := valueTypePos + UINT64_LEN
+	if valueType == SETINT {
+		rec.intVal = p.GetInt(valuePos)
+	} else {
+		rec.strVal = p.GetString(valuePos)
+	}
+
+	return rec
+}
+
+func (c *CompensationRecord) Op() RECORD_TYPE {
+	return COMPENSATION
+}
+
+func (c *CompensationRecord) TxNumber() uint64 {
+	return c.txNum
+}
+
+func (c *CompensationRecord) Block() *fm.BlockId {
+	return c.blk
+}
+
+func (c *CompensationRecord) ToString() string {
+	var val any = c.strVal
+	if c.valueType == SETINT {
+		val = c.intVal
+	}
+	return fmt.Sprintf(COMPENSATION_RECORD_FORMAT, c.txNum, c.blk.BlkNum(), c.offset, val)
+}
+
+func (c *CompensationRecord) Undo(_ TransactionInterface) error {
+	//redo-only
+	return nil
+}
+
+func (c *CompensationRecord) Redo(tx TransactionInterface) error {
+	err := tx.Pin(c.blk)
+	if err != nil {
+		return err
+	}
+	defer tx.Unpin(c.blk)
+	if c.valueType == SETINT {
+		return tx.SetInt(c.blk, c.offset, c.intVal, false)
+	}
+	return tx.SetString(c.blk, c.offset, c.strVal, false)
+}
+
+func WriteIntCompensationLog(lgmr *lg.LogFileManager, txNum uint64,
+	blk *fm.BlockId, offset uint64, val uint64) (uint64, error) {
+
+	rec, valuePos := newCompensationBytes(txNum, blk, offset, SETINT, UINT64_LEN)
+	fm.NewPageByBytes(rec).SetInt(valuePos, val)
+
+	return lgmr.AppendLogRecordIntoPage(rec)
+}
+
+func WriteStringCompensationLog(lgmr *lg.LogFileManager, txNum uint64,
+	blk *fm.BlockId, offset uint64, val string) (uint64, error) {
+
+	rec, valuePos := newCompensationBytes(txNum, blk, offset, SETSTRING, fm.MaxLengthForStr(val))
+	fm.NewPageByBytes(rec).SetString(valuePos, val)
+
+	return lgmr.AppendLogRecordIntoPage(rec)
+}
+
+// newCompensationBytes fills everything but the value, returns the record and where the value goes
+func newCompensationBytes(txNum uint64, blk *fm.BlockId, offset uint64,
+	valueType RECORD_TYPE, valueLen uint64) ([]byte, uint64) {
+
+	txNumPos := UINT64_LEN
+	fileNamePos := txNumPos + UINT64_LEN
+	blkNumPos := fileNamePos + fm.MaxLengthForStr(blk.GetFilePath())
+	offsetPos := blkNumPos + UINT64_LEN
+	valueTypePos := offsetPos + UINT64_LEN
+	valuePos := valueTypePos + UINT64_LEN
+
+	rec := make([]byte, valuePos+valueLen)
+	p := fm.NewPageByBytes(rec)
+	p.SetInt(0, uint64(COMPENSATION))
+	p.SetInt(txNumPos, txNum)
+	p.SetString(fileNamePos, blk.GetFilePath())
+	p.SetInt(blkNumPos, blk.BlkNum())
+	p.SetInt(offsetPos, offset)
+	p.SetInt(valueTypePos, uint64(valueType))
+
+	return rec, valuePos
+}
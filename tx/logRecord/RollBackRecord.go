@@ -4,7 +4,6 @@ import (
 	"fmt"
 	fm "oh_my_godb/file_manager"
 	lg "oh_my_godb/log_manager"
-	"oh_my_godb/tx"
 )
 
 type RollBackRecord struct {
@@ -13,20 +12,26 @@ type RollBackRecord struct {
 
 func NewRollBackRecord(p *fm.Page) *RollBackRecord {
 	return &RollBackRecord{
-		tx_num: p.GetInt(tx.UINT64_LEN),
+		tx_num: p.GetInt(UINT64_LEN),
 	}
 }
 
-func (r *RollBackRecord) Op() tx.RECORD_TYPE {
-	return tx.ROLLBACK
+func (r *RollBackRecord) Op() RECORD_TYPE {
+	return ROLLBACK
 }
 
 func (r *RollBackRecord) TxNumber() uint64 {
 	return r.tx_num
 }
 
-func (r *RollBackRecord) Undo(_ tx.TransactionInterface) {
+func (r *RollBackRecord) Undo(_ TransactionInterface) error {
 	//它没有回滚操作
+	return nil
+}
+
+func (r *RollBackRecord) Redo(_ TransactionInterface) error {
+	//nothing to redo
+	return nil
 }
 
 func (r *RollBackRecord) ToString() string {
@@ -34,10 +39,10 @@ func (r *RollBackRecord) ToString() string {
 }
 
 func WriteRollBackLog(lgmr *lg.LogFileManager, tx_num uint64) (uint64, error) {
-	rec := make([]byte, 2*tx.UINT64_LEN)
+	rec := make([]byte, 2*UINT64_LEN)
 	p := fm.NewPageByBytes(rec)
-	p.SetInt(0, uint64(tx.ROLLBACK))
-	p.SetInt(tx.UINT64_LEN, tx_num)
+	p.SetInt(0, uint64(ROLLBACK))
+	p.SetInt(UINT64_LEN, tx_num)
 
 	return lgmr.AppendLogRecordIntoPage(rec)
 }
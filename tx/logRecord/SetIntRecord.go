@@ -4,82 +4,124 @@ import (
 	"fmt"
 	fm "oh_my_godb/file_manager"
 	lg "oh_my_godb/log_manager"
-	"oh_my_godb/tx"
 )
 
+/*
+<SETINT, 2, testfile, 1, 80, 1, 2>
+
+<OP TxNum FileName BlkNum Offset OldValue NewValue>
+
+- OldValue, the before-image, is used by Undo
+- NewValue, the after-image, is used by Redo
+*/
+
+const SET_INT_RECORD_FORMAT = "<SETINT %d %d %d %d %d>"
+
 type SetIntRecord struct {
-	txNum  uint64
-	offset uint64
-	value  uint64
-	blk    *fm.BlockId
+	txNum    uint64
+	offset   uint64
+	oldValue uint64
+	newValue uint64
+	blk      *fm.BlockId
 }
 
+/*
+NewSetIntRecord the page's layout is:
+
+| SETINT | txNum | fileName | blkNum | offset | oldValue | newValue |
+*/
 func NewSetIntRecord(p *fm.Page) *SetIntRecord {
 
-	txNumPos := tx.UINT64_LEN
+	txNumPos := UINT64_LEN
 	txNum := p.GetInt(txNumPos)
 
-	fileNamePos := txNumPos + tx.UINT64_LEN
+	fileNamePos := txNumPos + UINT64_LEN
 	filename := p.GetString(fileNamePos)
 
 	blkNumPos := fileNamePos + fm.MaxLengthForStr(filename)
 	blkNum := p.GetInt(blkNumPos)
 	blk := fm.NewBlockId(filename, blkNum)
 
-	offsetPos := blkNumPos + tx.UINT64_LEN
+	offsetPos := blkNumPos + UINT64_LEN
 	offset := p.GetInt(offsetPos)
 
-	valuePos := offsetPos + tx.UINT64_LEN
-	value := p.GetInt(valuePos)
+	oldValuePos := offsetPos + UINT64_LEN
+	oldValue := p.GetInt(oldValuePos)
+
+	newValuePos := oldValuePos + UINT64_LEN
+	newValue := p.GetInt(newValuePos)
 
 	return &SetIntRecord{
-		txNum:  txNum,
-		offset: offset,
-		value:  value,
-		blk:    blk,
+		txNum:    txNum,
+		offset:   offset,
+		oldValue: oldValue,
+		newValue: newValue,
+		blk:      blk,
 	}
 }
 
-func (s *SetIntRecord) Op() tx.RECORD_TYPE {
-	return tx.SETINT
+func (s *SetIntRecord) Op() RECORD_TYPE {
+	return SETINT
 }
 
 func (s *SetIntRecord) TxNumber() uint64 {
 	return s.txNum
 }
 
+func (s *SetIntRecord) Block() *fm.BlockId {
+	return s.blk
+}
+
 func (s *SetIntRecord) ToString() string {
-	str := fmt.Sprintf("<SETINT %d %d %d %d>", s.txNum, s.blk.BlkNum(),
-		s.offset, s.value)
+	str := fmt.Sprintf(SET_INT_RECORD_FORMAT, s.txNum, s.blk.BlkNum(),
+		s.offset, s.oldValue, s.newValue)
 
 	return str
 }
 
-func (s *SetIntRecord) Undo(tx tx.TransactionInterface) {
-	tx.Pin(s.blk)
-	tx.SetInt(s.blk, s.offset, s.value, false) //将原来的字符串写回去
-	tx.Unpin(s.blk)
+func (s *SetIntRecord) Undo(tx TransactionInterface) error {
+	err := tx.Pin(s.blk)
+	if err != nil {
+		return err
+	}
+	defer tx.Unpin(s.blk)
+	return tx.SetInt(s.blk, s.offset, s.oldValue, false) //将原来的值写回去
+}
+
+func (s *SetIntRecord) Redo(tx TransactionInterface) error {
+	err := tx.Pin(s.blk)
+	if err != nil {
+		return err
+	}
+	defer tx.Unpin(s.blk)
+	return tx.SetInt(s.blk, s.offset, s.newValue, false)
+}
+
+// WriteCompensationToLog writes the CLR of this record, it restores the oldValue
+func (s *SetIntRecord) WriteCompensationToLog(lgmr *lg.LogFileManager) (uint64, error) {
+	return WriteIntCompensationLog(lgmr, s.txNum, s.blk, s.offset, s.oldValue)
 }
 
 func WriteSetIntLog(log_manager *lg.LogFileManager, tx_num uint64,
-	blk *fm.BlockId, offset uint64, val uint64) (uint64, error) {
+	blk *fm.BlockId, offset uint64, oldVal uint64, newVal uint64) (uint64, error) {
 
-	tpos := tx.UINT64_LEN
-	fpos := tpos + tx.UINT64_LEN
-	p := fm.NewPageBySize(1)
+	tpos := UINT64_LEN
+	fpos := tpos + UINT64_LEN
 	bpos := fpos + fm.MaxLengthForStr(blk.GetFilePath())
-	opos := bpos + tx.UINT64_LEN
-	vpos := opos + tx.UINT64_LEN
-	rec_len := vpos + tx.UINT64_LEN
+	opos := bpos + UINT64_LEN
+	ovpos := opos + UINT64_LEN
+	nvpos := ovpos + UINT64_LEN
+	rec_len := nvpos + UINT64_LEN
 	rec := make([]byte, rec_len)
 
-	p = fm.NewPageByBytes(rec)
-	p.SetInt(0, uint64(tx.SETSTRING))
+	p := fm.NewPageByBytes(rec)
+	p.SetInt(0, uint64(SETINT))
 	p.SetInt(tpos, tx_num)
 	p.SetString(fpos, blk.GetFilePath())
 	p.SetInt(bpos, blk.BlkNum())
 	p.SetInt(opos, offset)
-	p.SetInt(vpos, val)
+	p.SetInt(ovpos, oldVal)
+	p.SetInt(nvpos, newVal)
 
 	return log_manager.AppendLogRecordIntoPage(rec)
 }
@@ -4,103 +4,128 @@ import (
 	"fmt"
 	fm "oh_my_godb/file_manager"
 	lm "oh_my_godb/log_manager"
-	"oh_my_godb/tx"
 )
 
 /*
  <SETSTRING, 2, testfile, 1, 40, one, two>
 
-This can be transformed into
- <SETSTRING 2 testfile 1 40 one>
- <SETSTRING 2 testfile 1 40 two>
+ <OP TxNum FileName BlkNum Offset OldValue NewValue>
 
- <OP TxNum FileName BlkNum Offset Value>
+- OldValue, the before-image, is used by Undo
+- NewValue, the after-image, is used by Redo
 */
 
-const SET_STRING_RECORD_FORMAT = "<SETSTRING %d %d %d %s>"
+const SET_STRING_RECORD_FORMAT = "<SETSTRING %d %d %d %s %s>"
 
 type SetStringRecord struct {
-	txNum  uint64
-	offset uint64 // the offset of the record in the block
-	value  string
-	blk    *fm.BlockId
+	txNum    uint64
+	offset   uint64 // the offset of the record in the block
+	oldValue string
+	newValue string
+	blk      *fm.BlockId
 }
 
 /*
 NewSetStringRecord the page's layout is:
 
-| txNum | fileName | blkNum | offset | value |
+| SETSTRING | txNum | fileName | blkNum | offset | oldValue | newValue |
 */
 func NewSetStringRecord(p *fm.Page) *SetStringRecord {
-	txNumPos := tx.UINT64_LEN
+	txNumPos := UINT64_LEN
 	txNum := p.GetInt(txNumPos)
 
-	fileNamePos := txNumPos + tx.UINT64_LEN
+	fileNamePos := txNumPos + UINT64_LEN
 	fileName := p.GetString(fileNamePos)
 
 	blkNumPos := fileNamePos + fm.MaxLengthForStr(fileName)
 	blkNum := p.GetInt(blkNumPos)
 
-	offsetPos := blkNumPos + tx.UINT64_LEN
+	offsetPos := blkNumPos + UINT64_LEN
 	offset := p.GetInt(offsetPos)
 
-	valuePos := offsetPos + tx.UINT64_LEN
-	value := p.GetString(valuePos)
+	oldValuePos := offsetPos + UINT64_LEN
+	oldValue := p.GetString(oldValuePos)
+
+	newValuePos := oldValuePos + fm.MaxLengthForStr(oldValue)
+	newValue := p.GetString(newValuePos)
 
 	return &SetStringRecord{
-		txNum:  txNum,
-		offset: offset,
-		value:  value,
-		blk:    fm.NewBlockId(fileName, blkNum),
+		txNum:    txNum,
+		offset:   offset,
+		oldValue: oldValue,
+		newValue: newValue,
+		blk:      fm.NewBlockId(fileName, blkNum),
 	}
 }
 
-func (s *SetStringRecord) Op() tx.RECORD_TYPE {
-	return tx.SETSTRING
+func (s *SetStringRecord) Op() RECORD_TYPE {
+	return SETSTRING
 }
 
 func (s *SetStringRecord) TxNumber() uint64 {
 	return s.txNum
 }
 
+func (s *SetStringRecord) Block() *fm.BlockId {
+	return s.blk
+}
+
 func (s *SetStringRecord) ToString() string {
-	str := fmt.Sprintf("<SETSTRING %d %d %d %s>", s.txNum, s.blk.BlkNum(), s.offset, s.value)
+	str := fmt.Sprintf(SET_STRING_RECORD_FORMAT, s.txNum, s.blk.BlkNum(), s.offset, s.oldValue, s.newValue)
 	return str
 }
 
-func (s *SetStringRecord) Undo(tx tx.TransactionInterface) {
-	tx.Pin(s.blk)
+func (s *SetStringRecord) Undo(tx TransactionInterface) error {
+	err := tx.Pin(s.blk)
+	if err != nil {
+		return err
+	}
+	defer tx.Unpin(s.blk)
 	//the tx will use this info to roll back
-	tx.SetString(s.blk, s.offset, s.value, false)
-	tx.Unpin(s.blk)
+	return tx.SetString(s.blk, s.offset, s.oldValue, false)
+}
+
+func (s *SetStringRecord) Redo(tx TransactionInterface) error {
+	err := tx.Pin(s.blk)
+	if err != nil {
+		return err
+	}
+	defer tx.Unpin(s.blk)
+	return tx.SetString(s.blk, s.offset, s.newValue, false)
+}
+
+// WriteCompensationToLog writes the CLR of this record, it restores the oldValue
+func (s *SetStringRecord) WriteCompensationToLog(lgmr *lm.LogFileManager) (uint64, error) {
+	return WriteStringCompensationLog(lgmr, s.txNum, s.blk, s.offset, s.oldValue)
 }
 
 func WriteSetStringLog(
 	lm *lm.LogFileManager, txNum uint64,
-	blk *fm.BlockId, offset uint64, value string) (uint64, error) {
+	blk *fm.BlockId, offset uint64, oldValue string, newValue string) (uint64, error) {
 
-	txNumPos := tx.UINT64_LEN
+	txNumPos := UINT64_LEN
 
-	fileNamePos := txNumPos + tx.UINT64_LEN
-
-	page := fm.NewPageBySize(1)
+	fileNamePos := txNumPos + UINT64_LEN
 
 	blockNumPos := fileNamePos + fm.MaxLengthForStr(blk.GetFilePath())
 
-	offsetPos := blockNumPos + tx.UINT64_LEN
+	offsetPos := blockNumPos + UINT64_LEN
+
+	oldValuePos := offsetPos + UINT64_LEN
 
-	valuePos := offsetPos + tx.UINT64_LEN
+	newValuePos := oldValuePos + fm.MaxLengthForStr(oldValue)
 
-	rec_len := valuePos + fm.MaxLengthForStr(value)
+	rec_len := newValuePos + fm.MaxLengthForStr(newValue)
 	rec := make([]byte, rec_len)
 
-	page = fm.NewPageByBytes(rec)
-	page.SetInt(0, uint64(tx.SETSTRING))
+	page := fm.NewPageByBytes(rec)
+	page.SetInt(0, uint64(SETSTRING))
 	page.SetInt(txNumPos, txNum)
 	page.SetString(fileNamePos, blk.GetFilePath())
 	page.SetInt(blockNumPos, blk.BlkNum())
 	page.SetInt(offsetPos, offset)
-	page.SetString(valuePos, value)
+	page.SetString(oldValuePos, oldValue)
+	page.SetString(newValuePos, newValue)
 
 	return lm.AppendLogRecordIntoPage(rec)
 }
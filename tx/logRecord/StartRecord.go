@@ -4,7 +4,6 @@ import (
 	"fmt"
 	fm "oh_my_godb/file_manager"
 	log "oh_my_godb/log_manager"
-	"oh_my_godb/tx"
 )
 
 // <START, 1>  // start transaction 1
@@ -20,7 +19,7 @@ NewStartRecord  the page contains something like "<START 1>", the start is an ui
 */
 func NewStartRecord(p *fm.Page, logManager *log.LogFileManager) *StartRecord {
 
-	txNum := p.GetInt(tx.UINT64_LEN) //just over the START, the first 64bits
+	txNum := p.GetInt(UINT64_LEN) //just over the START, the first 64bits
 	return &StartRecord{
 		txNum:      txNum,
 		logManager: logManager,
@@ -28,16 +27,20 @@ func NewStartRecord(p *fm.Page, logManager *log.LogFileManager) *StartRecord {
 
 }
 
-func (s *StartRecord) Op() tx.RECORD_TYPE {
-	return tx.START
+func (s *StartRecord) Op() RECORD_TYPE {
+	return START
 }
 
 func (s *StartRecord) TxNumber() uint64 {
 	return s.txNum
 }
 
-func (s *StartRecord) Undo(_ tx.TransactionInterface) {
-	return
+func (s *StartRecord) Undo(_ TransactionInterface) error {
+	return nil
+}
+
+func (s *StartRecord) Redo(_ TransactionInterface) error {
+	return nil
 }
 
 func (s *StartRecord) ToString() string {
@@ -45,10 +48,10 @@ func (s *StartRecord) ToString() string {
 }
 
 func (s *StartRecord) WriteToLog() (uint64, error) {
-	record := make([]byte, 2*tx.UINT64_LEN)
+	record := make([]byte, 2*UINT64_LEN)
 	p := fm.NewPageByBytes(record)
-	p.SetInt(uint64(0), uint64(tx.START)) // set the START
-	p.SetInt(tx.UINT64_LEN, s.txNum)      // set txNum
+	p.SetInt(uint64(0), uint64(START)) // set the START
+	p.SetInt(UINT64_LEN, s.txNum)      // set txNum
 
 	return s.logManager.AppendLogRecordIntoPage(record)
 }
@@ -0,0 +1,57 @@
+package logRecord
+
+import fm "oh_my_godb/file_manager"
+
+/*
+TransactionInterface is what a log record needs from a transaction to undo or redo itself.
+It lives here rather than in tx, otherwise tx -> logRecord -> tx becomes an import cycle.
+*/
+type TransactionInterface interface {
+	Commit() error
+	Rollback() error
+	Recover() error
+	Pin(blk *fm.BlockId) error
+	Unpin(blk *fm.BlockId)
+	GetInt(blk *fm.BlockId, offset uint64) (uint64, error)
+	GetString(blk *fm.BlockId, offset uint64) (string, error)
+	SetInt(blk *fm.BlockId, offset uint64, val uint64, okToLog bool) error
+	SetString(blk *fm.BlockId, offset uint64, value string, okToLog bool) error
+	AvailableBuffers() uint64
+	Size(fileName string) (uint64, error)
+	Append(fileName string) (*fm.BlockId, error)
+	BlockSize() uint64
+}
+type RECORD_TYPE uint64
+
+const (
+	CHECKPOINT RECORD_TYPE = iota
+	START
+	COMMIT
+	ROLLBACK
+	SETINT
+	SETSTRING
+	COMPENSATION
+)
+
+const (
+	UINT64_LEN = uint64(8)
+	EOF        = -1
+)
+
+/*
+LogRecordInterface Undo writes the before-image back, Redo writes the after-image again.
+Both of them are no-ops for the records which don't modify any block.
+*/
+type LogRecordInterface interface {
+	Op() RECORD_TYPE
+	TxNumber() uint64
+	Undo(tx TransactionInterface) error
+	Redo(tx TransactionInterface) error
+	ToString() string
+}
+
+// UpdateRecordInterface the records modifying a block, i.e. SETINT, SETSTRING and COMPENSATION
+type UpdateRecordInterface interface {
+	LogRecordInterface
+	Block() *fm.BlockId
+}
@@ -11,7 +11,7 @@ import (
 )
 
 func TestStartRecord(t *testing.T) {
-	fileManager, err := fm.NewFileManager("recordtest", 400)
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 400, fm.SYNC_ON_LOG_FLUSH)
 	if err != nil {
 		t.Error(err)
 	}
@@ -33,7 +33,9 @@ func TestStartRecord(t *testing.T) {
 	_, err = startRecord.WriteToLog()
 	require.Nil(t, err)
 
-	it := logManager.Iterator()
+	it, err := logManager.Iterator()
+
+	require.Nil(t, err)
 	rec := it.Next()
 	recOp := binary.LittleEndian.Uint64(rec[0:8])
 	recTxNum := binary.LittleEndian.Uint64(rec[8:16])
@@ -43,7 +45,7 @@ func TestStartRecord(t *testing.T) {
 }
 
 func TestSetStringRecord(t *testing.T) {
-	fileManager, err := fm.NewFileManager("recordtest", 400)
+	fileManager, err := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 400, fm.SYNC_ON_LOG_FLUSH)
 	if err != nil {
 		t.Error(err)
 	}
@@ -55,6 +57,7 @@ func TestSetStringRecord(t *testing.T) {
 	// Test Writing And Reading
 	// simulate client write something into the blk
 	str := "original string"
+	newStr := "new string"
 	blkNum := uint64(1)
 
 	dummyBlk := fm.NewBlockId("dummy_id", blkNum)
@@ -63,19 +66,21 @@ func TestSetStringRecord(t *testing.T) {
 	offset := uint64(13)
 
 	// as the client write "original string" into the blk, generate a setStringRecord
-	// the logFile now should have something like: <SETSTRING 1 dummy_id 13 original string>
-	_, err = logRecord.WriteSetStringLog(logManager, txNum, dummyBlk, offset, str)
+	// the logFile now should have something like: <SETSTRING 1 dummy_id 13 original string new string>
+	_, err = logRecord.WriteSetStringLog(logManager, txNum, dummyBlk, offset, str, newStr)
 	if err != nil {
 		return
 	}
 
-	iter := logManager.Iterator()
+	iter, err := logManager.Iterator()
+
+	require.Nil(t, err)
 	rec := iter.Next()
 
-	// read the <SETSTRING 1 dummy_id 13 original string>  back
+	// read the <SETSTRING 1 dummy_id 13 original string new string>  back
 	logPage := fm.NewPageByBytes(rec)
 	setStr := logRecord.NewSetStringRecord(logPage)
-	setStr_exp := fmt.Sprintf(logRecord.SET_STRING_RECORD_FORMAT, txNum, blkNum, offset, str)
+	setStr_exp := fmt.Sprintf(logRecord.SET_STRING_RECORD_FORMAT, txNum, blkNum, offset, str, newStr)
 	require.Equal(t, setStr.ToString(), setStr_exp)
 
 	/*--------------------------------------------------*/
@@ -87,21 +92,27 @@ func TestSetStringRecord(t *testing.T) {
 
 	txStub := NewTxStub(page)
 	//rewrite the page in txStub with the "original string"
-	setStr.Undo(txStub)
+	require.Nil(t, setStr.Undo(txStub))
 
 	setString_recovery := page.GetString(offset)
 
 	// str := "original string"
 	require.Equal(t, setString_recovery, str)
 
+	/*--------------------------------------------------*/
+	//Test Redo
+
+	require.Nil(t, setStr.Redo(txStub))
+	require.Equal(t, newStr, page.GetString(offset))
 }
 
 func TestCommitRecord(t *testing.T) {
-	file_manager, _ := fm.NewFileManager("recordtest", 400)
+	file_manager, _ := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 400, fm.SYNC_ON_LOG_FLUSH)
 	log_manager, _ := lm.NewLogManager(file_manager, "commit")
 	tx_num := uint64(13)
 	logRecord.WriteCommitRecordLog(log_manager, tx_num)
-	iter := log_manager.Iterator()
+	iter, err := log_manager.Iterator()
+	require.Nil(t, err)
 	rec := iter.Next()
 	pp := fm.NewPageByBytes(rec)
 
@@ -112,17 +123,34 @@ func TestCommitRecord(t *testing.T) {
 }
 
 func TestCheckPointRecord(t *testing.T) {
-	file_manager, _ := fm.NewFileManager("recordtest", 400)
+	file_manager, _ := fm.NewFileManagerWithStorage(fm.NewMemStorage(), 400, fm.SYNC_ON_LOG_FLUSH)
 	log_manager, _ := lm.NewLogManager(file_manager, "checkpoint")
-	logRecord.WriteCheckPointToLog(log_manager)
-	iter := log_manager.Iterator()
+	logRecord.WriteCheckPointToLog(log_manager, 1, nil, nil)
+	iter, err := log_manager.Iterator()
+	require.Nil(t, err)
 	rec := iter.Next()
 	pp := fm.NewPageByBytes(rec)
 	val := pp.GetInt(0)
 
 	require.Equal(t, val, uint64(CHECKPOINT))
 
-	check_point_rec := logRecord.NewCheckPointRecord()
+	check_point_rec := logRecord.NewCheckPointRecord(pp)
 	expected_str := "<CHECKPOINT>"
 	require.Equal(t, expected_str, check_point_rec.ToString())
+
+	// the fuzzy one
+	dirtyPages := map[fm.BlockId]uint64{
+		*fm.NewBlockId("testfile", 1): 42, *fm.NewBlockId("testfile", 10): 50, *fm.NewBlockId("afile", 2): 45}
+	logRecord.WriteCheckPointToLog(log_manager, 7, []uint64{3, 5}, dirtyPages)
+	iter, err = log_manager.Iterator()
+	require.Nil(t, err)
+	check_point_rec = logRecord.NewCheckPointRecord(fm.NewPageByBytes(iter.Next()))
+
+	require.Equal(t, uint64(7), check_point_rec.BeginLSN())
+	require.Equal(t, []uint64{3, 5}, check_point_rec.ActiveTxNums())
+	require.Equal(t, dirtyPages, check_point_rec.DirtyPages())
+	minRecLSN, ok := check_point_rec.MinRecLSN()
+	require.True(t, ok)
+	require.Equal(t, uint64(42), minRecLSN)
+	require.Equal(t, "<CHECKPOINT [3 5] [afile:2@45 testfile:1@42 testfile:10@50]>", check_point_rec.ToString())
 }
@@ -12,53 +12,55 @@ func NewTxStub(p *fm.Page) *TxStub {
 	}
 }
 
-func (t *TxStub) Commit() {
-
+func (t *TxStub) Commit() error {
+	return nil
 }
 
-func (t *TxStub) RollBack() {
-
+func (t *TxStub) Rollback() error {
+	return nil
 }
 
-func (t *TxStub) Recover() {
-
+func (t *TxStub) Recover() error {
+	return nil
 }
 
-func (t *TxStub) Pin(_ *fm.BlockId) {
-
+func (t *TxStub) Pin(_ *fm.BlockId) error {
+	return nil
 }
 
 func (t *TxStub) Unpin(_ *fm.BlockId) {
 
 }
-func (t *TxStub) GetInt(_ *fm.BlockId, offset uint64) uint64 {
+func (t *TxStub) GetInt(_ *fm.BlockId, offset uint64) (uint64, error) {
 
-	return t.p.GetInt(offset)
+	return t.p.GetInt(offset), nil
 }
 
-func (t *TxStub) GetString(_ *fm.BlockId, offset uint64) string {
+func (t *TxStub) GetString(_ *fm.BlockId, offset uint64) (string, error) {
 	val := t.p.GetString(offset)
-	return val
+	return val, nil
 }
 
-func (t *TxStub) SetInt(_ *fm.BlockId, offset uint64, val uint64, _ bool) {
+func (t *TxStub) SetInt(_ *fm.BlockId, offset uint64, val uint64, _ bool) error {
 	t.p.SetInt(offset, val)
+	return nil
 }
 
-func (t *TxStub) SetString(_ *fm.BlockId, offset uint64, val string, _ bool) {
+func (t *TxStub) SetString(_ *fm.BlockId, offset uint64, val string, _ bool) error {
 	t.p.SetString(offset, val)
+	return nil
 }
 
 func (t *TxStub) AvailableBuffers() uint64 {
 	return 0
 }
 
-func (t *TxStub) Size(_ string) uint64 {
-	return 0
+func (t *TxStub) Size(_ string) (uint64, error) {
+	return 0, nil
 }
 
-func (t *TxStub) Append(_ string) *fm.BlockId {
-	return nil
+func (t *TxStub) Append(_ string) (*fm.BlockId, error) {
+	return nil, nil
 }
 
 func (t *TxStub) BlockSize() uint64 {